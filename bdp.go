@@ -0,0 +1,147 @@
+package main
+
+import (
+	"time"
+)
+
+// bdpPingData identifies the PING frames sent to measure the bandwidth-delay
+// product, so that their acknowledgements are not mistaken for others.
+const bdpPingData = 0x4244502D50494E47 // "BDP-PING"
+
+const (
+	// bdpAlpha weights new round trip times once enough have been taken
+	bdpAlpha = 0.9
+	// bdpBeta is how much of the current window a sample has to fill
+	// before the window is grown
+	bdpBeta = 0.66
+	// bdpGamma is how much larger than the sample the window is made
+	bdpGamma = 2
+)
+
+// bdpWindowUpdatePolicy replenishes windows early enough that a full
+// window can arrive within one round trip, which the estimator needs to
+// see before it grows the window.
+var bdpWindowUpdatePolicy WindowUpdatePolicy = ThresholdPolicy{0.25}
+
+// bdpEstimator estimates the bandwidth-delay product of a connection by
+// counting the DATA received during a PING round trip, so that receive
+// windows can be grown to keep the link full.  This follows the estimator
+// in grpc-go.
+type bdpEstimator struct {
+	clock Clock
+	// bdp is the current estimate, which is used as the window size
+	bdp uint32
+	// max caps bdp
+	max uint32
+
+	pingSent    bool
+	sentAt      time.Time
+	sample      uint32
+	sampleCount uint64
+	// rtt is a moving average of round trip times, in seconds
+	rtt float64
+	// bwMax is the highest bandwidth seen, in bytes per second
+	bwMax float64
+}
+
+func newBDPEstimator(clock Clock, initial uint32, max uint32) *bdpEstimator {
+	if max > maxWindowSize {
+		max = maxWindowSize
+	}
+
+	return &bdpEstimator{clock: clock, bdp: initial, max: max}
+}
+
+// add records n bytes of received DATA and returns true if a PING should be
+// sent to start a new sample.
+func (b *bdpEstimator) add(n uint32) bool {
+	if b.bdp >= b.max {
+		return false
+	}
+
+	if !b.pingSent {
+		b.pingSent = true
+		b.sentAt = b.clock.Now()
+		b.sample = n
+		b.sampleCount++
+		return true
+	}
+
+	b.sample += n
+	return false
+}
+
+// calculate is called when our PING is acknowledged, and returns the new
+// window size if the estimate grew.
+func (b *bdpEstimator) calculate() (uint32, bool) {
+	if !b.pingSent {
+		return 0, false
+	}
+	b.pingSent = false
+
+	rttSample := b.clock.Now().Sub(b.sentAt).Seconds()
+	if b.sampleCount < 10 {
+		b.rtt += (rttSample - b.rtt) / float64(b.sampleCount)
+	} else {
+		b.rtt += (rttSample - b.rtt) * bdpAlpha
+	}
+	if b.rtt <= 0 {
+		return 0, false
+	}
+
+	bwCurrent := float64(b.sample) / (b.rtt * 1.5)
+	if bwCurrent > b.bwMax {
+		b.bwMax = bwCurrent
+	}
+
+	if float64(b.sample) < bdpBeta*float64(b.bdp) || bwCurrent != b.bwMax || b.bdp >= b.max {
+		return 0, false
+	}
+
+	bdp := bdpGamma * float64(b.sample)
+	if bdp > float64(b.max) {
+		bdp = float64(b.max)
+	}
+	if uint32(bdp) <= b.bdp {
+		return 0, false
+	}
+	b.bdp = uint32(bdp)
+
+	return b.bdp, true
+}
+
+// sampleBandwidth feeds received DATA to the estimator, starting a round
+// trip measurement if one is not already underway.
+func (c *Connection) sampleBandwidth(f DATA) error {
+	c.mu.Lock()
+	sendPing := c.bdp != nil && c.bdp.add(uint32(flowControlledLength(f)))
+	c.mu.Unlock()
+
+	if !sendPing {
+		return nil
+	}
+
+	return c.writeFrame(PING{OpaqueData: bdpPingData})
+}
+
+// growReceiveWindows is called when the bandwidth-delay product estimate
+// grows.  The connection window is opened with WINDOW_UPDATE and stream
+// windows through SETTINGS_INITIAL_WINDOW_SIZE.
+func (c *Connection) growReceiveWindows() error {
+	c.mu.Lock()
+	size, grew := c.bdp.calculate()
+	delta := int64(size) - c.recvWindowSize
+	if !grew || delta <= 0 {
+		c.mu.Unlock()
+		return nil
+	}
+	c.recvWindowSize = int64(size)
+	c.recvWindow += delta
+	c.mu.Unlock()
+
+	if err := c.writeFrame(WINDOW_UPDATE{0, uint32(delta)}); err != nil {
+		return err
+	}
+
+	return c.UpdateSettings([]Parameter{{SETTINGS_INITIAL_WINDOW_SIZE, size}})
+}
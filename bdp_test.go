@@ -0,0 +1,219 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+type linkEvent struct {
+	at time.Time
+	f  Frame
+}
+
+// simulatedLink is an in-memory link between a Connection and a peer that
+// uploads on stream 1 as fast as the bandwidth and its send windows allow.
+// Frames take latency to arrive in either direction.
+type simulatedLink struct {
+	t     *testing.T
+	c     *Connection
+	conn  *MockConn
+	clock *fakeClock
+
+	latency   time.Duration
+	bandwidth int64 // bytes per second
+
+	// The peer's send windows
+	connWindow   int64
+	streamWindow int64
+
+	toConnection []linkEvent
+	toPeer       []linkEvent
+	delivered    int64
+}
+
+func newSimulatedLink(t *testing.T, latency time.Duration, bandwidth int64, maxReceiveWindow uint32) *simulatedLink {
+	clock := newFakeClock()
+	server, conn := NewTestServer()
+	server.Clock = clock
+	server.MaxReceiveWindow = maxReceiveWindow
+	conn.readData = [][]byte{[]byte(preface), SETTINGS{}.Marshal()}
+
+	c, err := server.InitiateConn(conn)
+	assert.Nil(t, err)
+	conn.written = conn.written[0:0]
+	assert.Nil(t, c.handleFrame(settingsAck()))
+	NewTestStream(t, c, 1)
+
+	return &simulatedLink{
+		t:            t,
+		c:            c,
+		conn:         conn,
+		clock:        clock,
+		latency:      latency,
+		bandwidth:    bandwidth,
+		connWindow:   defaultInitialWindowSize,
+		streamWindow: defaultInitialWindowSize,
+	}
+}
+
+// run simulates the link in one millisecond steps, returning how many bytes
+// the connection received.
+func (l *simulatedLink) run(d time.Duration) int64 {
+	start := l.delivered
+	step := time.Millisecond
+
+	for end := l.clock.Now().Add(d); l.clock.Now().Before(end); l.clock.Advance(step) {
+		now := l.clock.Now()
+
+		n := l.bandwidth * int64(step) / int64(time.Second)
+		if n > l.connWindow {
+			n = l.connWindow
+		}
+		if n > l.streamWindow {
+			n = l.streamWindow
+		}
+		if n > 0 {
+			l.connWindow -= n
+			l.streamWindow -= n
+			l.toConnection = append(l.toConnection, linkEvent{now.Add(l.latency), DATA{StreamId: 1, Data: string(make([]byte, n))}})
+		}
+
+		var due []linkEvent
+		due, l.toConnection = dueEvents(l.toConnection, now)
+		for _, e := range due {
+			assert.Nil(l.t, l.c.handleFrame(e.f))
+			if data, ok := e.f.(DATA); ok {
+				l.delivered += int64(len(data.Data))
+				assert.Nil(l.t, l.c.Consumed(1, len(data.Data)))
+			}
+		}
+
+		for _, f := range readAllFrames(l.t, l.conn.written) {
+			l.toPeer = append(l.toPeer, linkEvent{now.Add(l.latency), f})
+		}
+		l.conn.written = l.conn.written[0:0]
+
+		due, l.toPeer = dueEvents(l.toPeer, now)
+		for _, e := range due {
+			l.peerReceive(now, e.f)
+		}
+	}
+
+	return l.delivered - start
+}
+
+func (l *simulatedLink) peerReceive(now time.Time, f Frame) {
+	switch f := f.(type) {
+	case WINDOW_UPDATE:
+		if f.StreamId == 0 {
+			l.connWindow += int64(f.WindowSizeIncrement)
+		} else {
+			l.streamWindow += int64(f.WindowSizeIncrement)
+		}
+	case PING:
+		l.toConnection = append(l.toConnection, linkEvent{now.Add(l.latency), pingAck(f.OpaqueData)})
+	case SETTINGS:
+		for _, p := range f.Parameters {
+			if p.Id == SETTINGS_INITIAL_WINDOW_SIZE {
+				l.streamWindow += int64(p.Value) - l.c.streams.initialRecvWindow
+			}
+		}
+		l.toConnection = append(l.toConnection, linkEvent{now.Add(l.latency), settingsAck()})
+	}
+}
+
+func dueEvents(events []linkEvent, now time.Time) ([]linkEvent, []linkEvent) {
+	i := 0
+	for i < len(events) && !events[i].at.After(now) {
+		i++
+	}
+	return events[0:i], events[i:]
+}
+
+func TestBDPEstimatorSkipsSmallSamples(t *testing.T) {
+	clock := newFakeClock()
+	b := newBDPEstimator(clock, 65535, 1<<24)
+
+	assert.True(t, b.add(1000))
+	assert.False(t, b.add(1000), "Only one PING should be outstanding")
+	clock.Advance(100 * time.Millisecond)
+
+	_, grew := b.calculate()
+	assert.False(t, grew, "Sample was too small to fill the window")
+	assert.True(t, b.add(1000), "A new sample should have started")
+}
+
+func TestBDPEstimatorGrowsWindow(t *testing.T) {
+	clock := newFakeClock()
+	b := newBDPEstimator(clock, 65535, 1<<24)
+
+	assert.True(t, b.add(30000))
+	b.add(30000)
+	clock.Advance(100 * time.Millisecond)
+
+	size, grew := b.calculate()
+	assert.True(t, grew)
+	assert.Equal(t, size, uint32(120000))
+}
+
+func TestBDPEstimatorRespectsCap(t *testing.T) {
+	clock := newFakeClock()
+	b := newBDPEstimator(clock, 65535, 100000)
+
+	b.add(60000)
+	clock.Advance(100 * time.Millisecond)
+
+	size, grew := b.calculate()
+	assert.True(t, grew)
+	assert.Equal(t, size, uint32(100000))
+	assert.False(t, b.add(60000), "No more samples should be taken at the cap")
+}
+
+func TestBDPPingAckGrowsConnectionWindows(t *testing.T) {
+	c, conn, clock := NewTestConnection(nil)
+	c.bdp = newBDPEstimator(clock, defaultInitialWindowSize, 1<<20)
+	NewTestStream(t, c, 1)
+
+	assert.Nil(t, c.handleFrame(DATA{StreamId: 1, Data: string(make([]byte, 50000))}))
+	assert.Equal(t, readAllFrames(t, conn.written), []Frame{PING{OpaqueData: bdpPingData}})
+	conn.written = conn.written[0:0]
+
+	clock.Advance(50 * time.Millisecond)
+	assert.Nil(t, c.handleFrame(pingAck(bdpPingData)))
+
+	assert.Equal(t, readAllFrames(t, conn.written), []Frame{
+		WINDOW_UPDATE{0, 100000 - defaultInitialWindowSize},
+		SETTINGS{Parameters: []Parameter{{SETTINGS_INITIAL_WINDOW_SIZE, 100000}}},
+	})
+	assert.Equal(t, c.recvWindowSize, int64(100000))
+}
+
+func TestPingIsAcknowledged(t *testing.T) {
+	c, conn, _ := NewTestConnection(nil)
+
+	assert.Nil(t, c.handleFrame(PING{OpaqueData: 42}))
+
+	assert.Equal(t, readAllFrames(t, conn.written), []Frame{pingAck(42)})
+}
+
+func TestBDPAutoTuningOverHighLatencyLink(t *testing.T) {
+	const bandwidth = 10 << 20 // 10MB/s
+	latency := 50 * time.Millisecond
+
+	fixed := newSimulatedLink(t, latency, bandwidth, 0)
+	fixed.run(2 * time.Second)
+	fixedThroughput := fixed.run(time.Second)
+
+	tuned := newSimulatedLink(t, latency, bandwidth, 4<<20)
+	tuned.run(2 * time.Second)
+	tunedThroughput := tuned.run(time.Second)
+
+	assert.True(t, fixedThroughput < 1<<20,
+		"A 64KB window should have limited a 100ms round trip to under 1MB/s, got %d", fixedThroughput)
+	assert.True(t, tunedThroughput > 8<<20,
+		"Auto-tuning should have nearly filled the link, got %d", tunedThroughput)
+	assert.True(t, tuned.c.recvWindowSize <= 4<<20, "Window should not have exceeded the cap")
+	assert.Equal(t, tuned.c.recvWindowSize, tuned.c.streams.initialRecvWindow,
+		"Stream windows should have grown with the connection window")
+}
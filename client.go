@@ -1,9 +1,179 @@
 package main
 
 import (
+	"fmt"
 	"net"
 )
 
 type Client struct {
-	conn net.Conn
+	Config
+}
+
+// GoAwayError is returned for streams that cannot be used because the peer
+// sent GOAWAY.  Streams we opened with identifiers above LastStreamId were
+// not processed by the peer, so their requests can be retried on a new
+// connection.
+// http://tools.ietf.org/html/rfc9113#section-6.8
+type GoAwayError struct {
+	// StreamId is the stream that failed, or 0 when a new stream could
+	// not be opened
+	StreamId            uint32
+	LastStreamId        uint32
+	ErrorCode           ErrCode
+	AdditionalDebugData string
+}
+
+func (e GoAwayError) Error() string {
+	return fmt.Sprintf("GoAwayError: %q (stream %d, last stream %d, %s)",
+		e.AdditionalDebugData, e.StreamId, e.LastStreamId, e.ErrorCode)
+}
+
+// Retryable is true when the peer did not process the stream.
+func (e GoAwayError) Retryable() bool {
+	return e.StreamId == 0 || e.StreamId > e.LastStreamId
+}
+
+// Dial connects to an HTTP/2 server over TCP, with prior knowledge that it
+// speaks HTTP/2.
+// http://tools.ietf.org/html/rfc9113#section-3.3
+func (cl *Client) Dial(address string) (*Connection, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return cl.InitiateConn(conn)
+}
+
+// InitiateConn sends the client connection preface and exchanges SETTINGS
+// frames.
+// http://tools.ietf.org/html/rfc9113#section-3.4
+func (cl *Client) InitiateConn(conn Conn) (*Connection, error) {
+	if _, err := conn.Write([]byte(preface)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c := newConnection(conn, conn, cl.Clock, false)
+	if err := cl.start(c); err != nil {
+		c.closeWithError(err)
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// OpenStream allocates a stream and sends fields on it as a request's
+// header block.  Once the peer has sent GOAWAY no more streams can be
+// opened, and a retryable GoAwayError is returned.
+func (c *Connection) OpenStream(fields []HeaderField, endStream bool) (uint32, error) {
+	// writeMu is held until the HEADERS are written so that streams are
+	// opened in order
+	c.writeMu.Lock()
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		c.writeMu.Unlock()
+		return 0, ErrConnectionClosed
+	}
+	if c.peerGoAway != nil {
+		c.mu.Unlock()
+		c.writeMu.Unlock()
+		return 0, *c.peerGoAway
+	}
+	s, err := c.streams.newLocalStream()
+	if err == nil {
+		f := HEADERS{StreamId: s.Id}
+		f.Flags.END_STREAM = endStream
+		err = c.streams.send(f)
+	}
+	c.mu.Unlock()
+
+	if err != nil {
+		c.writeMu.Unlock()
+		return 0, err
+	}
+
+	err = c.writer.WriteHeaders(s.Id, fields, endStream)
+	c.writeMu.Unlock()
+	if err != nil {
+		// The peer may never have seen the stream, so it is closed without
+		// sending RST_STREAM
+		c.mu.Lock()
+		s.close(closedByLocalReset)
+		c.streams.update(s, nil)
+		c.mu.Unlock()
+		c.releaseStream(s.Id)
+
+		return 0, err
+	}
+
+	return s.Id, nil
+}
+
+// CanOpenStream is false once the connection has closed or the peer has
+// sent GOAWAY.
+func (c *Connection) CanOpenStream() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return !c.closed && c.peerGoAway == nil
+}
+
+// handleGoAway stops new streams being opened and closes the streams we
+// opened that the peer will not process.
+// http://tools.ietf.org/html/rfc9113#section-6.8
+func (c *Connection) handleGoAway(f GOAWAY) error {
+	c.mu.Lock()
+	if c.peerGoAway != nil && f.LastStreamId > c.peerGoAway.LastStreamId {
+		c.mu.Unlock()
+		return ConnectionError{
+			PROTOCOL_ERROR,
+			fmt.Sprintf("GOAWAY last stream identifier increased from %d to %d", c.peerGoAway.LastStreamId, f.LastStreamId),
+		}
+	}
+	c.peerGoAway = &GoAwayError{
+		LastStreamId:        f.LastStreamId,
+		ErrorCode:           f.ErrorCode,
+		AdditionalDebugData: f.AdditionalDebugData,
+	}
+
+	refused := []uint32{}
+	for id, s := range c.streams.streams {
+		if c.streams.isLocal(id) && id > f.LastStreamId && s.state != StreamIdle {
+			s.close(closedByLocalReset)
+			delete(c.streams.streams, id)
+			refused = append(refused, id)
+		}
+	}
+	// Wake writers blocked on the refused streams
+	c.windowUpdated.Broadcast()
+	c.mu.Unlock()
+
+	for _, id := range refused {
+		c.releaseStream(id)
+	}
+
+	return nil
+}
+
+// streamSendError explains why a frame cannot be sent on s, reporting
+// streams refused by a GOAWAY as such and reset streams as STREAM_CLOSED.
+// c.mu must be held.
+func (c *Connection) streamSendError(s *Stream, f Frame) error {
+	if c.peerGoAway != nil && c.streams.isLocal(s.Id) && s.Id > c.peerGoAway.LastStreamId {
+		e := *c.peerGoAway
+		e.StreamId = s.Id
+		return e
+	}
+	if s.state == StreamClosed {
+		return StreamError{
+			s.Id,
+			STREAM_CLOSED,
+			fmt.Sprintf("Cannot send %s frame on closed stream %d", frameName(f), s.Id),
+		}
+	}
+
+	return s.sendError(f)
 }
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func NewTestClientConnection(t *testing.T) (*Connection, *MockConn) {
+	conn := NewMockConn()
+	conn.readData = [][]byte{SETTINGS{}.Marshal()}
+
+	c, err := (&Client{}).InitiateConn(conn)
+	assert.Nil(t, err)
+	conn.written = conn.written[0:0]
+
+	return c, conn
+}
+
+func requestFields() []HeaderField {
+	return []HeaderField{
+		{":method", "GET", false},
+		{":scheme", "https", false},
+		{":path", "/", false},
+		{":authority", "example.com", false},
+	}
+}
+
+func TestClientInitiateConnSendsPreface(t *testing.T) {
+	conn := NewMockConn()
+	conn.readData = [][]byte{SETTINGS{}.Marshal()}
+
+	_, err := (&Client{Config{Settings: []Parameter{{SETTINGS_ENABLE_PUSH, 0}}}}).InitiateConn(conn)
+
+	assert.Nil(t, err)
+	assert.Equal(t, string(conn.written[0:len(preface)]), preface)
+	assert.Equal(t, readAllFrames(t, conn.written[len(preface):]), []Frame{
+		SETTINGS{Parameters: []Parameter{{SETTINGS_ENABLE_PUSH, 0}}},
+		settingsAck(),
+	})
+}
+
+func TestClientOpenStreamAllocatesOddIds(t *testing.T) {
+	c, conn := NewTestClientConnection(t)
+
+	id, err := c.OpenStream(requestFields(), false)
+	assert.Nil(t, err)
+	assert.Equal(t, id, uint32(1))
+	id, _ = c.OpenStream(requestFields(), true)
+	assert.Equal(t, id, uint32(3))
+
+	frames := readAllFrames(t, conn.written)
+	assert.Equal(t, len(frames), 2)
+	assert.Equal(t, frames[1].(HEADERS).StreamId, uint32(3))
+	assert.True(t, frames[1].(HEADERS).Flags.END_STREAM)
+
+	s, _ := c.streams.get(3)
+	assert.Equal(t, s.State(), StreamHalfClosedLocal)
+}
+
+func TestClientOpenStreamClosesStreamWhenWriteFails(t *testing.T) {
+	c, conn := NewTestClientConnection(t)
+	conn.writeErr = errors.New("broken pipe")
+
+	_, err := c.OpenStream(requestFields(), false)
+	assert.Equal(t, err, errors.New("broken pipe"))
+
+	s, _ := c.streams.get(1)
+	assert.Equal(t, s.State(), StreamClosed)
+	assert.Equal(t, c.streams.streams, map[uint32]*Stream{},
+		"The stream should no longer count as open")
+}
+
+func TestClientAppliesConfig(t *testing.T) {
+	scheduler := NewPriorityWriteScheduler()
+	conn := NewMockConn()
+	conn.readData = [][]byte{SETTINGS{}.Marshal()}
+	cl := &Client{}
+	cl.WindowUpdatePolicy = ManualPolicy{}
+	cl.MaxReceiveWindow = 1 << 24
+	cl.NewWriteScheduler = func() WriteScheduler { return scheduler }
+
+	c, err := cl.InitiateConn(conn)
+
+	assert.Nil(t, err)
+	assert.NotNil(t, c.bdp)
+	assert.Equal(t, c.scheduler, WriteScheduler(scheduler))
+	assert.Equal(t, c.windowPolicy, WindowUpdatePolicy(ManualPolicy{}))
+}
+
+func TestGoAwayRefusesStreamsAboveLastStreamId(t *testing.T) {
+	c, _ := NewTestClientConnection(t)
+	for i := 0; i < 3; i++ {
+		c.OpenStream(requestFields(), false)
+	}
+
+	assert.Nil(t, c.handleFrame(GOAWAY{3, NO_ERROR, "restarting"}))
+
+	assert.Nil(t, c.WriteData(3, []byte("body"), true), "Stream 3 will still be processed")
+	err := c.WriteData(5, []byte("body"), true)
+	assert.Equal(t, err, GoAwayError{5, 3, NO_ERROR, "restarting"})
+	assert.True(t, err.(GoAwayError).Retryable())
+
+	assert.False(t, c.CanOpenStream())
+	_, err = c.OpenStream(requestFields(), true)
+	assert.Equal(t, err, GoAwayError{0, 3, NO_ERROR, "restarting"})
+	assert.True(t, err.(GoAwayError).Retryable())
+
+	assert.False(t, GoAwayError{3, 3, NO_ERROR, ""}.Retryable())
+}
+
+func TestGoAwayWakesBlockedWriters(t *testing.T) {
+	c, _ := NewTestClientConnection(t)
+	id, _ := c.OpenStream(requestFields(), false)
+	s, _ := c.streams.get(id)
+	s.sendWindow = 0
+
+	result := make(chan error)
+	go func() {
+		result <- c.WriteData(id, []byte("body"), true)
+	}()
+
+	assert.Nil(t, c.handleFrame(GOAWAY{0, PROTOCOL_ERROR, "bad request"}))
+	assert.Equal(t, <-result, GoAwayError{1, 0, PROTOCOL_ERROR, "bad request"})
+}
+
+func TestGoAwayCannotIncreaseLastStreamId(t *testing.T) {
+	c, _ := NewTestClientConnection(t)
+
+	assert.Nil(t, c.handleFrame(GOAWAY{maxStreamId, NO_ERROR, ""}))
+	assert.Nil(t, c.handleFrame(GOAWAY{1, NO_ERROR, ""}))
+	assert.Equal(t, c.handleFrame(GOAWAY{3, NO_ERROR, ""}), ConnectionError{
+		PROTOCOL_ERROR,
+		"GOAWAY last stream identifier increased from 1 to 3",
+	})
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Version identifies the wire profile a FrameCodec speaks.
+type Version uint8
+
+const (
+	// http://tools.ietf.org/html/rfc9113
+	RFC9113 Version = iota
+	// http://tools.ietf.org/html/draft-ietf-httpbis-http2-12
+	Draft12
+)
+
+// FrameCodec marshals and unmarshals frames using the header layout, padding
+// flags and frame types of a particular Version.  The zero value speaks
+// RFC 9113.
+type FrameCodec struct {
+	Version Version
+	// MaxFrameSize is the largest frame payload that Unmarshal accepts,
+	// as we advertised in SETTINGS_MAX_FRAME_SIZE; zero means the default
+	// http://tools.ietf.org/html/rfc9113#section-4.2
+	MaxFrameSize uint32
+}
+
+// FrameDecoder decodes the payload of one type of frame.
+type FrameDecoder func(c FrameCodec, frameFlags uint8, streamId uint32, payload string) (Frame, error)
+
+var rfc9113FrameTypes = map[uint8]FrameDecoder{
+	0x0: unmarshalDataPayload,
+	0x1: unmarshalHeadersPayload,
+	0x2: unmarshalPriorityPayload,
+	0x3: unmarshalRstStreamPayload,
+	0x4: unmarshalSettingsPayload,
+	0x5: unmarshalPushPromisePayload,
+	0x6: unmarshalPingPayload,
+	0x7: unmarshalGoAwayPayload,
+	0x8: unmarshalWindowUpdatePayload,
+	0x9: unmarshalContinuationPayload,
+	// http://tools.ietf.org/html/rfc9218#section-7.1
+	0x10: unmarshalPriorityUpdatePayload,
+}
+
+var draft12FrameTypes = map[uint8]FrameDecoder{
+	0x0: unmarshalDataPayload,
+	0x1: unmarshalHeadersPayload,
+	0x2: unmarshalPriorityPayload,
+	0x3: unmarshalRstStreamPayload,
+	0x4: unmarshalSettingsPayload,
+	0x5: unmarshalPushPromisePayload,
+	0x6: unmarshalPingPayload,
+	0x7: unmarshalGoAwayPayload,
+	0x8: unmarshalWindowUpdatePayload,
+	0x9: unmarshalContinuationPayload,
+	0xB: unmarshalBlockedPayload,
+}
+
+// extensionFrameTypes are the decoders registered for frame types that
+// neither Version defines.
+var (
+	extensionMu         sync.RWMutex
+	extensionFrameTypes = map[uint8]FrameDecoder{}
+)
+
+// RegisterFrameType adds a decoder for an extension frame type, so that
+// Unmarshal returns its frames rather than UnknownFrame.  The types defined
+// by either Version cannot be replaced.
+// http://tools.ietf.org/html/rfc9113#section-5.5
+func RegisterFrameType(frameType uint8, decode FrameDecoder) error {
+	if decode == nil {
+		return fmt.Errorf("Frame type 0x%x has no decoder", frameType)
+	}
+	_, rfc9113 := rfc9113FrameTypes[frameType]
+	_, draft12 := draft12FrameTypes[frameType]
+	if rfc9113 || draft12 {
+		return fmt.Errorf("Frame type 0x%x is already defined", frameType)
+	}
+
+	extensionMu.Lock()
+	defer extensionMu.Unlock()
+
+	extensionFrameTypes[frameType] = decode
+	return nil
+}
+
+// codecMarshaler is implemented by frames whose encoding depends on the
+// codec Version.
+type codecMarshaler interface {
+	marshal(c FrameCodec) []byte
+}
+
+func (c FrameCodec) headerLength() int {
+	if c.Version == Draft12 {
+		return 8
+	}
+	return 9
+}
+
+func (c FrameCodec) settingsParameterLength() int {
+	if c.Version == Draft12 {
+		return 5
+	}
+	return 6
+}
+
+// decoder returns the decoder for a frame type, preferring the types of
+// the codec's own Version to any registered extensions.
+func (c FrameCodec) decoder(frameType uint8) (FrameDecoder, bool) {
+	frameTypes := rfc9113FrameTypes
+	if c.Version == Draft12 {
+		frameTypes = draft12FrameTypes
+	}
+	if decode, ok := frameTypes[frameType]; ok {
+		return decode, true
+	}
+
+	extensionMu.RLock()
+	defer extensionMu.RUnlock()
+
+	decode, ok := extensionFrameTypes[frameType]
+	return decode, ok
+}
+
+func (c FrameCodec) Marshal(f Frame) []byte {
+	if m, ok := f.(codecMarshaler); ok {
+		return m.marshal(c)
+	}
+	return f.Marshal()
+}
+
+func (c FrameCodec) Unmarshal(wire []byte) (advance int, f Frame, err error) {
+	headerLength := c.headerLength()
+	if len(wire) < headerLength {
+		// Incomplete header
+		return 0, nil, nil
+	}
+
+	var payloadLen int
+	if c.Version == Draft12 {
+		payloadLen = int(binary.BigEndian.Uint16(wire[0:2]) & 0x3FFF)
+	} else {
+		payloadLen = int(uint24(wire[0:3]))
+	}
+	frameType := wire[headerLength-6]
+	frameFlags := wire[headerLength-5]
+	streamId := uint31(string(wire[headerLength-4 : headerLength]))
+
+	// Checked before the payload has arrived, so that it is never buffered
+	if payloadLen > int(c.maxFrameSize()) {
+		return 0, nil, ConnectionError{
+			FRAME_SIZE_ERROR,
+			fmt.Sprintf("Frame length of %d exceeded the maximum frame size of %d", payloadLen, c.maxFrameSize()),
+		}
+	}
+
+	if len(wire) < payloadLen+headerLength {
+		// Incomplete payload
+		return 0, nil, nil
+	}
+
+	advance = payloadLen + headerLength
+	toDecode := string(wire[headerLength:advance])
+
+	decode, ok := c.decoder(frameType)
+	if !ok {
+		return advance, UnknownFrame{frameType, frameFlags, streamId, toDecode}, nil
+	}
+
+	f, err = decode(c, frameFlags, streamId, toDecode)
+	if err != nil {
+		return advance, nil, err
+	}
+	if f == nil {
+		// A complete frame must always be returned, or scanners would
+		// wait for more of it
+		return advance, nil, fmt.Errorf("Decoder for frame type 0x%x returned no frame", frameType)
+	}
+	return advance, f, nil
+}
+
+func (c FrameCodec) maxFrameSize() uint32 {
+	if c.MaxFrameSize != 0 {
+		return c.MaxFrameSize
+	}
+	if c.Version == Draft12 {
+		// Draft12 frames have a 14-bit length field
+		return 0x3FFF
+	}
+	return defaultMaxFrameSize
+}
+
+func (c FrameCodec) NewFrameScanner(r io.Reader) *bufio.Scanner {
+	var f Frame
+	return newFrameScanner(r, &c, &f)
+}
+
+// newFrameScanner splits frames from r with the codec c points to, so that
+// changes to its MaxFrameSize apply to the frames that follow.  Each frame
+// is decoded as it is split, and left in last for the caller.
+func newFrameScanner(r io.Reader, c *FrameCodec, last *Frame) *bufio.Scanner {
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, c.headerLength()+maxMaxFrameSize)
+	s.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		advance, f, err := c.Unmarshal(data)
+		if f != nil || err != nil {
+			*last = f
+			return advance, data[0:advance], err
+		}
+
+		return 0, nil, nil
+	})
+	return s
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+var draft12 = FrameCodec{Version: Draft12}
+
+func TestCodecDefaultsToRFC9113(t *testing.T) {
+	f := PING{OpaqueData: 2198179}
+
+	assert.Equal(t, FrameCodec{}.Marshal(f), f.Marshal())
+	assert.Equal(t, len(FrameCodec{}.Marshal(f)), 9+8)
+}
+
+func TestDraft12MarshalUsesEightOctetHeader(t *testing.T) {
+	f := WINDOW_UPDATE{StreamId: 12344, WindowSizeIncrement: 124789}
+
+	marshalled := draft12.Marshal(f)
+
+	assert.Equal(t, len(marshalled), 8+4)
+	assert.Equal(t, binary.BigEndian.Uint16(marshalled[0:2]), uint16(4),
+		"Length should have been marshalled in the first two octets")
+	assert.Equal(t, marshalled[2], uint8(0x8),
+		"Type should have been marshalled as the third octet")
+	assert.Equal(t, binary.BigEndian.Uint32(marshalled[4:8]), f.StreamId,
+		"Stream identifier should have been marshalled as fifth through eighth octets")
+}
+
+func TestDraft12MarshalDATA_WithPaddingHighSet(t *testing.T) {
+	f := DATA{}
+	f.Data = "This is the data associated with the data frame"
+	f.Padding = strings.Repeat("a", 310)
+
+	marshalled := draft12.Marshal(f)
+
+	assert.Equal(t, marshalled[3]&0x08, byte(0x08),
+		"Padding low flag should have been set")
+	assert.Equal(t, marshalled[3]&0x10, byte(0x10),
+		"Padding high flag should have been set")
+	assert.Equal(t, binary.BigEndian.Uint16(marshalled[8:10]),
+		uint16(len(f.Padding)),
+		"Padding length should have been equal to length of padding")
+	assert.Equal(t, marshalled[10:10+len(f.Data)], []byte(f.Data),
+		"Data did not match")
+	assert.Equal(t, marshalled[10+len(f.Data):], []byte(f.Padding),
+		"Padding did not match")
+}
+
+func TestDraft12MarshalSETTINGS_UsesEightBitIdentifiers(t *testing.T) {
+	f := SETTINGS{}
+	f.Parameters = []Parameter{{SETTINGS_HEADER_TABLE_SIZE, 1298431729}}
+
+	marshalled := draft12.Marshal(f)
+
+	assert.Equal(t, binary.BigEndian.Uint16(marshalled[0:2]), uint16(5))
+	assert.Equal(t, uint16(marshalled[8]), f.Parameters[0].Id)
+	assert.Equal(t, binary.BigEndian.Uint32(marshalled[9:13]), f.Parameters[0].Value)
+}
+
+func TestDraft12UnmarshalDATA_WithLargePadding(t *testing.T) {
+	f := DATA{
+		StreamId: 37,
+		Data:     "This is the data associated with the data frame",
+		Padding:  strings.Repeat("\x00", 310),
+	}
+	f.Flags.PADDED = true
+
+	b := draft12.Marshal(f)
+	advance, uf, err := draft12.Unmarshal(b)
+
+	assert.Equal(t, advance, len(b))
+	assert.Nil(t, err)
+	assert.Equal(t, f, uf)
+}
+
+func TestDraft12UnmarshalDATA_IncompatiblePaddingFlags(t *testing.T) {
+	f := DATA{StreamId: 123, Data: "dagljkjagldka"}
+	b := draft12.Marshal(f)
+	b[3] = 0x10
+
+	_, uf, err := draft12.Unmarshal(b)
+
+	assert.Nil(t, uf)
+	assert.Equal(t, err, ConnectionError{PROTOCOL_ERROR, "PAD_HIGH was set but PAD_LOW was not set"})
+}
+
+func TestDraft12UnmarshalDATA_IgnoresEndSegment(t *testing.T) {
+	f := DATA{StreamId: 123, Data: "data"}
+	b := draft12.Marshal(f)
+	b[3] = 0x2
+
+	_, uf, err := draft12.Unmarshal(b)
+
+	assert.Nil(t, err)
+	assert.Equal(t, f, uf)
+}
+
+func TestDraft12UnmarshalDATA_RejectsCompressed(t *testing.T) {
+	f := DATA{StreamId: 123, Data: "data"}
+	b := draft12.Marshal(f)
+	b[3] = 0x20
+
+	_, uf, err := draft12.Unmarshal(b)
+
+	assert.Nil(t, uf)
+	assert.Equal(t, err, ConnectionError{PROTOCOL_ERROR, "DATA frame was compressed without SETTINGS_COMPRESS_DATA"})
+}
+
+func TestDraft12UnmarshalHEADERS_WithPriority(t *testing.T) {
+	f := HEADERS{}
+	f.StreamId = 2139480
+	f.StreamDependency = 39781097
+	f.Weight = 5
+	f.Flags.PRIORITY = true
+	f.Flags.EXCLUSIVE = true
+	f.Flags.END_HEADERS = true
+	f.HeaderBlockFragment = "accept-encoding:gzip"
+	f.Padding = strings.Repeat("\x00", 371)
+
+	_, uf, err := draft12.Unmarshal(draft12.Marshal(f))
+
+	assert.Nil(t, err)
+	assert.Equal(t, f, uf)
+}
+
+func TestDraft12UnmarshalCONTINUATION_DiscardsPadding(t *testing.T) {
+	b := base{Type: 0x9, Flags: 0x4 | 0x8, StreamId: 123}
+	b.Payload = "\x03fragment\x00\x00\x00"
+
+	_, uf, err := draft12.Unmarshal(b.marshal(draft12))
+
+	f := CONTINUATION{StreamId: 123, HeaderBlockFragment: "fragment"}
+	f.Flags.END_HEADERS = true
+
+	assert.Nil(t, err)
+	assert.Equal(t, f, uf)
+}
+
+func TestDraft12UnmarshalSETTINGS(t *testing.T) {
+	f := SETTINGS{}
+	f.Parameters = []Parameter{
+		{SETTINGS_HEADER_TABLE_SIZE, 512},
+		{SETTINGS_INITIAL_WINDOW_SIZE, 120000},
+	}
+
+	_, uf, err := draft12.Unmarshal(draft12.Marshal(f))
+
+	assert.Nil(t, err)
+	assert.Equal(t, f, uf)
+}
+
+func TestDraft12UnmarshalSETTINGS_IgnoresLaterSettings(t *testing.T) {
+	f := SETTINGS{}
+	// Identifier 5 was SETTINGS_COMPRESS_DATA rather than
+	// SETTINGS_MAX_FRAME_SIZE
+	f.Parameters = []Parameter{{5, 1}, {SETTINGS_NO_RFC7540_PRIORITIES, 2}}
+
+	_, uf, err := draft12.Unmarshal(draft12.Marshal(f))
+
+	assert.Nil(t, err)
+	assert.Equal(t, f, uf)
+}
+
+func TestDraft12UnmarshalBLOCKED(t *testing.T) {
+	f := BLOCKED{StreamId: 1234}
+
+	b := f.Marshal()
+	_, uf, err := draft12.Unmarshal(b)
+
+	assert.Nil(t, err)
+	assert.Equal(t, f, uf)
+}
+
+func TestDraft12UnmarshalBLOCKED_WithPayload(t *testing.T) {
+	b := base{Type: 0xB, StreamId: 1234, Payload: "x"}
+
+	_, uf, err := draft12.Unmarshal(b.marshal(draft12))
+
+	assert.Nil(t, uf)
+	assert.Equal(t, err, ConnectionError{PROTOCOL_ERROR, "BLOCKED frame must have length of 0"})
+}
+
+func TestRFC9113DoesNotRecognizeBLOCKED(t *testing.T) {
+	b := FrameCodec{}.Marshal(BLOCKED{StreamId: 1234})
+	advance, uf, err := Unmarshal(b)
+
+	assert.Equal(t, advance, len(b))
+	assert.Nil(t, err)
+	assert.Equal(t, uf, UnknownFrame{Type: 0xB, StreamId: 1234})
+}
+
+func TestUnmarshalUnknownFrame(t *testing.T) {
+	f := UnknownFrame{Type: 0xF0, Flags: 0x3, StreamId: 7, Payload: "extension"}
+
+	for _, c := range []FrameCodec{{}, draft12} {
+		_, uf, err := c.Unmarshal(c.Marshal(f))
+
+		assert.Nil(t, err)
+		assert.Equal(t, uf, f)
+	}
+}
+
+func TestFrameScannerDoesNotStallOnUnknownFrames(t *testing.T) {
+	conn := NewMockConn()
+	conn.readData = [][]byte{
+		UnknownFrame{Type: 0xF0, Payload: "extension"}.Marshal(),
+		PING{OpaqueData: 1}.Marshal(),
+	}
+
+	s := NewFrameScanner(conn)
+	assert.True(t, s.Scan())
+	assert.True(t, s.Scan())
+	_, f, _ := Unmarshal(s.Bytes())
+	assert.Equal(t, f, PING{OpaqueData: 1})
+}
+
+type ALTSVC struct {
+	StreamId uint32
+	Origin   string
+}
+
+func (f ALTSVC) Marshal() []byte {
+	return base{Type: 0xA, StreamId: f.StreamId, Payload: f.Origin}.Marshal()
+}
+
+func TestRegisterFrameType(t *testing.T) {
+	decode := func(c FrameCodec, frameFlags uint8, streamId uint32, payload string) (Frame, error) {
+		return ALTSVC{streamId, payload}, nil
+	}
+	assert.Nil(t, RegisterFrameType(0xA, decode))
+	defer delete(extensionFrameTypes, 0xA)
+
+	_, uf, err := Unmarshal(ALTSVC{1, "origin"}.Marshal())
+	assert.Nil(t, err)
+	assert.Equal(t, uf, ALTSVC{1, "origin"})
+
+	assert.Equal(t, RegisterFrameType(0x1, decode), fmt.Errorf("Frame type 0x1 is already defined"))
+	assert.Equal(t, RegisterFrameType(0xB, decode), fmt.Errorf("Frame type 0xb is already defined"),
+		"Types that only Draft12 defines should not be replaced either")
+	assert.Equal(t, RegisterFrameType(0xC, nil), fmt.Errorf("Frame type 0xc has no decoder"))
+}
+
+func TestFrameScannerDoesNotStallOnDecoderReturningNoFrame(t *testing.T) {
+	decode := func(c FrameCodec, frameFlags uint8, streamId uint32, payload string) (Frame, error) {
+		return nil, nil
+	}
+	assert.Nil(t, RegisterFrameType(0xA, decode))
+	defer delete(extensionFrameTypes, 0xA)
+
+	s := NewFrameScanner(bytes.NewReader(append(ALTSVC{1, "origin"}.Marshal(), PING{}.Marshal()...)))
+
+	assert.False(t, s.Scan())
+	assert.Equal(t, s.Err(), fmt.Errorf("Decoder for frame type 0xa returned no frame"))
+}
+
+func TestUnmarshalRejectsOversizeFrameFromHeader(t *testing.T) {
+	b := DATA{StreamId: 1, Data: strings.Repeat("a", defaultMaxFrameSize+1)}.Marshal()
+
+	advance, uf, err := Unmarshal(b[0:9])
+
+	assert.Equal(t, advance, 0)
+	assert.Nil(t, uf)
+	assert.Equal(t, err, ConnectionError{FRAME_SIZE_ERROR, "Frame length of 16385 exceeded the maximum frame size of 16384"})
+
+	_, uf, err = FrameCodec{MaxFrameSize: 1 << 20}.Unmarshal(b)
+	assert.Nil(t, err)
+	assert.NotNil(t, uf)
+}
+
+func TestFrameScannerAcceptsFramesLargerThanDefaultBuffer(t *testing.T) {
+	b := DATA{StreamId: 1, Data: strings.Repeat("a", 1<<17)}.Marshal()
+
+	s := FrameCodec{MaxFrameSize: 1 << 20}.NewFrameScanner(bytes.NewReader(b))
+
+	assert.True(t, s.Scan())
+	assert.Equal(t, s.Bytes(), b)
+}
+
+func TestDraft12FrameScanner(t *testing.T) {
+	conn := NewMockConn()
+	b1 := draft12.Marshal(PING{OpaqueData: 3957102})
+	b2 := draft12.Marshal(DATA{StreamId: 1, Data: "hello"})
+
+	conn.readData = [][]byte{append(b1, b2[0:3]...), b2[3:]}
+
+	s := draft12.NewFrameScanner(conn)
+
+	assert.True(t, s.Scan())
+	assert.Equal(t, s.Bytes(), b1)
+	assert.True(t, s.Scan())
+	assert.Equal(t, s.Bytes(), b2)
+	assert.False(t, s.Scan())
+}
+
+// seedFrames gives the fuzz targets one of every frame type to mutate.
+func seedFrames(f *testing.F) {
+	headers := HEADERS{StreamId: 1, HeaderBlockFragment: "fragment", Padding: "pad", StreamDependency: 3, Weight: 7}
+	headers.Flags.PRIORITY = true
+	frames := []Frame{
+		DATA{StreamId: 1, Data: "data", Padding: "pad"},
+		headers,
+		PRIORITY{StreamId: 1, StreamDependency: 3, Weight: 7},
+		RST_STREAM{1, CANCEL},
+		SETTINGS{Parameters: []Parameter{{SETTINGS_INITIAL_WINDOW_SIZE, 1000}}},
+		PUSH_PROMISE{StreamId: 1, PromisedStreamId: 2, HeaderBlockFragment: "fragment", Padding: "pad"},
+		PING{OpaqueData: 1},
+		GOAWAY{1, PROTOCOL_ERROR, "debug"},
+		WINDOW_UPDATE{1, 1000},
+		CONTINUATION{StreamId: 1, HeaderBlockFragment: "fragment"},
+		PRIORITY_UPDATE{1, "u=1"},
+		BLOCKED{StreamId: 1},
+	}
+	for _, frame := range frames {
+		f.Add(FrameCodec{}.Marshal(frame))
+		f.Add(draft12.Marshal(frame))
+	}
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	seedFrames(f)
+
+	f.Fuzz(func(t *testing.T, wire []byte) {
+		for _, c := range []FrameCodec{{}, draft12} {
+			advance, _, _ := c.Unmarshal(wire)
+			if advance > len(wire) {
+				t.Fatalf("Advanced %d past the %d bytes available", advance, len(wire))
+			}
+		}
+	})
+}
+
+func FuzzFrameScanner(f *testing.F) {
+	seedFrames(f)
+
+	f.Fuzz(func(t *testing.T, wire []byte) {
+		for _, c := range []FrameCodec{{}, draft12} {
+			s := c.NewFrameScanner(bytes.NewReader(wire))
+			for s.Scan() {
+			}
+		}
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"time"
+)
+
+// Config holds the options that Server and Client share, and applies them
+// to each connection either one makes.
+type Config struct {
+	// Settings are sent to the peer in our initial SETTINGS frame
+	Settings []Parameter
+	// SettingsTimeout is how long the peer has to acknowledge our SETTINGS
+	// before the connection is closed; zero means ten seconds
+	SettingsTimeout time.Duration
+	// Clock defaults to the system clock
+	Clock Clock
+	// KeepaliveInterval enables sending a PING once nothing has been
+	// received from the peer for this long
+	KeepaliveInterval time.Duration
+	// KeepaliveTimeout is how long a keepalive PING has to be acknowledged
+	// before the connection is closed; zero means twenty seconds
+	KeepaliveTimeout time.Duration
+	// WindowUpdatePolicy decides when receive windows are reopened;
+	// nil means DefaultWindowUpdatePolicy
+	WindowUpdatePolicy WindowUpdatePolicy
+	// MaxReceiveWindow enables growing receive windows to match the
+	// bandwidth-delay product of each connection, up to this size; zero
+	// leaves them at their initial size.  Unless WindowUpdatePolicy is set,
+	// windows are then replenished once a quarter has been consumed so that
+	// the link can fill up.
+	MaxReceiveWindow uint32
+	// NewWriteScheduler creates the scheduler that orders each
+	// connection's stream frames; nil means NewRoundRobinWriteScheduler
+	NewWriteScheduler func() WriteScheduler
+	// NoRFC7540Priorities advertises SETTINGS_NO_RFC7540_PRIORITIES, so
+	// that streams are only prioritized by the priority header field and
+	// PRIORITY_UPDATE frames
+	NoRFC7540Priorities bool
+}
+
+// start applies the options to a new connection and exchanges SETTINGS
+// frames with the peer.
+func (cfg *Config) start(c *Connection) error {
+	if cfg.SettingsTimeout != 0 {
+		c.settingsTimeout = cfg.SettingsTimeout
+	}
+	if cfg.MaxReceiveWindow != 0 {
+		c.bdp = newBDPEstimator(c.clock, defaultInitialWindowSize, cfg.MaxReceiveWindow)
+		c.windowPolicy = bdpWindowUpdatePolicy
+	}
+	if cfg.WindowUpdatePolicy != nil {
+		c.windowPolicy = cfg.WindowUpdatePolicy
+	}
+	if cfg.NewWriteScheduler != nil {
+		c.scheduler = cfg.NewWriteScheduler()
+	}
+
+	settings := cfg.Settings
+	if cfg.NoRFC7540Priorities {
+		settings = append(append([]Parameter{}, settings...), Parameter{SETTINGS_NO_RFC7540_PRIORITIES, 1})
+	}
+	if err := c.exchangeSettings(settings); err != nil {
+		return err
+	}
+	if cfg.KeepaliveInterval != 0 {
+		c.startKeepalive(cfg.KeepaliveInterval, cfg.KeepaliveTimeout)
+	}
+
+	return nil
+}
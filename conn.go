@@ -0,0 +1,631 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+const defaultSettingsTimeout = 10 * time.Second
+
+var ErrConnectionClosed = errors.New("Connection is closed")
+
+// pendingSettings is a SETTINGS frame we have sent that the peer has not
+// yet acknowledged.
+type pendingSettings struct {
+	parameters []Parameter
+	timer      Timer
+}
+
+// Connection is a single HTTP/2 connection after the connection preface
+// has been exchanged.
+type Connection struct {
+	conn   Conn
+	codec  FrameCodec
+	reader *FrameReader
+	writer *FrameWriter
+	clock  Clock
+
+	encoder *Encoder
+	decoder *Decoder
+
+	// settingsTimeout is how long the peer has to acknowledge our SETTINGS
+	// http://tools.ietf.org/html/rfc9113#section-6.5.3
+	settingsTimeout time.Duration
+
+	mu      sync.Mutex
+	writeMu sync.Mutex
+	closed  bool
+	// done is closed along with the connection, and onClose called
+	done    chan struct{}
+	onClose func()
+
+	// localSettings are the parameters the peer has acknowledged, starting
+	// from the defaults
+	localSettings Settings
+	// pendingSettings are sent but unacknowledged, oldest first
+	pendingSettings []*pendingSettings
+	// peerSettings are the parameters the peer has advertised to us,
+	// starting from the defaults
+	peerSettings Settings
+	// peerSettingsReceived is set once the peer's first SETTINGS is handled
+	peerSettingsReceived bool
+
+	streams *streamRegistry
+	// scheduler orders the stream frames we write, and is guarded by
+	// writeMu
+	scheduler WriteScheduler
+
+	// Connection-level flow-control windows; windowUpdated is signalled
+	// whenever a send window grows
+	sendWindow    int64
+	recvWindow    int64
+	windowUpdated *sync.Cond
+
+	// recvWindowSize is the size that windowPolicy keeps the connection
+	// receive window at, and recvConsumed the data consumed by the
+	// application that has not yet been returned to the peer
+	windowPolicy   WindowUpdatePolicy
+	recvWindowSize int64
+	recvConsumed   int64
+
+	// bdp grows the receive windows to fit the link, when enabled
+	bdp *bdpEstimator
+
+	// goingAway is set once we have sent a GOAWAY; streams the peer opens
+	// with identifiers above goAwayStreamId are then ignored
+	goingAway       bool
+	goAwayStreamId  uint32
+	shutdownPingAck chan struct{}
+	// streamClosed is signalled whenever a stream closes
+	streamClosed chan struct{}
+
+	// peerGoAway is set once the peer has sent GOAWAY
+	peerGoAway *GoAwayError
+
+	// lastActivity is when a frame was last received, which the keepalive
+	// timer checks; pings are the keepalive PINGs awaiting acknowledgement
+	lastActivity      time.Time
+	keepaliveInterval time.Duration
+	keepaliveTimeout  time.Duration
+	keepaliveTimer    Timer
+	pingCount         uint64
+	pings             map[uint64]*outstandingPing
+	rtt               time.Duration
+}
+
+func newConnection(conn Conn, r io.Reader, clock Clock, server bool) *Connection {
+	if clock == nil {
+		clock = realClock{}
+	}
+
+	c := &Connection{
+		conn:            conn,
+		clock:           clock,
+		done:            make(chan struct{}),
+		shutdownPingAck: make(chan struct{}),
+		streamClosed:    make(chan struct{}, 1),
+		lastActivity:    clock.Now(),
+		pings:           make(map[uint64]*outstandingPing),
+		encoder:         NewEncoder(defaultHeaderTableSize),
+		decoder:         NewDecoder(defaultHeaderTableSize),
+		settingsTimeout: defaultSettingsTimeout,
+		localSettings:   DefaultSettings(),
+		peerSettings:    DefaultSettings(),
+		streams:         newStreamRegistry(server),
+		scheduler:       NewRoundRobinWriteScheduler(),
+		sendWindow:      defaultInitialWindowSize,
+		recvWindow:      defaultInitialWindowSize,
+		windowPolicy:    DefaultWindowUpdatePolicy,
+		recvWindowSize:  defaultInitialWindowSize,
+	}
+	c.windowUpdated = sync.NewCond(&c.mu)
+	c.reader = NewFrameReader(r, c.codec, c.decoder)
+	c.writer = NewFrameWriter(conn, c.codec, c.encoder)
+
+	return c
+}
+
+// writeFrame writes a control frame immediately, ahead of any stream frames
+// queued with the write scheduler.
+func (c *Connection) writeFrame(f Frame) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	return c.writer.WriteFrame(f)
+}
+
+// writeStreamFrame queues a frame with the write scheduler and then writes
+// queued frames until none are left.
+func (c *Connection) writeStreamFrame(f Frame) error {
+	c.writeMu.Lock()
+	c.scheduler.Push(f)
+	c.writeMu.Unlock()
+
+	return c.flushStreamFrames()
+}
+
+// flushStreamFrames writes the frames queued with the write scheduler in
+// the order it chooses.  writeMu is released between frames so that control
+// frames are not held up behind them.
+func (c *Connection) flushStreamFrames() error {
+	for {
+		c.writeMu.Lock()
+		f, ok := c.scheduler.Pop()
+		if !ok {
+			c.writeMu.Unlock()
+			return nil
+		}
+		err := c.writer.WriteFrame(f)
+		c.writeMu.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// prioritize passes priority signals from the peer to the write scheduler.
+func (c *Connection) prioritize(f Frame) error {
+	c.mu.Lock()
+	ignoreRFC7540 := c.ignoresRFC7540Priorities()
+	c.mu.Unlock()
+
+	if ignoreRFC7540 {
+		var ok bool
+		if f, ok = withoutRFC7540Priority(f); !ok {
+			return nil
+		}
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	return c.scheduler.Prioritize(f)
+}
+
+// ignoresRFC7540Priorities is true once either endpoint has sent
+// SETTINGS_NO_RFC7540_PRIORITIES with a value of 1.  c.mu must be held.
+// http://tools.ietf.org/html/rfc9218#section-2.1
+func (c *Connection) ignoresRFC7540Priorities() bool {
+	if c.peerSettings.NoRFC7540Priorities || c.localSettings.NoRFC7540Priorities {
+		return true
+	}
+	for _, p := range c.pendingSettings {
+		for _, parameter := range p.parameters {
+			if parameter.Id == SETTINGS_NO_RFC7540_PRIORITIES && parameter.Value == 1 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// releaseStream drops a stream from the write scheduler once it has
+// closed, returning whether it had.
+func (c *Connection) releaseStream(streamId uint32) bool {
+	c.mu.Lock()
+	s, _ := c.streams.get(streamId)
+	closed := s.state == StreamClosed
+	c.mu.Unlock()
+
+	if closed {
+		c.writeMu.Lock()
+		dropped := c.scheduler.CloseStream(streamId)
+		c.writeMu.Unlock()
+
+		// DATA that will never be written gives back the connection send
+		// window it took, and writers blocked on the stream's window are
+		// woken
+		c.mu.Lock()
+		for _, f := range dropped {
+			if d, ok := f.(DATA); ok {
+				c.sendWindow += flowControlledLength(d)
+			}
+		}
+		c.windowUpdated.Broadcast()
+		c.mu.Unlock()
+
+		select {
+		case c.streamClosed <- struct{}{}:
+		default:
+		}
+	}
+
+	return closed
+}
+
+// LocalSetting returns the value of one of our settings that the peer has
+// acknowledged, and whether it is set at all.
+func (c *Connection) LocalSetting(id uint16) (uint32, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.localSettings.Get(id)
+}
+
+// LocalSettings returns our settings that the peer has acknowledged.
+func (c *Connection) LocalSettings() Settings {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.localSettings.clone()
+}
+
+// PeerSetting returns the value of a setting advertised by the peer, and
+// whether it is set at all.
+func (c *Connection) PeerSetting(id uint16) (uint32, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.peerSettings.Get(id)
+}
+
+// PeerSettings returns the settings advertised by the peer.
+func (c *Connection) PeerSettings() Settings {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.peerSettings.clone()
+}
+
+// UpdateSettings sends parameters to the peer.  They take effect locally
+// once the peer acknowledges them; if it does not do so in time the
+// connection is closed with SETTINGS_TIMEOUT.
+func (c *Connection) UpdateSettings(parameters []Parameter) error {
+	p := &pendingSettings{parameters: parameters}
+
+	c.mu.Lock()
+	c.pendingSettings = append(c.pendingSettings, p)
+	p.timer = c.clock.AfterFunc(c.settingsTimeout, c.settingsTimedOut)
+	c.mu.Unlock()
+
+	return c.writeFrame(SETTINGS{Parameters: parameters})
+}
+
+// ChangeSettings sends only the parameters needed to change the settings
+// most recently sent, acknowledged or not, into settings.
+func (c *Connection) ChangeSettings(settings Settings) error {
+	c.mu.Lock()
+	sent := c.localSettings.clone()
+	for _, p := range c.pendingSettings {
+		sent = sent.Merge(p.parameters)
+	}
+	c.mu.Unlock()
+
+	parameters := sent.Diff(settings)
+	if len(parameters) == 0 {
+		return nil
+	}
+
+	return c.UpdateSettings(parameters)
+}
+
+func (c *Connection) settingsTimedOut() {
+	c.closeWithError(ConnectionError{
+		SETTINGS_TIMEOUT,
+		"SETTINGS frame was not acknowledged in time",
+	})
+}
+
+// http://tools.ietf.org/html/rfc9113#section-3.4
+func (c *Connection) exchangeSettings(localSettings []Parameter) error {
+	if err := c.UpdateSettings(localSettings); err != nil {
+		return err
+	}
+
+	f, err := c.reader.ReadFrame()
+	if err != nil {
+		return err
+	}
+
+	settings, ok := f.(SETTINGS)
+	if !ok || settings.Flags.ACK {
+		return ConnectionError{
+			PROTOCOL_ERROR,
+			"First frame from the peer must be SETTINGS",
+		}
+	}
+
+	return c.handleSettings(settings)
+}
+
+// Serve reads and handles frames until the connection fails or is closed.
+// Stream errors only reset the stream concerned.
+func (c *Connection) Serve() error {
+	for {
+		f, err := c.reader.ReadFrame()
+		if err == nil {
+			err = asProtocolError(c.handleFrame(f))
+		} else if f != nil {
+			err = c.refuseHeaderBlock(f, err)
+		}
+		if err = c.handleError(err); err != nil {
+			return err
+		}
+	}
+}
+
+// refuseHeaderBlock opens the stream of a header block that the reader
+// refused with err, so that the stream can then be reset.
+func (c *Connection) refuseHeaderBlock(f Frame, err error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if receiveErr := c.streams.receive(f); receiveErr != nil {
+		return receiveErr
+	}
+	return err
+}
+
+// asProtocolError treats errors in handling a frame that are not already
+// stream or connection errors as our own fault.
+func asProtocolError(err error) error {
+	var streamErr StreamError
+	var connErr ConnectionError
+	if err == nil || errors.As(err, &streamErr) || errors.As(err, &connErr) {
+		return err
+	}
+
+	return ConnectionError{INTERNAL_ERROR, err.Error()}
+}
+
+// handleError sends the frame that tells the peer about err.  A StreamError
+// only resets its stream with RST_STREAM, leaving the connection open; any
+// other error closes the connection, with GOAWAY for a ConnectionError.
+// The error is returned if the connection was closed.
+// http://tools.ietf.org/html/rfc9113#section-5.4
+func (c *Connection) handleError(err error) error {
+	var streamErr StreamError
+	if errors.As(err, &streamErr) {
+		err = c.resetStream(streamErr)
+	}
+	if err != nil {
+		c.closeWithError(err)
+	}
+
+	return err
+}
+
+func (c *Connection) handleFrame(f Frame) error {
+	c.mu.Lock()
+	c.lastActivity = c.clock.Now()
+	c.mu.Unlock()
+
+	if streamId := frameStreamId(f); streamId != 0 && c.refusedAfterGoAway(streamId) {
+		if data, ok := f.(DATA); ok {
+			return c.ignoreData(data)
+		}
+		return nil
+	}
+
+	switch f := f.(type) {
+	case SETTINGS:
+		return c.handleSettings(f)
+	case DATA:
+		if err := c.handleData(f); err != nil {
+			return err
+		}
+		c.releaseStream(f.StreamId)
+		return c.sampleBandwidth(f)
+	case PING:
+		return c.handlePing(f)
+	case WINDOW_UPDATE:
+		return c.handleWindowUpdate(f)
+	case GOAWAY:
+		return c.handleGoAway(f)
+	case PRIORITY_UPDATE:
+		// http://tools.ietf.org/html/rfc9218#section-7.1
+		if !c.streams.server {
+			return ConnectionError{
+				PROTOCOL_ERROR,
+				"Servers cannot send PRIORITY_UPDATE",
+			}
+		}
+
+		if c.releaseStream(f.PrioritizedStreamId) {
+			return nil
+		}
+		return c.prioritize(f)
+	}
+
+	if streamId := frameStreamId(f); streamId != 0 {
+		c.mu.Lock()
+		err := c.streams.receive(f)
+		c.mu.Unlock()
+
+		if err != nil || c.releaseStream(streamId) {
+			return err
+		}
+		return c.prioritize(f)
+	}
+
+	return nil
+}
+
+// http://tools.ietf.org/html/rfc9113#section-6.7
+func (c *Connection) handlePing(f PING) error {
+	if !f.Flags.ACK {
+		ack := PING{OpaqueData: f.OpaqueData}
+		ack.Flags.ACK = true
+		return c.writeFrame(ack)
+	}
+
+	if f.OpaqueData == bdpPingData && c.bdp != nil {
+		return c.growReceiveWindows()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if f.OpaqueData == shutdownPingData && c.goingAway && c.goAwayStreamId == maxStreamId {
+		close(c.shutdownPingAck)
+		// Later acknowledgements are not waited for
+		c.goAwayStreamId = c.streams.lastPeerId
+	}
+	c.handleKeepaliveAck(f)
+
+	return nil
+}
+
+// http://tools.ietf.org/html/rfc9113#section-5.4.2
+func (c *Connection) resetStream(e StreamError) error {
+	f := RST_STREAM{e.StreamId, e.Code}
+
+	c.mu.Lock()
+	c.streams.send(f)
+	c.mu.Unlock()
+
+	err := c.writeFrame(f)
+	c.releaseStream(e.StreamId)
+	return err
+}
+
+// http://tools.ietf.org/html/rfc9113#section-6.5.3
+func (c *Connection) handleSettings(f SETTINGS) error {
+	if f.Flags.ACK {
+		return c.handleSettingsAck()
+	}
+
+	c.mu.Lock()
+	for _, parameter := range f.Parameters {
+		var err error
+		switch parameter.Id {
+		case SETTINGS_ENABLE_PUSH:
+			// http://tools.ietf.org/html/rfc9113#section-6.5.2
+			if !c.streams.server && parameter.Value != 0 {
+				err = ConnectionError{
+					PROTOCOL_ERROR,
+					"Servers must not enable SETTINGS_ENABLE_PUSH",
+				}
+			}
+		case SETTINGS_INITIAL_WINDOW_SIZE:
+			err = c.adjustSendWindows(parameter.Value)
+		case SETTINGS_NO_RFC7540_PRIORITIES:
+			err = c.checkNoRFC7540Priorities(parameter.Value)
+		}
+		if err != nil {
+			c.mu.Unlock()
+			return err
+		}
+		c.peerSettings.set(parameter)
+	}
+	c.peerSettingsReceived = true
+	c.mu.Unlock()
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	for _, parameter := range f.Parameters {
+		switch parameter.Id {
+		case SETTINGS_HEADER_TABLE_SIZE:
+			// Never grow the encoder's table past the default, whatever
+			// the peer allows
+			size := parameter.Value
+			if size > defaultHeaderTableSize {
+				size = defaultHeaderTableSize
+			}
+			c.encoder.SetMaxTableSize(size)
+		case SETTINGS_MAX_FRAME_SIZE:
+			c.writer.MaxFrameSize = parameter.Value
+		}
+	}
+
+	// The acknowledgement is written while holding writeMu so that nothing
+	// encoded with the old values can follow it
+	ack := SETTINGS{}
+	ack.Flags.ACK = true
+
+	return c.writer.WriteFrame(ack)
+}
+
+// The value cannot change once the peer's first SETTINGS has been sent.
+// http://tools.ietf.org/html/rfc9218#section-2.1
+func (c *Connection) checkNoRFC7540Priorities(value uint32) error {
+	if c.peerSettingsReceived && (value == 1) != c.peerSettings.NoRFC7540Priorities {
+		return ConnectionError{
+			PROTOCOL_ERROR,
+			"SETTINGS_NO_RFC7540_PRIORITIES must not change",
+		}
+	}
+
+	return nil
+}
+
+func (c *Connection) handleSettingsAck() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.pendingSettings) == 0 {
+		return ConnectionError{
+			PROTOCOL_ERROR,
+			"Received SETTINGS acknowledgement without outstanding SETTINGS",
+		}
+	}
+
+	p := c.pendingSettings[0]
+	c.pendingSettings = c.pendingSettings[1:]
+	p.timer.Stop()
+
+	for _, parameter := range p.parameters {
+		c.localSettings.set(parameter)
+
+		switch parameter.Id {
+		case SETTINGS_HEADER_TABLE_SIZE:
+			c.decoder.SetMaxTableSize(parameter.Value)
+		case SETTINGS_INITIAL_WINDOW_SIZE:
+			c.adjustRecvWindows(parameter.Value)
+		case SETTINGS_MAX_FRAME_SIZE:
+			// The peer can send larger frames only after its
+			// acknowledgement, and smaller ones before it
+			c.reader.SetMaxFrameSize(parameter.Value)
+		case SETTINGS_MAX_HEADER_LIST_SIZE:
+			c.decoder.SetMaxHeaderListSize(parameter.Value)
+			// An encoded block is never larger than the list it decodes
+			// to, which counts 32 octets for every field, so the block
+			// can be refused before it is decoded
+			if parameter.Value < defaultMaxHeaderBlockSize {
+				c.reader.MaxHeaderBlockSize = parameter.Value
+			}
+		}
+	}
+
+	return nil
+}
+
+// closeWithError tears down the connection, telling the peer why with a
+// GOAWAY frame when the error is a ConnectionError.
+// http://tools.ietf.org/html/rfc9113#section-5.4.1
+func (c *Connection) closeWithError(err error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	for _, p := range c.pendingSettings {
+		p.timer.Stop()
+	}
+	for _, p := range c.pings {
+		p.timer.Stop()
+	}
+	if c.keepaliveTimer != nil {
+		c.keepaliveTimer.Stop()
+	}
+	lastStreamId := c.streams.lastPeerId
+	c.windowUpdated.Broadcast()
+	close(c.done)
+	c.mu.Unlock()
+
+	var e ConnectionError
+	if errors.As(err, &e) {
+		c.writeFrame(GOAWAY{lastStreamId, e.Code, e.Message})
+	}
+	c.conn.Close()
+
+	if c.onClose != nil {
+		c.onClose()
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeTimer struct {
+	clock   *fakeClock
+	when    time.Time
+	f       func()
+	stopped bool
+}
+
+func (t *fakeTimer) Stop() bool {
+	wasActive := !t.stopped
+	t.stopped = true
+	return wasActive
+}
+
+// fakeClock only moves when Advance is called, running any timers that
+// have become due on the calling goroutine.
+type fakeClock struct {
+	now    time.Time
+	timers []*fakeTimer
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1400000000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	t := &fakeTimer{clock: c, when: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	end := c.now.Add(d)
+	for {
+		sort.SliceStable(c.timers, func(i, j int) bool {
+			return c.timers[i].when.Before(c.timers[j].when)
+		})
+		if len(c.timers) == 0 || c.timers[0].when.After(end) {
+			break
+		}
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		if t.stopped {
+			continue
+		}
+		c.now = t.when
+		t.stopped = true
+		t.f()
+	}
+	c.now = end
+}
+
+func NewTestConnection(settings []Parameter) (*Connection, *MockConn, *fakeClock) {
+	clock := newFakeClock()
+	server, conn := NewTestServer()
+	server.Settings = settings
+	server.SettingsTimeout = 5 * time.Second
+	server.Clock = clock
+
+	conn.readData = [][]byte{[]byte(preface), SETTINGS{}.Marshal()}
+	c, err := server.InitiateConn(conn)
+	if err != nil {
+		panic(err)
+	}
+	conn.written = conn.written[0:0]
+
+	return c, conn, clock
+}
+
+func TestSettingsTimeoutClosesConnection(t *testing.T) {
+	c, conn, clock := NewTestConnection(nil)
+
+	clock.Advance(4 * time.Second)
+	assert.False(t, conn.closed)
+
+	clock.Advance(time.Second)
+	assert.Equal(t, readAllFrames(t, conn.written), []Frame{
+		GOAWAY{0, SETTINGS_TIMEOUT, "SETTINGS frame was not acknowledged in time"},
+	})
+	assert.True(t, conn.closed)
+
+	assert.Nil(t, c.handleFrame(settingsAck()), "A late acknowledgement should not panic")
+}
+
+func TestSettingsAckAppliesLocalSettings(t *testing.T) {
+	c, conn, clock := NewTestConnection([]Parameter{{SETTINGS_HEADER_TABLE_SIZE, 256}})
+
+	value, _ := c.LocalSetting(SETTINGS_HEADER_TABLE_SIZE)
+	assert.Equal(t, value, uint32(defaultHeaderTableSize),
+		"Settings should not have applied before the acknowledgement")
+	assert.Equal(t, c.decoder.maxTableSize, uint32(defaultHeaderTableSize))
+
+	assert.Nil(t, c.handleFrame(settingsAck()))
+
+	value, _ = c.LocalSetting(SETTINGS_HEADER_TABLE_SIZE)
+	assert.Equal(t, value, uint32(256))
+	assert.Equal(t, c.decoder.maxTableSize, uint32(256))
+
+	clock.Advance(time.Minute)
+	assert.Equal(t, len(conn.written), 0, "Timer should have been stopped")
+	assert.False(t, conn.closed)
+}
+
+func TestSettingsAckMatchesOldestOutstandingSettings(t *testing.T) {
+	c, conn, clock := NewTestConnection(nil)
+
+	clock.Advance(3 * time.Second)
+	assert.Nil(t, c.UpdateSettings([]Parameter{{SETTINGS_ENABLE_PUSH, 0}}))
+	assert.Nil(t, c.handleFrame(settingsAck()))
+
+	value, _ := c.LocalSetting(SETTINGS_ENABLE_PUSH)
+	assert.Equal(t, value, uint32(1),
+		"First acknowledgement should have been for the initial SETTINGS")
+
+	clock.Advance(5 * time.Second)
+	assert.True(t, conn.closed,
+		"Second SETTINGS should have timed out")
+
+	frames := readAllFrames(t, conn.written)
+	assert.Equal(t, frames[len(frames)-1],
+		GOAWAY{0, SETTINGS_TIMEOUT, "SETTINGS frame was not acknowledged in time"})
+}
+
+func TestChangeSettingsSendsOnlyChanges(t *testing.T) {
+	c, conn, _ := NewTestConnection([]Parameter{{SETTINGS_HEADER_TABLE_SIZE, 256}})
+
+	s := DefaultSettings()
+	s.HeaderTableSize = 256
+	s.MaxConcurrentStreams = 10
+	assert.Nil(t, c.ChangeSettings(s),
+		"Changes should be made from the unacknowledged SETTINGS")
+	assert.Nil(t, c.ChangeSettings(s), "Nothing should be sent without changes")
+
+	assert.Equal(t, readAllFrames(t, conn.written), []Frame{
+		SETTINGS{Parameters: []Parameter{{SETTINGS_MAX_CONCURRENT_STREAMS, 10}}},
+	})
+
+	assert.Nil(t, c.handleFrame(settingsAck()))
+	assert.Nil(t, c.handleFrame(settingsAck()))
+	assert.Equal(t, c.LocalSettings(), s)
+}
+
+func TestLocalMaxFrameSizeAppliesOnceAcknowledged(t *testing.T) {
+	c, _, _ := NewTestConnection([]Parameter{{SETTINGS_MAX_FRAME_SIZE, 20000}})
+	assert.Equal(t, c.reader.codec.maxFrameSize(), uint32(defaultMaxFrameSize))
+
+	assert.Nil(t, c.handleFrame(settingsAck()))
+	assert.Equal(t, c.reader.codec.maxFrameSize(), uint32(20000))
+}
+
+func TestLocalMaxHeaderListSizeLimitsHeaderBlocks(t *testing.T) {
+	c, _, _ := NewTestConnection([]Parameter{{SETTINGS_MAX_HEADER_LIST_SIZE, 4096}})
+	assert.Equal(t, c.reader.MaxHeaderBlockSize, uint32(defaultMaxHeaderBlockSize))
+
+	assert.Nil(t, c.handleFrame(settingsAck()))
+	assert.Equal(t, c.reader.MaxHeaderBlockSize, uint32(4096))
+	assert.Equal(t, c.decoder.maxHeaderListSize, uint32(4096))
+}
+
+func TestServeResetsStreamsOverMaxHeaderListSize(t *testing.T) {
+	c, conn, _ := NewTestConnection([]Parameter{{SETTINGS_MAX_HEADER_LIST_SIZE, 100}})
+	assert.Nil(t, c.handleFrame(settingsAck()))
+	// Ten references to :method GET are ten octets compressed but 420
+	// decoded
+	h := headersFrame(1, false)
+	h.HeaderBlockFragment = strings.Repeat("\x82", 10)
+	conn.readData = [][]byte{
+		h.Marshal(),
+		dataFrame(1, false).Marshal(),
+		headersFrame(3, true).Marshal(),
+	}
+
+	c.Serve()
+
+	assert.Equal(t, readAllFrames(t, conn.written), []Frame{
+		RST_STREAM{1, REFUSED_STREAM},
+		WINDOW_UPDATE{0, 5},
+	}, "Only the stream should have been reset")
+	s, _ := c.streams.get(3)
+	assert.Equal(t, s.State(), StreamHalfClosedRemote)
+}
+
+func TestUnsolicitedSettingsAck(t *testing.T) {
+	c, _, _ := NewTestConnection(nil)
+
+	assert.Nil(t, c.handleFrame(settingsAck()))
+	assert.Equal(t, c.handleFrame(settingsAck()), ConnectionError{
+		PROTOCOL_ERROR,
+		"Received SETTINGS acknowledgement without outstanding SETTINGS",
+	})
+}
+
+func TestPeerSettingsAreAcknowledged(t *testing.T) {
+	c, conn, _ := NewTestConnection(nil)
+
+	assert.Nil(t, c.handleFrame(SETTINGS{Parameters: []Parameter{{SETTINGS_ENABLE_PUSH, 0}}}))
+
+	value, _ := c.PeerSetting(SETTINGS_ENABLE_PUSH)
+	assert.Equal(t, value, uint32(0))
+	assert.False(t, c.PeerSettings().EnablePush)
+	assert.Equal(t, readAllFrames(t, conn.written), []Frame{settingsAck()})
+}
+
+func TestPeerSettingsCannotChangeNoRFC7540Priorities(t *testing.T) {
+	c, _, _ := NewTestConnection(nil)
+
+	assert.Nil(t, c.handleFrame(SETTINGS{Parameters: []Parameter{{SETTINGS_NO_RFC7540_PRIORITIES, 0}}}),
+		"Repeating the implied value is not a change")
+	assert.Equal(t, c.handleFrame(SETTINGS{Parameters: []Parameter{{SETTINGS_NO_RFC7540_PRIORITIES, 1}}}), ConnectionError{
+		PROTOCOL_ERROR,
+		"SETTINGS_NO_RFC7540_PRIORITIES must not change",
+	})
+}
+
+func TestPeerSettingsKeepsUnknownSettings(t *testing.T) {
+	c, _, _ := NewTestConnection(nil)
+
+	assert.Nil(t, c.handleFrame(SETTINGS{Parameters: []Parameter{{0x0a0a, 7}}}))
+
+	value, ok := c.PeerSetting(0x0a0a)
+	assert.True(t, ok)
+	assert.Equal(t, value, uint32(7))
+}
+
+func TestClientRejectsServerEnablingPush(t *testing.T) {
+	c, _, _ := NewTestConnection(nil)
+	c.streams.server = false
+
+	assert.Nil(t, c.handleFrame(SETTINGS{Parameters: []Parameter{{SETTINGS_ENABLE_PUSH, 0}}}))
+	assert.Equal(t, c.handleFrame(SETTINGS{Parameters: []Parameter{{SETTINGS_ENABLE_PUSH, 1}}}), ConnectionError{
+		PROTOCOL_ERROR,
+		"Servers must not enable SETTINGS_ENABLE_PUSH",
+	})
+}
+
+func TestClientRejectsPriorityUpdate(t *testing.T) {
+	c, _, _ := NewTestConnection(nil)
+	assert.Nil(t, c.handleFrame(PRIORITY_UPDATE{1, "u=0"}))
+
+	c.streams.server = false
+	assert.Equal(t, c.handleFrame(PRIORITY_UPDATE{2, "u=0"}), ConnectionError{
+		PROTOCOL_ERROR,
+		"Servers cannot send PRIORITY_UPDATE",
+	})
+}
+
+func TestServeClosesConnectionOnError(t *testing.T) {
+	c, conn, _ := NewTestConnection(nil)
+	conn.readData = [][]byte{CONTINUATION{StreamId: 1}.Marshal()}
+
+	err := c.Serve()
+
+	assert.Equal(t, err, ConnectionError{PROTOCOL_ERROR, "CONTINUATION frame on stream 1 did not follow a header block"})
+	assert.Equal(t, readAllFrames(t, conn.written), []Frame{
+		GOAWAY{0, PROTOCOL_ERROR, "CONTINUATION frame on stream 1 did not follow a header block"},
+	})
+	assert.True(t, conn.closed)
+}
+
+func TestServeResetsStreamOnStreamError(t *testing.T) {
+	c, conn, _ := NewTestConnection(nil)
+	conn.readData = [][]byte{
+		headersFrame(1, true).Marshal(),
+		dataFrame(1, false).Marshal(),
+		CONTINUATION{StreamId: 3}.Marshal(),
+	}
+
+	c.Serve()
+
+	assert.Equal(t, readAllFrames(t, conn.written), []Frame{
+		WINDOW_UPDATE{0, 5},
+		RST_STREAM{1, STREAM_CLOSED},
+		GOAWAY{1, PROTOCOL_ERROR, "CONTINUATION frame on stream 3 did not follow a header block"},
+	}, "Only the stream should have been reset by the stream error")
+}
+
+func TestServeRejectsDecreasingStreamIds(t *testing.T) {
+	c, conn, _ := NewTestConnection(nil)
+	conn.readData = [][]byte{
+		headersFrame(5, false).Marshal(),
+		headersFrame(3, false).Marshal(),
+	}
+
+	err := c.Serve()
+
+	assert.Equal(t, err, ConnectionError{PROTOCOL_ERROR, "Stream identifier 3 was not greater than 5"})
+	assert.Equal(t, readAllFrames(t, conn.written), []Frame{
+		GOAWAY{5, PROTOCOL_ERROR, "Stream identifier 3 was not greater than 5"},
+	})
+}
+
+func TestControlFramesJumpQueuedStreamFrames(t *testing.T) {
+	c, conn, _ := NewTestConnection(nil)
+	c.scheduler.Push(dataFrame(1, false))
+
+	assert.Nil(t, c.handleFrame(PING{OpaqueData: 1}))
+	assert.Nil(t, c.flushStreamFrames())
+
+	assert.Equal(t, readAllFrames(t, conn.written), []Frame{pingAck(1), dataFrame(1, false)})
+}
+
+func TestServerUsesConfiguredWriteScheduler(t *testing.T) {
+	scheduler := NewPriorityWriteScheduler()
+	server, conn := NewTestServer()
+	server.NewWriteScheduler = func() WriteScheduler { return scheduler }
+	conn.readData = [][]byte{[]byte(preface), SETTINGS{}.Marshal()}
+
+	c, err := server.InitiateConn(conn)
+	assert.Nil(t, err)
+
+	assert.Nil(t, c.handleFrame(headersFrame(1, false)))
+	assert.Nil(t, c.handleFrame(headersFrame(3, false)))
+	assert.Nil(t, c.handleFrame(PRIORITY{StreamId: 3, StreamDependency: 1, Weight: 15}))
+	assert.Equal(t, childIds(scheduler, 1), []uint32{3},
+		"Priority signals should have reached the scheduler")
+}
+
+func TestServerNoRFC7540PrioritiesIgnoresPriorityFields(t *testing.T) {
+	scheduler := NewPriorityWriteScheduler()
+	server, conn := NewTestServer()
+	server.NewWriteScheduler = func() WriteScheduler { return scheduler }
+	server.NoRFC7540Priorities = true
+	conn.readData = [][]byte{[]byte(preface), SETTINGS{}.Marshal()}
+
+	c, err := server.InitiateConn(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, readAllFrames(t, conn.written)[0], SETTINGS{
+		Parameters: []Parameter{{SETTINGS_NO_RFC7540_PRIORITIES, 1}},
+	})
+
+	assert.Nil(t, c.handleFrame(headersFrame(1, false)))
+	h := headersFrame(3, false)
+	h.Flags.PRIORITY = true
+	h.StreamDependency = 1
+	h.Weight = 255
+	assert.Nil(t, c.handleFrame(h))
+	assert.Nil(t, c.handleFrame(PRIORITY{StreamId: 1, StreamDependency: 3, Weight: 15}))
+
+	assert.Equal(t, childIds(scheduler, 0), []uint32{1, 3},
+		"Priority fields should not have reached the scheduler")
+	assert.Equal(t, scheduler.nodes[3].weight, 16)
+}
+
+func TestPeerNoRFC7540PrioritiesIgnoresPriorityFields(t *testing.T) {
+	scheduler := NewPriorityWriteScheduler()
+	server, conn := NewTestServer()
+	server.NewWriteScheduler = func() WriteScheduler { return scheduler }
+	conn.readData = [][]byte{[]byte(preface), SETTINGS{
+		Parameters: []Parameter{{SETTINGS_NO_RFC7540_PRIORITIES, 1}},
+	}.Marshal()}
+
+	c, err := server.InitiateConn(conn)
+	assert.Nil(t, err)
+
+	assert.Nil(t, c.handleFrame(headersFrame(1, false)))
+	assert.Nil(t, c.handleFrame(headersFrame(3, false)))
+	assert.Nil(t, c.handleFrame(PRIORITY{StreamId: 3, StreamDependency: 1, Weight: 15}))
+	assert.Equal(t, childIds(scheduler, 1), []uint32{},
+		"PRIORITY should not have reached the scheduler")
+}
+
+func TestResetStreamDropsQueuedFrames(t *testing.T) {
+	c, conn, _ := NewTestConnection(nil)
+	NewTestStream(t, c, 1)
+	c.scheduler.Push(dataFrame(1, false))
+
+	assert.Nil(t, c.resetStream(StreamError{1, CANCEL, "cancelled"}))
+	assert.Nil(t, c.flushStreamFrames())
+
+	assert.Equal(t, readAllFrames(t, conn.written), []Frame{RST_STREAM{1, CANCEL}})
+}
+
+func TestHandleErrorMapsErrorsToFrames(t *testing.T) {
+	c, conn, _ := NewTestConnection(nil)
+	NewTestStream(t, c, 1)
+
+	assert.Nil(t, c.handleError(nil))
+	assert.Nil(t, c.handleError(StreamError{1, CANCEL, "Cancelled"}))
+	assert.False(t, conn.closed, "A stream error should only have reset the stream")
+
+	err := fmt.Errorf("Handling HEADERS: %w", ConnectionError{ENHANCE_YOUR_CALM, "Too many resets"})
+	assert.Equal(t, c.handleError(err), err)
+	assert.True(t, conn.closed)
+
+	assert.Equal(t, readAllFrames(t, conn.written), []Frame{
+		RST_STREAM{1, CANCEL},
+		GOAWAY{1, ENHANCE_YOUR_CALM, "Too many resets"},
+	})
+}
+
+func TestOtherErrorsAreInternalErrors(t *testing.T) {
+	assert.Nil(t, asProtocolError(nil))
+	assert.Equal(t, asProtocolError(StreamError{1, CANCEL, "Cancelled"}), StreamError{1, CANCEL, "Cancelled"})
+	assert.Equal(t, asProtocolError(errors.New("Out of memory")),
+		ConnectionError{INTERNAL_ERROR, "Out of memory"})
+}
+
+func TestServeIgnoresUnknownFrames(t *testing.T) {
+	c, conn, _ := NewTestConnection(nil)
+	conn.readData = [][]byte{
+		UnknownFrame{Type: 0xF0, StreamId: 1, Payload: "extension"}.Marshal(),
+		PING{OpaqueData: 1}.Marshal(),
+		CONTINUATION{StreamId: 3}.Marshal(),
+	}
+
+	c.Serve()
+
+	assert.Equal(t, readAllFrames(t, conn.written), []Frame{
+		pingAck(1),
+		GOAWAY{0, PROTOCOL_ERROR, "CONTINUATION frame on stream 3 did not follow a header block"},
+	})
+}
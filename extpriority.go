@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ExtensiblePriority is carried in the priority header field and in
+// PRIORITY_UPDATE frames.  Lower urgencies are more important.
+// http://tools.ietf.org/html/rfc9218#section-4
+type ExtensiblePriority struct {
+	Urgency     uint8
+	Incremental bool
+}
+
+const maxUrgency = 7
+
+// http://tools.ietf.org/html/rfc9218#section-4.1
+var defaultExtensiblePriority = ExtensiblePriority{Urgency: 3, Incremental: false}
+
+// ParseExtensiblePriority reads a priority field value, which is a
+// structured field dictionary such as "u=1, i".  Members that are unknown
+// or invalid are ignored, leaving the defaults in place.
+// http://tools.ietf.org/html/rfc9218#section-5
+func ParseExtensiblePriority(value string) ExtensiblePriority {
+	p := defaultExtensiblePriority
+
+	for _, member := range strings.Split(value, ",") {
+		member = strings.Trim(member, " \t")
+		if i := strings.IndexByte(member, ';'); i >= 0 {
+			// Parameters are not used by either key
+			member = member[0:i]
+		}
+
+		key, item, hasItem := strings.Cut(member, "=")
+		switch key {
+		case "u":
+			urgency, err := strconv.ParseUint(item, 10, 8)
+			if hasItem && err == nil && urgency <= maxUrgency {
+				p.Urgency = uint8(urgency)
+			}
+		case "i":
+			switch {
+			case !hasItem || item == "?1":
+				p.Incremental = true
+			case item == "?0":
+				p.Incremental = false
+			}
+		}
+	}
+
+	return p
+}
+
+// String serializes the priority as a field value, leaving out defaults.
+func (p ExtensiblePriority) String() string {
+	members := []string{}
+	if p.Urgency != defaultExtensiblePriority.Urgency {
+		members = append(members, fmt.Sprintf("u=%d", p.Urgency))
+	}
+	if p.Incremental {
+		members = append(members, "i")
+	}
+
+	return strings.Join(members, ", ")
+}
+
+// extensiblePriority returns the priority signalled by a request's header
+// block or a PRIORITY_UPDATE frame.
+func extensiblePriority(f Frame) (uint32, ExtensiblePriority, bool) {
+	switch f := f.(type) {
+	case HeaderBlock:
+		for _, field := range f.Fields {
+			if field.Name == "priority" {
+				return f.StreamId, ParseExtensiblePriority(field.Value), true
+			}
+		}
+		return f.StreamId, defaultExtensiblePriority, true
+	case PRIORITY_UPDATE:
+		return f.PrioritizedStreamId, ParseExtensiblePriority(f.PriorityFieldValue), true
+	}
+
+	return 0, ExtensiblePriority{}, false
+}
+
+type urgencyStream struct {
+	id       uint32
+	priority ExtensiblePriority
+	queue    []Frame
+	// idle is set until the stream is opened or has frames queued
+	idle bool
+}
+
+// ExtensiblePriorityWriteScheduler serves streams by urgency, most urgent
+// first.  Within an urgency, non-incremental streams are sent one at a
+// time in order of stream identifier, before incremental streams share
+// what is left round-robin.
+// http://tools.ietf.org/html/rfc9218#section-10
+type ExtensiblePriorityWriteScheduler struct {
+	streams map[uint32]*urgencyStream
+	// buckets holds the streams at each urgency; incremental streams move
+	// to the back of their bucket once served
+	buckets [maxUrgency + 1][]*urgencyStream
+	// idle are the streams that have been prioritized but not opened,
+	// oldest first; beyond maxIdlePriorityNodes the oldest is forgotten
+	// http://tools.ietf.org/html/rfc9218#section-7.1
+	idle []*urgencyStream
+}
+
+func NewExtensiblePriorityWriteScheduler() *ExtensiblePriorityWriteScheduler {
+	return &ExtensiblePriorityWriteScheduler{
+		streams: make(map[uint32]*urgencyStream),
+	}
+}
+
+func (s *ExtensiblePriorityWriteScheduler) OpenStream(streamId uint32, priority ExtensiblePriority) {
+	s.adjust(streamId, priority, false)
+}
+
+// AdjustStream changes the priority of a stream, which may not have been
+// opened yet.
+func (s *ExtensiblePriorityWriteScheduler) AdjustStream(streamId uint32, priority ExtensiblePriority) {
+	s.adjust(streamId, priority, true)
+}
+
+// adjust changes the priority of a stream, adding it as idle or open if
+// it is not known yet.
+func (s *ExtensiblePriorityWriteScheduler) adjust(streamId uint32, priority ExtensiblePriority, idle bool) {
+	if priority.Urgency > maxUrgency {
+		priority.Urgency = maxUrgency
+	}
+
+	st, ok := s.streams[streamId]
+	if !ok {
+		st = &urgencyStream{id: streamId, idle: idle}
+		s.streams[streamId] = st
+		if idle {
+			s.idle = append(s.idle, st)
+		}
+	} else {
+		s.removeFromBucket(st)
+	}
+
+	st.priority = priority
+	s.buckets[priority.Urgency] = append(s.buckets[priority.Urgency], st)
+	if !idle {
+		s.opened(st)
+	}
+
+	if len(s.idle) > maxIdlePriorityNodes {
+		s.CloseStream(s.idle[0].id)
+	}
+}
+
+// Prioritize applies the priority in a request's header block or a
+// PRIORITY_UPDATE frame.  A header block does not override the priority of
+// a stream that was already updated, or of trailers.
+// http://tools.ietf.org/html/rfc9218#section-7
+func (s *ExtensiblePriorityWriteScheduler) Prioritize(f Frame) error {
+	streamId, priority, ok := extensiblePriority(f)
+	if !ok {
+		return nil
+	}
+
+	if _, isUpdate := f.(PRIORITY_UPDATE); isUpdate {
+		s.AdjustStream(streamId, priority)
+		return nil
+	}
+	if st := s.streams[streamId]; st != nil {
+		s.opened(st)
+		return nil
+	}
+
+	s.OpenStream(streamId, priority)
+	return nil
+}
+
+// CloseStream forgets a stream, returning any frames still queued for it.
+func (s *ExtensiblePriorityWriteScheduler) CloseStream(streamId uint32) []Frame {
+	st, ok := s.streams[streamId]
+	if !ok {
+		return nil
+	}
+
+	s.removeFromBucket(st)
+	s.opened(st)
+	delete(s.streams, streamId)
+
+	return st.queue
+}
+
+// Push queues a frame to be written on its stream.  Frames for streams
+// that have not been opened are queued with the default priority.
+func (s *ExtensiblePriorityWriteScheduler) Push(f Frame) {
+	streamId := frameStreamId(f)
+	st, ok := s.streams[streamId]
+	if !ok {
+		s.OpenStream(streamId, defaultExtensiblePriority)
+		st = s.streams[streamId]
+	}
+	s.opened(st)
+
+	st.queue = append(st.queue, f)
+}
+
+// Pop returns the next frame to write, if any are queued.
+func (s *ExtensiblePriorityWriteScheduler) Pop() (Frame, bool) {
+	for urgency, bucket := range s.buckets {
+		var next *urgencyStream
+		for _, st := range bucket {
+			if len(st.queue) > 0 && !st.priority.Incremental && (next == nil || st.id < next.id) {
+				next = st
+			}
+		}
+
+		if next == nil {
+			for i, st := range bucket {
+				if len(st.queue) > 0 {
+					next = st
+					// Round-robin between incremental streams
+					bucket = append(bucket[0:i], bucket[i+1:]...)
+					s.buckets[urgency] = append(bucket, st)
+					break
+				}
+			}
+		}
+
+		if next != nil {
+			f := next.queue[0]
+			next.queue = next.queue[1:]
+			return f, true
+		}
+	}
+
+	return nil, false
+}
+
+// opened stops treating st as an idle stream.
+func (s *ExtensiblePriorityWriteScheduler) opened(st *urgencyStream) {
+	if !st.idle {
+		return
+	}
+
+	st.idle = false
+	for i, idle := range s.idle {
+		if idle == st {
+			s.idle = append(s.idle[0:i], s.idle[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *ExtensiblePriorityWriteScheduler) removeFromBucket(st *urgencyStream) {
+	bucket := s.buckets[st.priority.Urgency]
+	for i, other := range bucket {
+		if other == st {
+			s.buckets[st.priority.Urgency] = append(bucket[0:i], bucket[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func popStreamIds(t *testing.T, s *ExtensiblePriorityWriteScheduler, n int) []uint32 {
+	ids := []uint32{}
+	for i := 0; i < n; i++ {
+		f, ok := s.Pop()
+		assert.True(t, ok)
+		ids = append(ids, frameStreamId(f))
+	}
+	return ids
+}
+
+func TestParseExtensiblePriority(t *testing.T) {
+	assert.Equal(t, ParseExtensiblePriority(""), ExtensiblePriority{3, false})
+	assert.Equal(t, ParseExtensiblePriority("u=5"), ExtensiblePriority{5, false})
+	assert.Equal(t, ParseExtensiblePriority("u=0, i"), ExtensiblePriority{0, true})
+	assert.Equal(t, ParseExtensiblePriority("i=?1,u=7"), ExtensiblePriority{7, true})
+	assert.Equal(t, ParseExtensiblePriority("i, i=?0"), ExtensiblePriority{3, false},
+		"The last value of a key should win")
+	assert.Equal(t, ParseExtensiblePriority("u=2;foo=bar, i;x"), ExtensiblePriority{2, true},
+		"Parameters should have been ignored")
+}
+
+func TestParseExtensiblePriorityIgnoresInvalidMembers(t *testing.T) {
+	assert.Equal(t, ParseExtensiblePriority("u=8"), ExtensiblePriority{3, false})
+	assert.Equal(t, ParseExtensiblePriority("u=-1, i=1"), ExtensiblePriority{3, false})
+	assert.Equal(t, ParseExtensiblePriority("u, foo=2, u=1"), ExtensiblePriority{1, false})
+}
+
+func TestExtensiblePriorityString(t *testing.T) {
+	assert.Equal(t, ExtensiblePriority{3, false}.String(), "")
+	assert.Equal(t, ExtensiblePriority{1, true}.String(), "u=1, i")
+	assert.Equal(t, ExtensiblePriority{3, true}.String(), "i")
+}
+
+func TestExtensiblePriorityFromFrames(t *testing.T) {
+	id, p, ok := extensiblePriority(HeaderBlock{
+		StreamId: 3,
+		Fields:   []HeaderField{{":method", "GET", false}, {"priority", "u=1", false}},
+	})
+	assert.True(t, ok)
+	assert.Equal(t, id, uint32(3))
+	assert.Equal(t, p, ExtensiblePriority{1, false})
+
+	_, p, _ = extensiblePriority(HeaderBlock{StreamId: 3})
+	assert.Equal(t, p, defaultExtensiblePriority)
+
+	id, p, ok = extensiblePriority(PRIORITY_UPDATE{5, "i"})
+	assert.True(t, ok)
+	assert.Equal(t, id, uint32(5))
+	assert.Equal(t, p, ExtensiblePriority{3, true})
+
+	_, _, ok = extensiblePriority(dataFrame(3, false))
+	assert.False(t, ok)
+}
+
+func TestExtensiblePriorityServesUrgentStreamsFirst(t *testing.T) {
+	s := NewExtensiblePriorityWriteScheduler()
+	s.OpenStream(1, ExtensiblePriority{5, false})
+	s.OpenStream(3, ExtensiblePriority{0, false})
+	s.Push(dataFrame(1, false))
+	s.Push(dataFrame(3, false))
+	s.Push(dataFrame(3, true))
+
+	assert.Equal(t, popStreamIds(t, s, 3), []uint32{3, 3, 1})
+
+	_, ok := s.Pop()
+	assert.False(t, ok)
+}
+
+func TestExtensiblePriorityNonIncrementalInStreamOrder(t *testing.T) {
+	s := NewExtensiblePriorityWriteScheduler()
+	s.OpenStream(5, defaultExtensiblePriority)
+	s.OpenStream(3, defaultExtensiblePriority)
+	for i := 0; i < 2; i++ {
+		s.Push(dataFrame(5, false))
+		s.Push(dataFrame(3, false))
+	}
+
+	assert.Equal(t, popStreamIds(t, s, 4), []uint32{3, 3, 5, 5})
+}
+
+func TestExtensiblePriorityIncrementalRoundRobin(t *testing.T) {
+	s := NewExtensiblePriorityWriteScheduler()
+	s.OpenStream(1, ExtensiblePriority{3, true})
+	s.OpenStream(3, ExtensiblePriority{3, true})
+	s.OpenStream(5, ExtensiblePriority{3, false})
+	for i := 0; i < 3; i++ {
+		s.Push(dataFrame(1, false))
+		s.Push(dataFrame(3, false))
+	}
+	s.Push(dataFrame(5, false))
+
+	assert.Equal(t, popStreamIds(t, s, 7), []uint32{5, 1, 3, 1, 3, 1, 3})
+}
+
+func TestExtensiblePriorityAdjustStream(t *testing.T) {
+	s := NewExtensiblePriorityWriteScheduler()
+	s.OpenStream(1, defaultExtensiblePriority)
+	s.OpenStream(3, defaultExtensiblePriority)
+	s.Push(dataFrame(1, false))
+	s.Push(dataFrame(3, false))
+
+	s.AdjustStream(3, ExtensiblePriority{1, false})
+
+	assert.Equal(t, popStreamIds(t, s, 2), []uint32{3, 1})
+	assert.Equal(t, len(s.buckets[3]), 1, "Stream should have left its old urgency")
+}
+
+func TestExtensiblePriorityCloseStream(t *testing.T) {
+	s := NewExtensiblePriorityWriteScheduler()
+	s.Push(dataFrame(1, false))
+	s.Push(dataFrame(3, false))
+
+	assert.Equal(t, s.CloseStream(1), []Frame{dataFrame(1, false)})
+	assert.Nil(t, s.CloseStream(7))
+
+	assert.Equal(t, popStreamIds(t, s, 1), []uint32{3})
+	_, ok := s.Pop()
+	assert.False(t, ok, "Frames queued for the closed stream should have been dropped")
+}
+
+func TestExtensiblePriorityPrioritizeFromFrames(t *testing.T) {
+	s := NewExtensiblePriorityWriteScheduler()
+	assert.Nil(t, s.Prioritize(PRIORITY_UPDATE{3, "u=0"}))
+	assert.Nil(t, s.Prioritize(HeaderBlock{
+		StreamId: 3,
+		Fields:   []HeaderField{{"priority", "u=6", false}},
+	}))
+	assert.Equal(t, s.streams[3].priority, ExtensiblePriority{0, false},
+		"PRIORITY_UPDATE sent before the request should have taken precedence")
+
+	assert.Nil(t, s.Prioritize(PRIORITY_UPDATE{3, "u=2, i"}))
+	assert.Equal(t, s.streams[3].priority, ExtensiblePriority{2, true})
+}
+
+func TestExtensiblePriorityLimitsIdleStreams(t *testing.T) {
+	s := NewExtensiblePriorityWriteScheduler()
+	assert.Nil(t, s.Prioritize(HeaderBlock{StreamId: 1}))
+	for id := uint32(3); id < 2003; id += 2 {
+		assert.Nil(t, s.Prioritize(PRIORITY_UPDATE{id, "u=1"}))
+	}
+
+	assert.Equal(t, len(s.streams), 1+maxIdlePriorityNodes)
+	assert.Equal(t, len(s.buckets[1]), maxIdlePriorityNodes)
+	assert.NotNil(t, s.streams[1], "Open streams should not have been removed")
+	assert.NotNil(t, s.streams[2001])
+	assert.Nil(t, s.streams[3])
+
+	assert.Nil(t, s.Prioritize(HeaderBlock{StreamId: 2001}))
+	assert.Equal(t, len(s.idle), maxIdlePriorityNodes-1, "Opening the stream should have kept its priority")
+	assert.Equal(t, s.streams[2001].priority, ExtensiblePriority{1, false})
+}
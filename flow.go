@@ -0,0 +1,389 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// http://tools.ietf.org/html/rfc9113#section-6.9
+const (
+	defaultInitialWindowSize = 65535
+	maxWindowSize            = 1<<31 - 1
+)
+
+// flowControlledLength is the number of bytes a DATA frame counts against
+// the receive window, which includes any padding.
+// http://tools.ietf.org/html/rfc9113#section-6.9.1
+func flowControlledLength(f DATA) int64 {
+	n := int64(len(f.Data) + len(f.Padding))
+	if f.Flags.PADDED || len(f.Padding) > 0 {
+		// The Pad Length field
+		n += 1
+	}
+
+	return n
+}
+
+// WriteData sends data on a stream as one or more DATA frames, blocking
+// while the stream or connection send window is exhausted.
+func (c *Connection) WriteData(streamId uint32, data []byte, endStream bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for {
+		if c.closed {
+			return ErrConnectionClosed
+		}
+
+		s, tracked := c.streams.get(streamId)
+		if !tracked || (s.state != StreamOpen && s.state != StreamHalfClosedRemote) {
+			return c.streamSendError(s, DATA{})
+		}
+
+		n := int64(len(data))
+		if n > int64(c.peerSettings.MaxFrameSize) {
+			n = int64(c.peerSettings.MaxFrameSize)
+		}
+		if n > s.sendWindow {
+			n = s.sendWindow
+		}
+		if n > c.sendWindow {
+			n = c.sendWindow
+		}
+		if n <= 0 && len(data) > 0 {
+			c.windowUpdated.Wait()
+			continue
+		}
+
+		f := DATA{StreamId: streamId, Data: string(data[0:n])}
+		f.Flags.END_STREAM = endStream && n == int64(len(data))
+		if err := c.streams.send(f); err != nil {
+			return err
+		}
+		s.sendWindow -= n
+		c.sendWindow -= n
+
+		c.mu.Unlock()
+		err := c.writeStreamFrame(f)
+		if err == nil && f.Flags.END_STREAM {
+			c.releaseStream(streamId)
+		}
+		c.mu.Lock()
+
+		if err != nil {
+			return err
+		}
+
+		data = data[n:]
+		if len(data) == 0 {
+			return nil
+		}
+	}
+}
+
+// http://tools.ietf.org/html/rfc9113#section-6.9.1
+func (c *Connection) handleData(f DATA) error {
+	n := flowControlledLength(f)
+	delivered, err := c.receiveData(f, n)
+
+	if delivered {
+		return c.discardPadding(f, n-int64(len(f.Data)))
+	}
+	var connErr ConnectionError
+	if errors.As(err, &connErr) {
+		return err
+	}
+	if discardErr := c.discardData(n); discardErr != nil {
+		return discardErr
+	}
+
+	return err
+}
+
+// receiveData counts f against the receive windows, returning whether it
+// is for the application.
+func (c *Connection) receiveData(f DATA, n int64) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// DATA counts against the connection window even on closed streams
+	if n > c.recvWindow {
+		return false, ConnectionError{
+			FLOW_CONTROL_ERROR,
+			"DATA frame exceeded the connection flow-control window",
+		}
+	}
+	c.recvWindow -= n
+
+	s, tracked := c.streams.get(f.StreamId)
+	if err := c.streams.receive(f); err != nil || !tracked {
+		return false, err
+	}
+
+	if n > s.recvWindow {
+		return false, StreamError{
+			f.StreamId,
+			FLOW_CONTROL_ERROR,
+			fmt.Sprintf("DATA frame exceeded the flow-control window of stream %d", f.StreamId),
+		}
+	}
+	s.recvWindow -= n
+
+	return true, nil
+}
+
+// discardData returns n bytes of DATA that the application will never see
+// to the connection receive window at once.  The WindowUpdatePolicy is not
+// consulted, as it only paces what the application has consumed.
+func (c *Connection) discardData(n int64) error {
+	if n == 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	c.recvWindow += n
+	c.mu.Unlock()
+
+	return c.writeFrame(WINDOW_UPDATE{0, uint32(n)})
+}
+
+// discardPadding returns the n bytes of padding and Pad Length in a
+// delivered DATA frame to the receive windows at once, as the application
+// only ever consumes the data.
+func (c *Connection) discardPadding(f DATA, n int64) error {
+	if n == 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	updates := []WINDOW_UPDATE{{0, uint32(n)}}
+	c.recvWindow += n
+
+	s, tracked := c.streams.get(f.StreamId)
+	if tracked && s.state != StreamHalfClosedRemote {
+		s.recvWindow += n
+		updates = append(updates, WINDOW_UPDATE{f.StreamId, uint32(n)})
+	}
+	c.mu.Unlock()
+
+	for _, u := range updates {
+		if err := c.writeFrame(u); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// http://tools.ietf.org/html/rfc9113#section-6.9
+func (c *Connection) handleWindowUpdate(f WINDOW_UPDATE) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	increment := int64(f.WindowSizeIncrement)
+
+	if f.StreamId == 0 {
+		if increment == 0 {
+			return ConnectionError{PROTOCOL_ERROR, "WINDOW_UPDATE increment must not be 0"}
+		}
+		if c.sendWindow+increment > maxWindowSize {
+			return ConnectionError{
+				FLOW_CONTROL_ERROR,
+				"WINDOW_UPDATE exceeded the maximum connection flow-control window",
+			}
+		}
+		c.sendWindow += increment
+		c.windowUpdated.Broadcast()
+		return nil
+	}
+
+	s, tracked := c.streams.get(f.StreamId)
+	if err := c.streams.receive(f); err != nil || !tracked {
+		return err
+	}
+
+	if increment == 0 {
+		return StreamError{f.StreamId, PROTOCOL_ERROR, "WINDOW_UPDATE increment must not be 0"}
+	}
+	if s.sendWindow+increment > maxWindowSize {
+		return StreamError{
+			f.StreamId,
+			FLOW_CONTROL_ERROR,
+			fmt.Sprintf("WINDOW_UPDATE exceeded the maximum flow-control window of stream %d", f.StreamId),
+		}
+	}
+	s.sendWindow += increment
+	c.windowUpdated.Broadcast()
+
+	return nil
+}
+
+// adjustSendWindows applies a change in the peer's
+// SETTINGS_INITIAL_WINDOW_SIZE to every stream, as well as to new ones.
+// c.mu must be held.
+// http://tools.ietf.org/html/rfc9113#section-6.9.2
+func (c *Connection) adjustSendWindows(initialWindowSize uint32) error {
+	if initialWindowSize > maxWindowSize {
+		return ConnectionError{
+			FLOW_CONTROL_ERROR,
+			fmt.Sprintf("SETTINGS_INITIAL_WINDOW_SIZE of %d exceeded the maximum flow-control window", initialWindowSize),
+		}
+	}
+
+	delta := int64(initialWindowSize) - c.streams.initialSendWindow
+	for _, s := range c.streams.streams {
+		if s.sendWindow+delta > maxWindowSize {
+			return ConnectionError{
+				FLOW_CONTROL_ERROR,
+				fmt.Sprintf("SETTINGS_INITIAL_WINDOW_SIZE caused the flow-control window of stream %d to overflow", s.Id),
+			}
+		}
+	}
+
+	for _, s := range c.streams.streams {
+		s.sendWindow += delta
+	}
+	c.streams.initialSendWindow = int64(initialWindowSize)
+	c.windowUpdated.Broadcast()
+
+	return nil
+}
+
+// adjustRecvWindows applies a change in our own acknowledged
+// SETTINGS_INITIAL_WINDOW_SIZE.  c.mu must be held.
+func (c *Connection) adjustRecvWindows(initialWindowSize uint32) {
+	delta := int64(initialWindowSize) - c.streams.initialRecvWindow
+	for _, s := range c.streams.streams {
+		s.recvWindow += delta
+	}
+	c.streams.initialRecvWindow = int64(initialWindowSize)
+}
+
+// WindowUpdatePolicy decides when receive windows are reopened once the
+// application has consumed data.  It is given the full size of the window
+// and the number of bytes consumed that have not yet been returned to the
+// peer, and returns the increment to send in a WINDOW_UPDATE, or 0 to wait
+// for more to be consumed.  DATA that never reaches the application, such
+// as on streams that have been reset, is returned to the connection window
+// without consulting the policy.
+type WindowUpdatePolicy interface {
+	WindowUpdate(windowSize int64, consumed int64) int64
+}
+
+// ThresholdPolicy returns everything consumed once it reaches Fraction of
+// the window.
+type ThresholdPolicy struct {
+	Fraction float64
+}
+
+func (p ThresholdPolicy) WindowUpdate(windowSize int64, consumed int64) int64 {
+	if consumed > 0 && float64(consumed) >= p.Fraction*float64(windowSize) {
+		return consumed
+	}
+	return 0
+}
+
+// FixedIncrementPolicy reopens windows in multiples of Increment, which
+// keeps the number of WINDOW_UPDATE frames predictable.
+type FixedIncrementPolicy struct {
+	Increment int64
+}
+
+func (p FixedIncrementPolicy) WindowUpdate(windowSize int64, consumed int64) int64 {
+	if p.Increment <= 0 {
+		return consumed
+	}
+	return consumed - consumed%p.Increment
+}
+
+// ManualPolicy never sends WINDOW_UPDATE frames by itself; the application
+// calls Connection.SendWindowUpdate instead.
+type ManualPolicy struct{}
+
+func (ManualPolicy) WindowUpdate(windowSize int64, consumed int64) int64 {
+	return 0
+}
+
+// DefaultWindowUpdatePolicy replenishes a window once half of it has been
+// consumed.
+var DefaultWindowUpdatePolicy WindowUpdatePolicy = ThresholdPolicy{0.5}
+
+// Consumed tells the connection that the application has finished with n
+// bytes of DATA received on a stream, which may reopen the connection and
+// stream receive windows according to the WindowUpdatePolicy.
+func (c *Connection) Consumed(streamId uint32, n int) error {
+	c.mu.Lock()
+	updates := []WINDOW_UPDATE{}
+
+	c.recvConsumed += int64(n)
+	if increment := c.replenish(&c.recvWindow, &c.recvConsumed, c.recvWindowSize); increment > 0 {
+		updates = append(updates, WINDOW_UPDATE{0, increment})
+	}
+
+	// There is no point reopening the window of a stream the peer has
+	// finished sending on
+	s, tracked := c.streams.get(streamId)
+	if tracked && s.state != StreamHalfClosedRemote {
+		s.recvConsumed += int64(n)
+		if increment := c.replenish(&s.recvWindow, &s.recvConsumed, c.streams.initialRecvWindow); increment > 0 {
+			updates = append(updates, WINDOW_UPDATE{streamId, increment})
+		}
+	}
+	c.mu.Unlock()
+
+	for _, f := range updates {
+		if err := c.writeFrame(f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replenish asks the policy how much of consumed to return to the window,
+// never more than has actually been consumed.  c.mu must be held.
+func (c *Connection) replenish(window *int64, consumed *int64, windowSize int64) uint32 {
+	increment := c.windowPolicy.WindowUpdate(windowSize, *consumed)
+	if increment > *consumed {
+		increment = *consumed
+	}
+	if increment <= 0 {
+		return 0
+	}
+
+	*consumed -= increment
+	*window += increment
+
+	return uint32(increment)
+}
+
+// SendWindowUpdate reopens a receive window by increment, for use with
+// ManualPolicy; a streamId of 0 means the connection window.
+func (c *Connection) SendWindowUpdate(streamId uint32, increment uint32) error {
+	if increment == 0 {
+		return fmt.Errorf("WINDOW_UPDATE increment must not be 0")
+	}
+
+	c.mu.Lock()
+	window, consumed := &c.recvWindow, &c.recvConsumed
+	if streamId != 0 {
+		s, tracked := c.streams.get(streamId)
+		if !tracked {
+			c.mu.Unlock()
+			return s.sendError(WINDOW_UPDATE{})
+		}
+		window, consumed = &s.recvWindow, &s.recvConsumed
+	}
+	if *window+int64(increment) > maxWindowSize {
+		c.mu.Unlock()
+		return fmt.Errorf("WINDOW_UPDATE would exceed the maximum flow-control window")
+	}
+	*window += int64(increment)
+	*consumed -= int64(increment)
+	if *consumed < 0 {
+		*consumed = 0
+	}
+	c.mu.Unlock()
+
+	return c.writeFrame(WINDOW_UPDATE{streamId, increment})
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+// NewTestStream opens a stream from the client so that the server can
+// respond on it.
+func NewTestStream(t *testing.T, c *Connection, streamId uint32) *Stream {
+	assert.Nil(t, c.handleFrame(headersFrame(streamId, false)))
+	s, tracked := c.streams.get(streamId)
+	assert.True(t, tracked)
+
+	return s
+}
+
+// waitFor polls until condition holds under the connection lock, for
+// checking on writers blocked in another goroutine.
+func waitFor(t *testing.T, c *Connection, condition func() bool) {
+	for i := 0; i < 1000; i++ {
+		c.mu.Lock()
+		ok := condition()
+		c.mu.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("Condition was never met")
+}
+
+func writtenData(t *testing.T, wire []byte) []DATA {
+	data := []DATA{}
+	for _, f := range readAllFrames(t, wire) {
+		if d, ok := f.(DATA); ok {
+			data = append(data, d)
+		}
+	}
+	return data
+}
+
+func TestFlowControlledLengthIncludesPadding(t *testing.T) {
+	assert.Equal(t, flowControlledLength(DATA{Data: "abc"}), int64(3))
+	assert.Equal(t, flowControlledLength(DATA{Data: "abc", Padding: "\x00\x00"}), int64(6))
+
+	empty := DATA{Data: "abc"}
+	empty.Flags.PADDED = true
+	assert.Equal(t, flowControlledLength(empty), int64(4), "An empty Pad Length field still counts")
+}
+
+func TestWriteDataSplitsIntoFrames(t *testing.T) {
+	c, conn, _ := NewTestConnection(nil)
+	NewTestStream(t, c, 1)
+
+	assert.Nil(t, c.WriteData(1, []byte(strings.Repeat("a", 20000)), true))
+
+	data := writtenData(t, conn.written)
+	assert.Equal(t, len(data), 2)
+	assert.Equal(t, len(data[0].Data), defaultMaxFrameSize)
+	assert.False(t, data[0].Flags.END_STREAM)
+	assert.Equal(t, len(data[1].Data), 20000-defaultMaxFrameSize)
+	assert.True(t, data[1].Flags.END_STREAM, "Only the last frame should end the stream")
+	assert.Equal(t, c.sendWindow, int64(defaultInitialWindowSize-20000))
+}
+
+func TestWriteDataSplitsToPeerMaxFrameSize(t *testing.T) {
+	c, conn, _ := NewTestConnection(nil)
+	NewTestStream(t, c, 1)
+
+	assert.Nil(t, c.handleFrame(SETTINGS{Parameters: []Parameter{{SETTINGS_MAX_FRAME_SIZE, 20000}}}))
+	conn.written = conn.written[0:0]
+	assert.Nil(t, c.WriteData(1, []byte(strings.Repeat("a", 30000)), true))
+
+	codec := FrameCodec{MaxFrameSize: 20000}
+	advance, f, err := codec.Unmarshal(conn.written)
+	assert.Nil(t, err)
+	assert.Equal(t, len(f.(DATA).Data), 20000)
+	_, f, err = codec.Unmarshal(conn.written[advance:])
+	assert.Nil(t, err)
+	assert.Equal(t, len(f.(DATA).Data), 10000)
+}
+
+func TestWriteDataBlocksUntilWindowUpdate(t *testing.T) {
+	c, conn, _ := NewTestConnection(nil)
+	s := NewTestStream(t, c, 1)
+
+	done := make(chan error)
+	go func() {
+		done <- c.WriteData(1, []byte(strings.Repeat("a", 70000)), true)
+	}()
+
+	waitFor(t, c, func() bool { return c.sendWindow == 0 })
+	select {
+	case <-done:
+		t.Fatal("WriteData should have blocked on the exhausted window")
+	default:
+	}
+
+	assert.Nil(t, c.handleFrame(WINDOW_UPDATE{0, 10000}))
+	assert.Nil(t, c.handleFrame(WINDOW_UPDATE{1, 10000}))
+	assert.Nil(t, <-done)
+
+	total := 0
+	for _, d := range writtenData(t, conn.written) {
+		total += len(d.Data)
+	}
+	assert.Equal(t, total, 70000)
+	assert.Equal(t, s.sendWindow, int64(defaultInitialWindowSize+10000-70000))
+}
+
+func TestWriteDataUnblocksWhenConnectionCloses(t *testing.T) {
+	c, _, _ := NewTestConnection(nil)
+	NewTestStream(t, c, 1)
+	c.sendWindow = 0
+
+	done := make(chan error)
+	go func() {
+		done <- c.WriteData(1, []byte("hello"), false)
+	}()
+
+	c.closeWithError(ConnectionError{NO_ERROR, "Going away"})
+	assert.Equal(t, <-done, ErrConnectionClosed)
+}
+
+func TestWriteDataUnblocksWhenStreamIsReset(t *testing.T) {
+	for _, reset := range []func(c *Connection) error{
+		func(c *Connection) error { return c.handleFrame(RST_STREAM{1, CANCEL}) },
+		func(c *Connection) error { return c.resetStream(StreamError{1, CANCEL, "Cancelled"}) },
+	} {
+		c, _, _ := NewTestConnection(nil)
+		NewTestStream(t, c, 1)
+		c.sendWindow = 0
+
+		done := make(chan error)
+		go func() {
+			done <- c.WriteData(1, []byte("hello"), false)
+		}()
+
+		// Give the writer time to block on the window
+		time.Sleep(10 * time.Millisecond)
+		assert.Nil(t, reset(c))
+		assert.Equal(t, <-done, StreamError{1, STREAM_CLOSED, "Cannot send DATA frame on closed stream 1"})
+	}
+}
+
+func TestResetReturnsQueuedDataToConnectionWindow(t *testing.T) {
+	c, conn, _ := NewTestConnection(nil)
+	NewTestStream(t, c, 1)
+	NewTestStream(t, c, 3)
+
+	// DATA that WriteData has taken the whole connection window for, and
+	// that is still waiting in the scheduler
+	c.sendWindow = 0
+	c.scheduler.Push(DATA{StreamId: 1, Data: strings.Repeat("a", defaultInitialWindowSize)})
+
+	assert.Nil(t, c.resetStream(StreamError{1, CANCEL, "Cancelled"}))
+	assert.Equal(t, c.sendWindow, int64(defaultInitialWindowSize))
+
+	assert.Nil(t, c.WriteData(3, []byte("hello"), true), "Stream 3 should not have blocked")
+	assert.Equal(t, writtenData(t, conn.written), []DATA{dataFrame(3, true)})
+}
+
+func TestWriteDataOnClosedStream(t *testing.T) {
+	c, _, _ := NewTestConnection(nil)
+
+	assert.EqualError(t, c.WriteData(1, []byte("hello"), false),
+		"Cannot send DATA frame on idle stream 1")
+}
+
+func TestInitialWindowSizeAdjustsOpenStreams(t *testing.T) {
+	c, _, _ := NewTestConnection(nil)
+	s := NewTestStream(t, c, 1)
+	assert.Nil(t, c.WriteData(1, []byte(strings.Repeat("a", 50)), false))
+
+	assert.Nil(t, c.handleFrame(SETTINGS{Parameters: []Parameter{{SETTINGS_INITIAL_WINDOW_SIZE, 10}}}))
+	assert.Equal(t, s.sendWindow, int64(-40), "Window should have gone negative")
+
+	other := NewTestStream(t, c, 3)
+	assert.Equal(t, other.sendWindow, int64(10))
+	assert.Equal(t, c.sendWindow, int64(defaultInitialWindowSize-50),
+		"The connection window should not have changed")
+}
+
+func TestInitialWindowSizeOverflow(t *testing.T) {
+	c, _, _ := NewTestConnection(nil)
+	s := NewTestStream(t, c, 1)
+	s.sendWindow = maxWindowSize
+
+	err := c.handleFrame(SETTINGS{Parameters: []Parameter{{SETTINGS_INITIAL_WINDOW_SIZE, 65536}}})
+	assert.Equal(t, err, ConnectionError{
+		FLOW_CONTROL_ERROR,
+		"SETTINGS_INITIAL_WINDOW_SIZE caused the flow-control window of stream 1 to overflow",
+	})
+
+	err = c.handleFrame(SETTINGS{Parameters: []Parameter{{SETTINGS_INITIAL_WINDOW_SIZE, maxWindowSize + 1}}})
+	assert.Equal(t, err, ConnectionError{
+		FLOW_CONTROL_ERROR,
+		"SETTINGS_INITIAL_WINDOW_SIZE of 2147483648 exceeded the maximum flow-control window",
+	})
+}
+
+func TestLocalInitialWindowSizeAppliesOnAck(t *testing.T) {
+	c, _, _ := NewTestConnection([]Parameter{{SETTINGS_INITIAL_WINDOW_SIZE, 10}})
+	s := NewTestStream(t, c, 1)
+	assert.Equal(t, s.recvWindow, int64(defaultInitialWindowSize))
+
+	assert.Nil(t, c.handleFrame(settingsAck()))
+	assert.Equal(t, s.recvWindow, int64(10))
+
+	assert.Nil(t, c.handleFrame(dataFrame(1, false)))
+	assert.Nil(t, c.handleFrame(DATA{StreamId: 1, Data: "world"}))
+	assert.Equal(t, c.handleFrame(DATA{StreamId: 1, Data: "!"}), StreamError{
+		1,
+		FLOW_CONTROL_ERROR,
+		"DATA frame exceeded the flow-control window of stream 1",
+	})
+}
+
+func TestDataExceedingConnectionWindow(t *testing.T) {
+	c, _, _ := NewTestConnection(nil)
+	NewTestStream(t, c, 1)
+	c.recvWindow = 4
+
+	assert.Equal(t, c.handleFrame(dataFrame(1, false)), ConnectionError{
+		FLOW_CONTROL_ERROR,
+		"DATA frame exceeded the connection flow-control window",
+	})
+}
+
+func TestDataOnResetStreamIsReturnedToConnectionWindow(t *testing.T) {
+	c, conn, _ := NewTestConnection(nil)
+	NewTestStream(t, c, 1)
+	NewTestStream(t, c, 3)
+	assert.Nil(t, c.resetStream(StreamError{1, CANCEL, "Cancelled"}))
+	assert.Nil(t, c.handleFrame(RST_STREAM{3, CANCEL}))
+	conn.written = conn.written[0:0]
+
+	assert.Nil(t, c.handleFrame(dataFrame(1, false)),
+		"DATA may still arrive before the peer sees our RST_STREAM")
+	assert.Equal(t, c.handleFrame(dataFrame(3, false)), StreamError{
+		3,
+		STREAM_CLOSED,
+		"Received DATA frame on stream 3 after RST_STREAM",
+	})
+
+	assert.Equal(t, c.recvWindow, int64(defaultInitialWindowSize))
+	assert.Equal(t, readAllFrames(t, conn.written), []Frame{
+		WINDOW_UPDATE{0, 5},
+		WINDOW_UPDATE{0, 5},
+	})
+}
+
+func TestDataOnUnknownStreamIsReturnedToConnectionWindow(t *testing.T) {
+	c, conn, _ := NewTestConnection(nil)
+	NewTestStream(t, c, 3)
+
+	assert.Nil(t, c.handleFrame(dataFrame(1, false)), "Stream 1 was implicitly closed")
+	assert.Equal(t, c.recvWindow, int64(defaultInitialWindowSize))
+	assert.Equal(t, readAllFrames(t, conn.written), []Frame{WINDOW_UPDATE{0, 5}})
+}
+
+func TestWindowUpdateOverflow(t *testing.T) {
+	c, _, _ := NewTestConnection(nil)
+	NewTestStream(t, c, 1)
+
+	assert.Equal(t, c.handleFrame(WINDOW_UPDATE{1, maxWindowSize}), StreamError{
+		1,
+		FLOW_CONTROL_ERROR,
+		"WINDOW_UPDATE exceeded the maximum flow-control window of stream 1",
+	})
+	assert.Equal(t, c.handleFrame(WINDOW_UPDATE{0, maxWindowSize}), ConnectionError{
+		FLOW_CONTROL_ERROR,
+		"WINDOW_UPDATE exceeded the maximum connection flow-control window",
+	})
+}
+
+func TestWindowUpdateWithZeroIncrement(t *testing.T) {
+	c, _, _ := NewTestConnection(nil)
+	NewTestStream(t, c, 1)
+
+	assert.Equal(t, c.handleFrame(WINDOW_UPDATE{1, 0}), StreamError{
+		1,
+		PROTOCOL_ERROR,
+		"WINDOW_UPDATE increment must not be 0",
+	})
+	assert.Equal(t, c.handleFrame(WINDOW_UPDATE{0, 0}), ConnectionError{
+		PROTOCOL_ERROR,
+		"WINDOW_UPDATE increment must not be 0",
+	})
+}
+
+func TestThresholdPolicy(t *testing.T) {
+	p := ThresholdPolicy{0.5}
+
+	assert.Equal(t, p.WindowUpdate(100, 0), int64(0))
+	assert.Equal(t, p.WindowUpdate(100, 49), int64(0))
+	assert.Equal(t, p.WindowUpdate(100, 50), int64(50))
+	assert.Equal(t, p.WindowUpdate(100, 70), int64(70))
+}
+
+func TestFixedIncrementPolicy(t *testing.T) {
+	p := FixedIncrementPolicy{16}
+
+	assert.Equal(t, p.WindowUpdate(100, 15), int64(0))
+	assert.Equal(t, p.WindowUpdate(100, 16), int64(16))
+	assert.Equal(t, p.WindowUpdate(100, 40), int64(32))
+}
+
+func TestConsumedReplenishesWindowsWhenHalfConsumed(t *testing.T) {
+	c, conn, _ := NewTestConnection(nil)
+	s := NewTestStream(t, c, 1)
+	data := DATA{StreamId: 1, Data: strings.Repeat("a", 40000)}
+	assert.Nil(t, c.handleFrame(data))
+
+	assert.Nil(t, c.Consumed(1, 30000))
+	assert.Equal(t, len(conn.written), 0, "Less than half of the windows should have been consumed")
+
+	assert.Nil(t, c.Consumed(1, 10000))
+	assert.Equal(t, readAllFrames(t, conn.written), []Frame{
+		WINDOW_UPDATE{0, 40000},
+		WINDOW_UPDATE{1, 40000},
+	})
+	assert.Equal(t, c.recvWindow, int64(defaultInitialWindowSize))
+	assert.Equal(t, s.recvWindow, int64(defaultInitialWindowSize))
+}
+
+func TestPaddingIsReturnedToWindowsAtOnce(t *testing.T) {
+	c, conn, _ := NewTestConnection(nil)
+	s := NewTestStream(t, c, 1)
+	data := DATA{StreamId: 1, Data: strings.Repeat("a", 40000), Padding: strings.Repeat("\x00", 200)}
+	data.Flags.PADDED = true
+	assert.Nil(t, c.handleFrame(data))
+	empty := DATA{StreamId: 1}
+	empty.Flags.PADDED = true
+	assert.Nil(t, c.handleFrame(empty))
+
+	assert.Equal(t, readAllFrames(t, conn.written), []Frame{
+		WINDOW_UPDATE{0, 201},
+		WINDOW_UPDATE{1, 201},
+		WINDOW_UPDATE{0, 1},
+		WINDOW_UPDATE{1, 1},
+	}, "Padding should not wait for the application to consume it")
+	conn.written = conn.written[0:0]
+
+	assert.Nil(t, c.Consumed(1, 40000))
+	assert.Equal(t, readAllFrames(t, conn.written), []Frame{
+		WINDOW_UPDATE{0, 40000},
+		WINDOW_UPDATE{1, 40000},
+	})
+	assert.Equal(t, c.recvWindow, int64(defaultInitialWindowSize))
+	assert.Equal(t, s.recvWindow, int64(defaultInitialWindowSize))
+}
+
+func TestConsumedDoesNotReplenishFinishedStreams(t *testing.T) {
+	c, conn, _ := NewTestConnection(nil)
+	NewTestStream(t, c, 1)
+	data := DATA{StreamId: 1, Data: strings.Repeat("a", 40000)}
+	data.Flags.END_STREAM = true
+	assert.Nil(t, c.handleFrame(data))
+
+	assert.Nil(t, c.Consumed(1, 40000))
+	assert.Equal(t, readAllFrames(t, conn.written), []Frame{WINDOW_UPDATE{0, 40000}})
+}
+
+func TestFixedIncrementPolicyOnConnection(t *testing.T) {
+	c, conn, _ := NewTestConnection(nil)
+	c.windowPolicy = FixedIncrementPolicy{1000}
+	NewTestStream(t, c, 1)
+	assert.Nil(t, c.handleFrame(DATA{StreamId: 1, Data: strings.Repeat("a", 2500)}))
+
+	assert.Nil(t, c.Consumed(1, 2500))
+	assert.Equal(t, readAllFrames(t, conn.written), []Frame{
+		WINDOW_UPDATE{0, 2000},
+		WINDOW_UPDATE{1, 2000},
+	})
+	assert.Equal(t, c.recvConsumed, int64(500))
+}
+
+func TestManualPolicy(t *testing.T) {
+	c, conn, _ := NewTestConnection(nil)
+	c.windowPolicy = ManualPolicy{}
+	s := NewTestStream(t, c, 1)
+	assert.Nil(t, c.handleFrame(DATA{StreamId: 1, Data: strings.Repeat("a", 60000)}))
+
+	assert.Nil(t, c.Consumed(1, 60000))
+	assert.Equal(t, len(conn.written), 0)
+
+	assert.Nil(t, c.SendWindowUpdate(0, 60000))
+	assert.Nil(t, c.SendWindowUpdate(1, 1000))
+	assert.Equal(t, readAllFrames(t, conn.written), []Frame{
+		WINDOW_UPDATE{0, 60000},
+		WINDOW_UPDATE{1, 1000},
+	})
+	assert.Equal(t, c.recvWindow, int64(defaultInitialWindowSize))
+	assert.Equal(t, s.recvWindow, int64(defaultInitialWindowSize-59000))
+
+	assert.EqualError(t, c.SendWindowUpdate(1, maxWindowSize),
+		"WINDOW_UPDATE would exceed the maximum flow-control window")
+	assert.EqualError(t, c.SendWindowUpdate(3, 1), "Cannot send WINDOW_UPDATE frame on idle stream 3")
+}
+
+func TestEveryPolicyReturnsDataAfterReset(t *testing.T) {
+	for _, policy := range []WindowUpdatePolicy{ThresholdPolicy{0.5}, FixedIncrementPolicy{1000}, ManualPolicy{}} {
+		c, conn, _ := NewTestConnection(nil)
+		c.windowPolicy = policy
+		NewTestStream(t, c, 1)
+		assert.Nil(t, c.resetStream(StreamError{1, CANCEL, "Cancelled"}))
+		conn.written = conn.written[0:0]
+
+		// Enough DATA to exhaust the connection window several times over
+		for i := 0; i < 10; i++ {
+			assert.Nil(t, c.handleFrame(DATA{StreamId: 1, Data: strings.Repeat("a", 16384)}))
+		}
+
+		assert.Equal(t, c.recvWindow, int64(defaultInitialWindowSize), "%T", policy)
+		assert.Equal(t, len(readAllFrames(t, conn.written)), 10, "%T", policy)
+	}
+}
+
+func TestServerWindowUpdatePolicy(t *testing.T) {
+	server, conn := NewTestServer()
+	server.WindowUpdatePolicy = ManualPolicy{}
+	conn.readData = [][]byte{[]byte(preface), SETTINGS{}.Marshal()}
+
+	c, err := server.InitiateConn(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, c.windowPolicy, ManualPolicy{})
+}
@@ -15,20 +15,21 @@ type base struct {
 	Payload  string
 }
 
-// http://tools.ietf.org/html/draft-ietf-httpbis-http2-11#section-6.1
+// http://tools.ietf.org/html/rfc9113#section-6.1
 type DATA struct {
 	StreamId uint32
 	Data     string
 	Padding  string
 
 	Flags struct {
-		END_STREAM  bool // 0x1
-		END_SEGMENT bool // 0x2
-		COMPRESSED  bool // 0x20
+		END_STREAM bool // 0x1
+		// PADDED is set whenever Padding is not empty; on its own it sends
+		// a Pad Length of zero
+		PADDED bool // 0x8
 	}
 }
 
-// http://tools.ietf.org/html/draft-ietf-httpbis-http2-11#section-6.2
+// http://tools.ietf.org/html/rfc9113#section-6.2
 type HEADERS struct {
 	StreamId            uint32
 	Weight              uint8
@@ -37,31 +38,30 @@ type HEADERS struct {
 	Padding             string
 
 	Flags struct {
-		END_STREAM          bool // 0x1
-		END_SEGMENT         bool // 0x2
-		END_HEADERS         bool // 0x4
-		PRIORITY_DEPENDENCY bool // 0x20
-		EXCLUSIVE           bool // First bit of StreamDependency
+		END_STREAM  bool // 0x1
+		END_HEADERS bool // 0x4
+		PRIORITY    bool // 0x20
+		EXCLUSIVE   bool // First bit of StreamDependency
 	}
 }
 
-// http://tools.ietf.org/html/draft-ietf-httpbis-http2-11#section-6.3
+// http://tools.ietf.org/html/rfc9113#section-6.3
 type PRIORITY struct {
 	StreamId         uint32
 	StreamDependency uint32
 	Weight           uint8
 	Flags            struct {
-		PRIORITY_DEPENDENCY bool
-		EXCLUSIVE           bool // First bit of StreamDependency
+		EXCLUSIVE bool // First bit of StreamDependency
 	}
 }
 
-// http://tools.ietf.org/html/draft-ietf-httpbis-http2-11#section-6.4
+// http://tools.ietf.org/html/rfc9113#section-6.4
 type RST_STREAM struct {
 	StreamId  uint32
-	ErrorCode uint32
+	ErrorCode ErrCode
 }
 
+// http://tools.ietf.org/html/rfc9113#section-6.6
 type PUSH_PROMISE struct {
 	StreamId            uint32
 	PromisedStreamId    uint32
@@ -72,19 +72,34 @@ type PUSH_PROMISE struct {
 	}
 }
 
+// http://tools.ietf.org/html/rfc9113#section-11.3
 const (
 	SETTINGS_HEADER_TABLE_SIZE      = 1
 	SETTINGS_ENABLE_PUSH            = 2
 	SETTINGS_MAX_CONCURRENT_STREAMS = 3
 	SETTINGS_INITIAL_WINDOW_SIZE    = 4
+	SETTINGS_MAX_FRAME_SIZE         = 5
+	SETTINGS_MAX_HEADER_LIST_SIZE   = 6
+	// http://tools.ietf.org/html/rfc8441#section-3
+	SETTINGS_ENABLE_CONNECT_PROTOCOL = 8
+	// http://tools.ietf.org/html/rfc9218#section-2.1
+	SETTINGS_NO_RFC7540_PRIORITIES = 9
+)
+
+// Bounds of SETTINGS_MAX_FRAME_SIZE
+// http://tools.ietf.org/html/rfc9113#section-6.5.2
+const (
+	minMaxFrameSize = 1 << 14
+	maxMaxFrameSize = 1<<24 - 1
 )
 
-// http://tools.ietf.org/html/draft-ietf-httpbis-http2-11#page-35
+// http://tools.ietf.org/html/rfc9113#section-6.5.1
 type Parameter struct {
-	Id    uint8
+	Id    uint16
 	Value uint32
 }
 
+// http://tools.ietf.org/html/rfc9113#section-6.5
 type SETTINGS struct {
 	Parameters []Parameter
 	Flags      struct {
@@ -92,7 +107,7 @@ type SETTINGS struct {
 	}
 }
 
-// http://tools.ietf.org/html/draft-ietf-httpbis-http2-11#section-6.7
+// http://tools.ietf.org/html/rfc9113#section-6.7
 type PING struct {
 	OpaqueData uint64
 	Flags      struct {
@@ -100,90 +115,170 @@ type PING struct {
 	}
 }
 
-// http://tools.ietf.org/html/draft-ietf-httpbis-http2-11#section-6.8
+// http://tools.ietf.org/html/rfc9113#section-6.8
 type GOAWAY struct {
 	LastStreamId        uint32
-	ErrorCode           uint32
+	ErrorCode           ErrCode
 	AdditionalDebugData string
 }
 
-// http://tools.ietf.org/html/draft-ietf-httpbis-http2-11#section-6.9
+// http://tools.ietf.org/html/rfc9113#section-6.9
 type WINDOW_UPDATE struct {
 	StreamId            uint32
 	WindowSizeIncrement uint32
 }
 
-// http://tools.ietf.org/html/draft-ietf-httpbis-http2-11#section-6.10
+// http://tools.ietf.org/html/rfc9113#section-6.10
 type CONTINUATION struct {
 	StreamId            uint32
 	HeaderBlockFragment string
-	Padding             string
 	Flags               struct {
 		END_HEADERS bool // 0x4
 	}
 }
 
-// TODO: ALTSVC frame
-
-// http://tools.ietf.org/html/draft-ietf-httpbis-http2-11#section-6.12
-type BLOCKED struct {
-	StreamId uint32
+// PRIORITY_UPDATE is only recognised by the RFC9113 codec.
+// http://tools.ietf.org/html/rfc9218#section-7.1
+type PRIORITY_UPDATE struct {
+	PrioritizedStreamId uint32
+	PriorityFieldValue  string
 }
 
 type Frame interface {
 	Marshal() []byte
 }
 
+// UnknownFrame is a frame of a type that has no decoder, which endpoints
+// must ignore.
+// http://tools.ietf.org/html/rfc9113#section-4.1
+type UnknownFrame struct {
+	Type     uint8
+	Flags    uint8
+	StreamId uint32
+	Payload  string
+}
+
+// ErrCode is the reason a stream or connection was closed, as sent in
+// RST_STREAM and GOAWAY frames.
+// http://tools.ietf.org/html/rfc9113#section-7
+type ErrCode uint32
+
 const (
-	NO_ERROR            = 0
-	PROTOCOL_ERROR      = 1
-	INTERNAL_ERROR      = 2
-	FLOW_CONTROL_ERROR  = 3
-	SETTINGS_TIMEOUT    = 4
-	STREAM_CLOSED       = 5
-	FRAME_SIZE_ERROR    = 6
-	REFUSED_STREAM      = 7
-	CANCEL              = 8
-	COMPRESSION_ERROR   = 9
-	CONNECT_ERROR       = 10
-	ENHANCE_YOUR_CALM   = 11
-	INADEQUATE_SECURITY = 12
+	NO_ERROR            ErrCode = 0
+	PROTOCOL_ERROR      ErrCode = 1
+	INTERNAL_ERROR      ErrCode = 2
+	FLOW_CONTROL_ERROR  ErrCode = 3
+	SETTINGS_TIMEOUT    ErrCode = 4
+	STREAM_CLOSED       ErrCode = 5
+	FRAME_SIZE_ERROR    ErrCode = 6
+	REFUSED_STREAM      ErrCode = 7
+	CANCEL              ErrCode = 8
+	COMPRESSION_ERROR   ErrCode = 9
+	CONNECT_ERROR       ErrCode = 10
+	ENHANCE_YOUR_CALM   ErrCode = 11
+	INADEQUATE_SECURITY ErrCode = 12
+	HTTP_1_1_REQUIRED   ErrCode = 13
 )
 
+var errCodeNames = map[ErrCode]string{
+	NO_ERROR:            "NO_ERROR",
+	PROTOCOL_ERROR:      "PROTOCOL_ERROR",
+	INTERNAL_ERROR:      "INTERNAL_ERROR",
+	FLOW_CONTROL_ERROR:  "FLOW_CONTROL_ERROR",
+	SETTINGS_TIMEOUT:    "SETTINGS_TIMEOUT",
+	STREAM_CLOSED:       "STREAM_CLOSED",
+	FRAME_SIZE_ERROR:    "FRAME_SIZE_ERROR",
+	REFUSED_STREAM:      "REFUSED_STREAM",
+	CANCEL:              "CANCEL",
+	COMPRESSION_ERROR:   "COMPRESSION_ERROR",
+	CONNECT_ERROR:       "CONNECT_ERROR",
+	ENHANCE_YOUR_CALM:   "ENHANCE_YOUR_CALM",
+	INADEQUATE_SECURITY: "INADEQUATE_SECURITY",
+	HTTP_1_1_REQUIRED:   "HTTP_1_1_REQUIRED",
+}
+
+// String names the code.  Unknown codes must not trigger any special
+// behaviour, so they are only shown in hex.
+// http://tools.ietf.org/html/rfc9113#section-7
+func (e ErrCode) String() string {
+	if name, ok := errCodeNames[e]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown error code 0x%x", uint32(e))
+}
+
+// ConnectionError closes the whole connection with GOAWAY.
+// http://tools.ietf.org/html/rfc9113#section-5.4.1
 type ConnectionError struct {
-	Code    uint8
+	Code    ErrCode
 	Message string
 }
 
 func (e ConnectionError) Error() string {
-	return fmt.Sprintf("ConnectionError: %s (%d)", e.Message, e.Code)
+	return fmt.Sprintf("ConnectionError: %s (%s)", e.Message, e.Code)
+}
+
+// StreamError only affects a single stream, which is reset with RST_STREAM
+// rather than tearing down the whole connection.
+// http://tools.ietf.org/html/rfc9113#section-5.4.2
+type StreamError struct {
+	StreamId uint32
+	Code     ErrCode
+	Message  string
+}
+
+func (e StreamError) Error() string {
+	return fmt.Sprintf("StreamError: %s (stream %d, %s)", e.Message, e.StreamId, e.Code)
+}
+
+// BLOCKED is only recognised by the Draft12 codec; it was removed before
+// the final RFC.
+// http://tools.ietf.org/html/draft-ietf-httpbis-http2-12#section-6.12
+type BLOCKED struct {
+	StreamId uint32
 }
 
 func (f base) Marshal() []byte {
-	header := make([]byte, 8)
-	binary.BigEndian.PutUint16(header, uint16(len(f.Payload)))
-	header[2] = f.Type
-	header[3] = f.Flags
-	binary.BigEndian.PutUint32(header[4:8], f.StreamId)
+	return f.marshal(FrameCodec{})
+}
+
+func (f base) marshal(c FrameCodec) []byte {
+	header := make([]byte, c.headerLength())
+	if c.Version == Draft12 {
+		binary.BigEndian.PutUint16(header, uint16(len(f.Payload))&0x3FFF)
+	} else {
+		putUint24(header, uint32(len(f.Payload)))
+	}
+	header[len(header)-6] = f.Type
+	header[len(header)-5] = f.Flags
+	binary.BigEndian.PutUint32(header[len(header)-4:], f.StreamId&0x7FFFFFFF)
 
 	return append(header, f.Payload...)
 }
 
 func (f GOAWAY) Marshal() []byte {
+	return f.marshal(FrameCodec{})
+}
+
+func (f GOAWAY) marshal(c FrameCodec) []byte {
 	b := base{}
 	b.Type = 0x7
 
 	payload := make([]byte, 8+len(f.AdditionalDebugData))
 	binary.BigEndian.PutUint32(payload[0:4], f.LastStreamId)
-	binary.BigEndian.PutUint32(payload[4:8], f.ErrorCode)
+	binary.BigEndian.PutUint32(payload[4:8], uint32(f.ErrorCode))
 	copy(payload[8:], f.AdditionalDebugData)
 
 	b.Payload = string(payload)
 
-	return b.Marshal()
+	return b.marshal(c)
 }
 
 func (f PING) Marshal() []byte {
+	return f.marshal(FrameCodec{})
+}
+
+func (f PING) marshal(c FrameCodec) []byte {
 	b := base{}
 	b.Type = 0x6
 	if f.Flags.ACK {
@@ -194,37 +289,73 @@ func (f PING) Marshal() []byte {
 	binary.BigEndian.PutUint64(payload, f.OpaqueData)
 	b.Payload = string(payload)
 
-	return b.Marshal()
+	return b.marshal(c)
 }
 
-func paddingHeaders(b *base, padding string) []byte {
-	paddingHeaders := make([]byte, 0, 2)
-	paddingLength := uint16(len(padding))
-	if paddingLength > 0 {
-		// set PADDING_LOW flag
-		b.Flags |= 0x08
+// maxPadding is the longest padding the codec's Pad Length field can
+// express.  RFC 9113 has a single octet; Draft12 uses PAD_HIGH and PAD_LOW.
+func (c FrameCodec) maxPadding() int {
+	if c.Version == Draft12 {
+		return 0xFFFF
+	}
+	return 0xFF
+}
 
-		if paddingLength > 256 {
-			// set PADDING_HIGH flag
-			b.Flags |= 0x10
-			paddingHeaders = paddingHeaders[0:2]
-			binary.BigEndian.PutUint16(paddingHeaders, paddingLength)
+// checkPadding returns an error for padding longer than maxPadding, which
+// FrameWriter refuses to write.
+func (c FrameCodec) checkPadding(padding string) error {
+	if len(padding) > c.maxPadding() {
+		return fmt.Errorf("Padding of %d octets exceeds the maximum of %d", len(padding), c.maxPadding())
+	}
 
-		} else {
-			paddingHeaders = paddingHeaders[0:1]
-			paddingHeaders[0] = uint8(paddingLength)
+	return nil
+}
+
+// paddingHeaders sets the padding flags and returns the padding length
+// fields when padding is present.  Padding longer than maxPadding is cut
+// short, so that the Pad Length always matches what is written.
+func paddingHeaders(c FrameCodec, b *base, padding *string) []byte {
+	if len(*padding) == 0 {
+		return []byte{}
+	}
+	if len(*padding) > c.maxPadding() {
+		*padding = (*padding)[0:c.maxPadding()]
+	}
+	n := len(*padding)
+
+	if c.Version == Draft12 {
+		// set PAD_LOW flag
+		b.Flags |= 0x8
+		if n > 0xFF {
+			// set PAD_HIGH flag
+			b.Flags |= 0x10
+			paddingHeaders := make([]byte, 2)
+			binary.BigEndian.PutUint16(paddingHeaders, uint16(n))
+			return paddingHeaders
 		}
+		return []byte{uint8(n)}
 	}
 
-	return paddingHeaders
+	// set PADDED flag
+	b.Flags |= 0x8
+
+	return []byte{uint8(n)}
 }
 
 func (f DATA) Marshal() []byte {
+	return f.marshal(FrameCodec{})
+}
+
+func (f DATA) marshal(c FrameCodec) []byte {
 	b := base{}
 	b.Type = 0x0
 	b.StreamId = f.StreamId
 
-	payload := paddingHeaders(&b, f.Padding)
+	payload := paddingHeaders(c, &b, &f.Padding)
+	if f.Flags.PADDED && len(f.Padding) == 0 {
+		b.Flags |= 0x8
+		payload = []byte{0}
+	}
 	payload = append(payload, f.Data...)
 	payload = append(payload, f.Padding...)
 	b.Payload = string(payload)
@@ -232,34 +363,32 @@ func (f DATA) Marshal() []byte {
 	if f.Flags.END_STREAM {
 		b.Flags |= 0x01
 	}
-	if f.Flags.END_SEGMENT {
-		b.Flags |= 0x02
-	}
-	if f.Flags.COMPRESSED {
-		b.Flags |= 0x20
-	}
 
-	return b.Marshal()
+	return b.marshal(c)
 }
 
 func (f HEADERS) Marshal() []byte {
+	return f.marshal(FrameCodec{})
+}
+
+func (f HEADERS) marshal(c FrameCodec) []byte {
 	b := base{}
 	b.Type = 0x1
 	b.StreamId = f.StreamId
 
 	flagHeaders := make([]byte, 0, 5)
-	if f.Flags.PRIORITY_DEPENDENCY {
+	if f.Flags.PRIORITY {
 		flagHeaders = flagHeaders[0:5]
-		binary.BigEndian.PutUint32(flagHeaders, f.StreamDependency)
+		binary.BigEndian.PutUint32(flagHeaders, f.StreamDependency&0x7FFFFFFF)
 		flagHeaders[4] = f.Weight
 
 		if f.Flags.EXCLUSIVE {
 			flagHeaders[0] |= 0x80
 		}
-		b.Flags |= 0x40
+		b.Flags |= 0x20
 	}
 
-	payload := paddingHeaders(&b, f.Padding)
+	payload := paddingHeaders(c, &b, &f.Padding)
 	payload = append(payload, flagHeaders...)
 	payload = append(payload, f.HeaderBlockFragment...)
 	payload = append(payload, f.Padding...)
@@ -269,57 +398,67 @@ func (f HEADERS) Marshal() []byte {
 	if f.Flags.END_STREAM {
 		b.Flags |= 0x01
 	}
-	if f.Flags.END_SEGMENT {
-		b.Flags |= 0x02
-	}
 	if f.Flags.END_HEADERS {
 		b.Flags |= 0x04
 	}
 
-	return b.Marshal()
+	return b.marshal(c)
 }
 
 func (f PRIORITY) Marshal() []byte {
+	return f.marshal(FrameCodec{})
+}
+
+func (f PRIORITY) marshal(c FrameCodec) []byte {
 	b := base{}
 	b.Type = 0x2
 	b.StreamId = f.StreamId
 
-	var payload []byte
-	if f.Flags.PRIORITY_DEPENDENCY {
-		b.Flags |= 0x40
-		payload = make([]byte, 5)
-		binary.BigEndian.PutUint32(payload, f.StreamDependency)
-		payload[4] = f.Weight
+	payload := make([]byte, 5)
+	binary.BigEndian.PutUint32(payload, f.StreamDependency&0x7FFFFFFF)
+	payload[4] = f.Weight
 
-		if f.Flags.EXCLUSIVE {
-			payload[0] |= 0x80
-		}
+	if f.Flags.EXCLUSIVE {
+		payload[0] |= 0x80
 	}
 	b.Payload = string(payload)
 
-	return b.Marshal()
+	return b.marshal(c)
 }
 
 func (f RST_STREAM) Marshal() []byte {
+	return f.marshal(FrameCodec{})
+}
+
+func (f RST_STREAM) marshal(c FrameCodec) []byte {
 	b := base{}
 	b.Type = 0x3
 	b.StreamId = f.StreamId
 
 	payload := make([]byte, 4)
-	binary.BigEndian.PutUint32(payload, f.ErrorCode)
+	binary.BigEndian.PutUint32(payload, uint32(f.ErrorCode))
 	b.Payload = string(payload)
 
-	return b.Marshal()
+	return b.marshal(c)
 }
 
 func (f SETTINGS) Marshal() []byte {
+	return f.marshal(FrameCodec{})
+}
+
+func (f SETTINGS) marshal(c FrameCodec) []byte {
 	b := base{}
 	b.Type = 0x4
 
-	payload := make([]byte, len(f.Parameters)*5)
+	size := c.settingsParameterLength()
+	payload := make([]byte, len(f.Parameters)*size)
 	for i, parameter := range f.Parameters {
-		payload[i*5] = parameter.Id
-		binary.BigEndian.PutUint32(payload[i*5+1:], parameter.Value)
+		if c.Version == Draft12 {
+			payload[i*size] = uint8(parameter.Id)
+		} else {
+			binary.BigEndian.PutUint16(payload[i*size:], parameter.Id)
+		}
+		binary.BigEndian.PutUint32(payload[i*size+size-4:], parameter.Value)
 	}
 	b.Payload = string(payload)
 
@@ -327,10 +466,14 @@ func (f SETTINGS) Marshal() []byte {
 		b.Flags |= 0x1
 	}
 
-	return b.Marshal()
+	return b.marshal(c)
 }
 
 func (f PUSH_PROMISE) Marshal() []byte {
+	return f.marshal(FrameCodec{})
+}
+
+func (f PUSH_PROMISE) marshal(c FrameCodec) []byte {
 	b := base{}
 	b.Type = 0x5
 	b.StreamId = f.StreamId
@@ -339,18 +482,22 @@ func (f PUSH_PROMISE) Marshal() []byte {
 		b.Flags |= 0x4
 	}
 
-	headers := paddingHeaders(&b, f.Padding)
+	headers := paddingHeaders(c, &b, &f.Padding)
 	payload := make([]byte, 4+len(f.HeaderBlockFragment)+len(f.Padding))
-	binary.BigEndian.PutUint32(payload[0:4], f.PromisedStreamId)
+	binary.BigEndian.PutUint32(payload[0:4], f.PromisedStreamId&0x7FFFFFFF)
 	copy(payload[4:4+len(f.HeaderBlockFragment)], f.HeaderBlockFragment)
 	copy(payload[4+len(f.HeaderBlockFragment):], f.Padding)
 
 	b.Payload = string(append(headers, payload...))
 
-	return b.Marshal()
+	return b.marshal(c)
 }
 
 func (f WINDOW_UPDATE) Marshal() []byte {
+	return f.marshal(FrameCodec{})
+}
+
+func (f WINDOW_UPDATE) marshal(c FrameCodec) []byte {
 	b := base{}
 	b.Type = 0x8
 	b.StreamId = f.StreamId
@@ -360,144 +507,83 @@ func (f WINDOW_UPDATE) Marshal() []byte {
 
 	b.Payload = string(payload)
 
-	return b.Marshal()
+	return b.marshal(c)
 }
 
 func (f CONTINUATION) Marshal() []byte {
+	return f.marshal(FrameCodec{})
+}
+
+func (f CONTINUATION) marshal(c FrameCodec) []byte {
 	b := base{}
 	b.Type = 0x9
 	b.StreamId = f.StreamId
+	b.Payload = f.HeaderBlockFragment
 
 	if f.Flags.END_HEADERS {
 		b.Flags |= 0x4
 	}
 
-	headers := paddingHeaders(&b, f.Padding)
-	payload := make([]byte, len(f.HeaderBlockFragment)+len(f.Padding))
-	copy(payload[0:len(f.HeaderBlockFragment)], f.HeaderBlockFragment)
-	copy(payload[len(f.HeaderBlockFragment):], f.Padding)
+	return b.marshal(c)
+}
 
-	b.Payload = string(append(headers, payload...))
+func (f PRIORITY_UPDATE) Marshal() []byte {
+	return f.marshal(FrameCodec{})
+}
 
-	return b.Marshal()
+func (f PRIORITY_UPDATE) marshal(c FrameCodec) []byte {
+	b := base{}
+	b.Type = 0x10
+
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, f.PrioritizedStreamId&0x7FFFFFFF)
+	b.Payload = string(payload) + f.PriorityFieldValue
+
+	return b.marshal(c)
+}
+
+func (f UnknownFrame) Marshal() []byte {
+	return f.marshal(FrameCodec{})
+}
+
+func (f UnknownFrame) marshal(c FrameCodec) []byte {
+	return base(f).marshal(c)
 }
 
 func (f BLOCKED) Marshal() []byte {
+	return f.marshal(FrameCodec{Version: Draft12})
+}
+
+func (f BLOCKED) marshal(c FrameCodec) []byte {
 	b := base{}
 	b.Type = 0xB
 	b.StreamId = f.StreamId
 
-	return b.Marshal()
+	return b.marshal(c)
 }
 
 func Unmarshal(wire []byte) (advance int, f Frame, err error) {
-	if len(wire) < 8 {
-		// Incomplete header
-		return 0, nil, nil
-	}
-	payloadLen := binary.BigEndian.Uint16([]byte{wire[0] & 0x3F, wire[1]})
-	frameType := wire[2]
-	frameFlags := wire[3]
-	streamId := uint31(string(wire[4:8]))
-
-	if uint16(len(wire)) < payloadLen+8 {
-		// Incomplete payload
-		return 0, nil, nil
-	}
-
-	advance = int(payloadLen + 8)
-	toDecode := string(wire[8:advance])
-
-	switch frameType {
-	case 0x0:
-		if streamId == 0 {
-			return advance, nil, ConnectionError{
-				PROTOCOL_ERROR,
-				"DATA frame must have stream identifier",
-			}
-		}
-		f, err = unmarshalDataPayload(frameFlags, streamId, toDecode)
-	case 0x1:
-		if streamId == 0 {
-			return advance, nil, ConnectionError{
-				PROTOCOL_ERROR,
-				"HEADERS frame must have stream identifier",
-			}
-		}
-		f, err = unmarshalHeadersPayload(frameFlags, streamId, toDecode)
-	case 0x2:
-		if streamId == 0 {
-			return advance, nil, ConnectionError{
-				PROTOCOL_ERROR,
-				"PRIORITY frame must have stream identifier",
-			}
-		}
-		f, err = unmarshalPriorityPayload(frameFlags, streamId, toDecode)
-	case 0x3:
-		if streamId == 0 {
-			return advance, nil, ConnectionError{
-				PROTOCOL_ERROR,
-				"RST_STREAM frame must have stream identifier",
-			}
-		}
-		f, err = unmarshalRstStreamPayload(streamId, toDecode)
-	case 0x4:
-		f, err = unmarshalSettingsPayload(frameFlags, toDecode)
-	case 0x5:
-		if streamId == 0 {
-			return advance, nil, ConnectionError{
-				PROTOCOL_ERROR,
-				"PUSH_PROMISE frame must have stream identifier",
-			}
-		}
-		f, err = unmarshalPushPromisePayload(frameFlags, streamId, toDecode)
-	case 0x6:
-		if streamId != 0 {
-			return advance, nil, ConnectionError{
-				PROTOCOL_ERROR,
-				"PING frame must not have stream identifier",
-			}
-		}
-		if payloadLen != 8 {
-			return advance, nil, ConnectionError{
-				FRAME_SIZE_ERROR,
-				"PING payload must have length of 8",
-			}
-		}
-		f, err = unmarshalPingPayload(frameFlags, toDecode)
-	case 0x7:
-		f, err = unmarshalGoAwayPayload(toDecode)
-	case 0x8:
-		f, err = unmarshalWindowUpdatePayload(streamId, toDecode)
-	case 0x9:
-		if streamId == 0 {
-			return advance, nil, ConnectionError{
-				PROTOCOL_ERROR,
-				"CONTINUATION frame must have stream identifier",
-			}
-		}
-		f, err = unmarshalContinuationPayload(frameFlags, streamId, toDecode)
-	case 0xB:
-		if payloadLen != 0 {
-			return advance, nil, ConnectionError{
-				PROTOCOL_ERROR,
-				"BLOCKED frame must have length of 0",
-			}
-		}
-		f = BLOCKED{StreamId: streamId}
-	}
-
-	if err != nil {
-		return advance, nil, err
-	}
-	return advance, f, nil
+	return FrameCodec{}.Unmarshal(wire)
 }
 
 func flagIsSet(flags uint8, mask uint8) bool {
 	return flags&mask == mask
 }
 
-func unmarshalPingPayload(frameFlags uint8, payload string) (Frame, error) {
+func unmarshalPingPayload(c FrameCodec, frameFlags uint8, streamId uint32, payload string) (Frame, error) {
+	if streamId != 0 {
+		return nil, ConnectionError{
+			PROTOCOL_ERROR,
+			"PING frame must not have stream identifier",
+		}
+	}
+	if len(payload) != 8 {
+		return nil, ConnectionError{
+			FRAME_SIZE_ERROR,
+			"PING payload must have length of 8",
+		}
+	}
+
 	f := PING{}
 	f.OpaqueData = binary.BigEndian.Uint64([]byte(payload))
 	if flagIsSet(frameFlags, 0x1) {
@@ -507,74 +593,126 @@ func unmarshalPingPayload(frameFlags uint8, payload string) (Frame, error) {
 	return f, nil
 }
 
-func decodePaddingLength(frameFlags uint8, payload *string) (uint16, error) {
-	paddingLengthBytes := []byte{0x00, 0x00}
-	if flagIsSet(frameFlags, 0x10) {
-		// padHigh is present
-		paddingLengthBytes[0] = (*payload)[0]
-		*payload = (*payload)[1:]
-		if !flagIsSet(frameFlags, 0x08) {
-			return 0, ConnectionError{PROTOCOL_ERROR, "PAD_HIGH was set but PAD_LOW was not set"}
+// A frame too short to hold one of its fixed-size fields is a
+// FRAME_SIZE_ERROR.
+// http://tools.ietf.org/html/rfc9113#section-4.2
+var errMissingPadLength = ConnectionError{
+	FRAME_SIZE_ERROR,
+	"Padded frame was too short to include the padding length",
+}
+
+func decodePaddingLength(c FrameCodec, frameFlags uint8, payload *string) (int, error) {
+	paddingLength := 0
+
+	if c.Version == Draft12 {
+		paddingLengthBytes := []byte{0x00, 0x00}
+		if flagIsSet(frameFlags, 0x10) {
+			// padHigh is present
+			if !flagIsSet(frameFlags, 0x08) {
+				return 0, ConnectionError{PROTOCOL_ERROR, "PAD_HIGH was set but PAD_LOW was not set"}
+			}
+			if len(*payload) < 1 {
+				return 0, errMissingPadLength
+			}
+			paddingLengthBytes[0] = (*payload)[0]
+			*payload = (*payload)[1:]
 		}
-	}
-	if flagIsSet(frameFlags, 0x08) {
-		// padLow is present
-		paddingLengthBytes[1] = (*payload)[0]
+		if flagIsSet(frameFlags, 0x08) {
+			// padLow is present
+			if len(*payload) < 1 {
+				return 0, errMissingPadLength
+			}
+			paddingLengthBytes[1] = (*payload)[0]
+			*payload = (*payload)[1:]
+		}
+		paddingLength = int(binary.BigEndian.Uint16(paddingLengthBytes))
+	} else if flagIsSet(frameFlags, 0x8) {
+		// PADDED is set, so the Pad Length field is present
+		if len(*payload) < 1 {
+			return 0, errMissingPadLength
+		}
+		paddingLength = int((*payload)[0])
 		*payload = (*payload)[1:]
 	}
-	paddingLength := binary.BigEndian.Uint16(paddingLengthBytes)
 
-	if paddingLength > uint16(len(*payload)) {
+	if paddingLength > len(*payload) {
 		return 0, ConnectionError{PROTOCOL_ERROR, "Padding length exceeded length of payload"}
 	}
 
 	return paddingLength, nil
 }
 
-func unmarshalDataPayload(frameFlags uint8, streamId uint32, payload string) (Frame, error) {
-	// Check flags for pad high/pad low
+func unmarshalDataPayload(c FrameCodec, frameFlags uint8, streamId uint32, payload string) (Frame, error) {
+	if streamId == 0 {
+		return nil, ConnectionError{
+			PROTOCOL_ERROR,
+			"DATA frame must have stream identifier",
+		}
+	}
+	if c.Version == Draft12 && flagIsSet(frameFlags, 0x20) {
+		// We never advertise SETTINGS_COMPRESS_DATA
+		return nil, ConnectionError{
+			PROTOCOL_ERROR,
+			"DATA frame was compressed without SETTINGS_COMPRESS_DATA",
+		}
+	}
 
 	f := DATA{}
 
 	if flagIsSet(frameFlags, 0x1) {
 		f.Flags.END_STREAM = true
 	}
-	if flagIsSet(frameFlags, 0x2) {
-		f.Flags.END_SEGMENT = true
+	if flagIsSet(frameFlags, 0x8) {
+		f.Flags.PADDED = true
 	}
-	if flagIsSet(frameFlags, 0x20) {
-		f.Flags.COMPRESSED = true
-	}
-	paddingLength, err := decodePaddingLength(frameFlags, &payload)
+	paddingLength, err := decodePaddingLength(c, frameFlags, &payload)
 	if err != nil {
 		return nil, err
 	}
 
-	dataLength := uint16(len(payload)) - paddingLength
+	dataLength := len(payload) - paddingLength
 	f.Data = payload[0:dataLength]
-
-	payload = payload[dataLength:]
-	f.Padding = payload[0:paddingLength]
+	f.Padding = payload[dataLength:]
 	f.StreamId = streamId
 
 	return f, nil
 }
 
-func unmarshalGoAwayPayload(payload string) (Frame, error) {
+func unmarshalGoAwayPayload(c FrameCodec, frameFlags uint8, streamId uint32, payload string) (Frame, error) {
+	if streamId != 0 {
+		return nil, ConnectionError{
+			PROTOCOL_ERROR,
+			"GOAWAY frame must not have stream identifier",
+		}
+	}
+	if len(payload) < 8 {
+		return nil, ConnectionError{
+			FRAME_SIZE_ERROR,
+			"GOAWAY payload must have length of at least 8",
+		}
+	}
+
 	lastStreamId := uint31(payload[0:4])
 
 	return GOAWAY{
 		LastStreamId:        lastStreamId,
-		ErrorCode:           binary.BigEndian.Uint32([]byte(payload[4:8])),
+		ErrorCode:           ErrCode(binary.BigEndian.Uint32([]byte(payload[4:8]))),
 		AdditionalDebugData: payload[8:],
 	}, nil
 }
 
-func unmarshalHeadersPayload(frameFlags uint8, streamId uint32, payload string) (Frame, error) {
+func unmarshalHeadersPayload(c FrameCodec, frameFlags uint8, streamId uint32, payload string) (Frame, error) {
+	if streamId == 0 {
+		return nil, ConnectionError{
+			PROTOCOL_ERROR,
+			"HEADERS frame must have stream identifier",
+		}
+	}
+
 	f := HEADERS{}
 	f.StreamId = streamId
 
-	paddingLength, err := decodePaddingLength(frameFlags, &payload)
+	paddingLength, err := decodePaddingLength(c, frameFlags, &payload)
 	if err != nil {
 		return nil, err
 	}
@@ -582,24 +720,30 @@ func unmarshalHeadersPayload(frameFlags uint8, streamId uint32, payload string)
 	if flagIsSet(frameFlags, 0x1) {
 		f.Flags.END_STREAM = true
 	}
-	if flagIsSet(frameFlags, 0x2) {
-		f.Flags.END_SEGMENT = true
-	}
 	if flagIsSet(frameFlags, 0x4) {
 		f.Flags.END_HEADERS = true
 	}
-	if flagIsSet(frameFlags, 0x40) {
-		// Priority dependency fields are present
+	if flagIsSet(frameFlags, 0x20) {
+		// Priority fields are present
+		if len(payload) < 5 {
+			return nil, ConnectionError{
+				FRAME_SIZE_ERROR,
+				"HEADERS frame was too short to include priority fields",
+			}
+		}
 		f.StreamDependency = uint31(payload[0:4])
 		f.Weight = payload[4]
-		f.Flags.PRIORITY_DEPENDENCY = true
+		f.Flags.PRIORITY = true
 		if flagIsSet(payload[0], 0x80) {
 			f.Flags.EXCLUSIVE = true
 		}
 		payload = payload[5:]
+		if paddingLength > len(payload) {
+			return nil, ConnectionError{PROTOCOL_ERROR, "Padding length exceeded length of payload"}
+		}
 	}
 
-	payloadLength := uint16(len(payload)) - paddingLength
+	payloadLength := len(payload) - paddingLength
 
 	f.HeaderBlockFragment = payload[0:payloadLength]
 	f.Padding = payload[payloadLength:]
@@ -607,30 +751,62 @@ func unmarshalHeadersPayload(frameFlags uint8, streamId uint32, payload string)
 	return f, nil
 }
 
-func unmarshalPriorityPayload(frameFlags uint8, streamId uint32, payload string) (Frame, error) {
-	f := PRIORITY{}
-	f.StreamId = streamId
+func unmarshalPriorityPayload(c FrameCodec, frameFlags uint8, streamId uint32, payload string) (Frame, error) {
+	if streamId == 0 {
+		return nil, ConnectionError{
+			PROTOCOL_ERROR,
+			"PRIORITY frame must have stream identifier",
+		}
+	}
 
-	if flagIsSet(frameFlags, 0x40) {
-		f.Flags.PRIORITY_DEPENDENCY = true
-		f.StreamDependency = uint31(payload[0:4])
-		f.Weight = uint8(payload[4])
-		if flagIsSet(payload[0], 0x80) {
-			f.Flags.EXCLUSIVE = true
+	if len(payload) != 5 {
+		return nil, ConnectionError{
+			FRAME_SIZE_ERROR,
+			"PRIORITY payload must have length of 5",
 		}
 	}
+
+	f := PRIORITY{}
+	f.StreamId = streamId
+	f.StreamDependency = uint31(payload[0:4])
+	f.Weight = uint8(payload[4])
+	if flagIsSet(payload[0], 0x80) {
+		f.Flags.EXCLUSIVE = true
+	}
+
 	return f, nil
 }
 
-func unmarshalRstStreamPayload(streamId uint32, payload string) (Frame, error) {
+func unmarshalRstStreamPayload(c FrameCodec, frameFlags uint8, streamId uint32, payload string) (Frame, error) {
+	if streamId == 0 {
+		return nil, ConnectionError{
+			PROTOCOL_ERROR,
+			"RST_STREAM frame must have stream identifier",
+		}
+	}
+
+	if len(payload) != 4 {
+		return nil, ConnectionError{
+			FRAME_SIZE_ERROR,
+			"RST_STREAM payload must have length of 4",
+		}
+	}
+
 	f := RST_STREAM{}
 	f.StreamId = streamId
-	f.ErrorCode = binary.BigEndian.Uint32([]byte(payload))
+	f.ErrorCode = ErrCode(binary.BigEndian.Uint32([]byte(payload)))
 
 	return f, nil
 }
 
-func unmarshalSettingsPayload(frameFlags uint8, payload string) (Frame, error) {
+func unmarshalSettingsPayload(c FrameCodec, frameFlags uint8, streamId uint32, payload string) (Frame, error) {
+	if streamId != 0 {
+		return nil, ConnectionError{
+			PROTOCOL_ERROR,
+			"SETTINGS frame must not have stream identifier",
+		}
+	}
+
 	f := SETTINGS{}
 	if flagIsSet(frameFlags, 0x1) {
 		f.Flags.ACK = true
@@ -642,52 +818,110 @@ func unmarshalSettingsPayload(frameFlags uint8, payload string) (Frame, error) {
 		}
 	}
 
+	size := c.settingsParameterLength()
 	for len(payload) > 0 {
-		if len(payload) < 5 {
+		if len(payload) < size {
 			return nil, ConnectionError{
 				FRAME_SIZE_ERROR,
 				"Improperly constructed Settings frame",
 			}
 		}
-		id := payload[0]
-		if id == 0 || id > 4 {
-			return nil, ConnectionError{
+		var id uint16
+		if c.Version == Draft12 {
+			id = uint16(payload[0])
+		} else {
+			id = binary.BigEndian.Uint16([]byte(payload[0:2]))
+		}
+		parameter := Parameter{id, binary.BigEndian.Uint32([]byte(payload[size-4 : size]))}
+		if err := c.validateSetting(parameter); err != nil {
+			return nil, err
+		}
+		f.Parameters = append(f.Parameters, parameter)
+		payload = payload[size:]
+	}
+
+	return f, nil
+}
+
+// validateSetting checks the value of a setting that the codec's Version
+// defines.  Settings it does not define, including reserved values sent to
+// exercise this, are passed through to be ignored.
+// http://tools.ietf.org/html/rfc9113#section-6.5.2
+func (c FrameCodec) validateSetting(p Parameter) error {
+	switch {
+	case p.Id == SETTINGS_ENABLE_PUSH,
+		p.Id == SETTINGS_ENABLE_CONNECT_PROTOCOL && c.Version != Draft12,
+		p.Id == SETTINGS_NO_RFC7540_PRIORITIES && c.Version != Draft12:
+		if p.Value > 1 {
+			return ConnectionError{
 				PROTOCOL_ERROR,
-				fmt.Sprintf("Settings frame specified invalid identifier: %d", id),
+				fmt.Sprintf("Setting %d must be 0 or 1, was %d", p.Id, p.Value),
+			}
+		}
+	case p.Id == SETTINGS_INITIAL_WINDOW_SIZE:
+		if p.Value > 1<<31-1 {
+			return ConnectionError{
+				FLOW_CONTROL_ERROR,
+				fmt.Sprintf("SETTINGS_INITIAL_WINDOW_SIZE of %d exceeded the maximum flow-control window", p.Value),
+			}
+		}
+	case p.Id == SETTINGS_MAX_FRAME_SIZE && c.Version != Draft12:
+		if p.Value < minMaxFrameSize || p.Value > maxMaxFrameSize {
+			return ConnectionError{
+				PROTOCOL_ERROR,
+				fmt.Sprintf("SETTINGS_MAX_FRAME_SIZE of %d was outside the allowed range", p.Value),
 			}
 		}
-		f.Parameters = append(f.Parameters, Parameter{
-			id,
-			binary.BigEndian.Uint32([]byte(payload[1:5])),
-		})
-		payload = payload[5:]
 	}
 
-	return f, nil
+	return nil
 }
 
-func unmarshalPushPromisePayload(frameFlags uint8, streamId uint32, payload string) (Frame, error) {
+func unmarshalPushPromisePayload(c FrameCodec, frameFlags uint8, streamId uint32, payload string) (Frame, error) {
+	if streamId == 0 {
+		return nil, ConnectionError{
+			PROTOCOL_ERROR,
+			"PUSH_PROMISE frame must have stream identifier",
+		}
+	}
+
 	f := PUSH_PROMISE{}
 	f.StreamId = streamId
 	if flagIsSet(frameFlags, 0x4) {
 		f.Flags.END_HEADERS = true
 	}
 
-	paddingLength, err := decodePaddingLength(frameFlags, &payload)
+	paddingLength, err := decodePaddingLength(c, frameFlags, &payload)
 	if err != nil {
 		return nil, err
 	}
 
+	if len(payload) < 4 {
+		return nil, ConnectionError{
+			FRAME_SIZE_ERROR,
+			"PUSH_PROMISE frame was too short to include promised stream identifier",
+		}
+	}
 	f.PromisedStreamId = uint31(payload[0:4])
 	payload = payload[4:]
-	headerBlockLength := uint16(len(payload)) - paddingLength
+	if paddingLength > len(payload) {
+		return nil, ConnectionError{PROTOCOL_ERROR, "Padding length exceeded length of payload"}
+	}
+	headerBlockLength := len(payload) - paddingLength
 	f.HeaderBlockFragment = payload[0:headerBlockLength]
 	f.Padding = payload[headerBlockLength:]
 
 	return f, nil
 }
 
-func unmarshalWindowUpdatePayload(streamId uint32, payload string) (Frame, error) {
+func unmarshalWindowUpdatePayload(c FrameCodec, frameFlags uint8, streamId uint32, payload string) (Frame, error) {
+	if len(payload) != 4 {
+		return nil, ConnectionError{
+			FRAME_SIZE_ERROR,
+			"WINDOW_UPDATE payload must have length of 4",
+		}
+	}
+
 	f := WINDOW_UPDATE{}
 	f.StreamId = streamId
 	f.WindowSizeIncrement = uint31(payload)
@@ -695,25 +929,72 @@ func unmarshalWindowUpdatePayload(streamId uint32, payload string) (Frame, error
 	return f, nil
 }
 
-func unmarshalContinuationPayload(frameFlags uint8, streamId uint32, payload string) (Frame, error) {
+func unmarshalContinuationPayload(c FrameCodec, frameFlags uint8, streamId uint32, payload string) (Frame, error) {
+	if streamId == 0 {
+		return nil, ConnectionError{
+			PROTOCOL_ERROR,
+			"CONTINUATION frame must have stream identifier",
+		}
+	}
+
 	f := CONTINUATION{}
 	f.StreamId = streamId
 	if flagIsSet(frameFlags, 0x4) {
 		f.Flags.END_HEADERS = true
 	}
 
-	paddingLength, err := decodePaddingLength(frameFlags, &payload)
-	if err != nil {
-		return nil, err
+	if c.Version == Draft12 {
+		// Draft CONTINUATION frames may be padded; the padding is discarded
+		paddingLength, err := decodePaddingLength(c, frameFlags, &payload)
+		if err != nil {
+			return nil, err
+		}
+		payload = payload[0 : len(payload)-paddingLength]
 	}
+	f.HeaderBlockFragment = payload
 
-	headerBlockLength := uint16(len(payload)) - paddingLength
-	f.HeaderBlockFragment = payload[0:headerBlockLength]
-	f.Padding = payload[headerBlockLength:]
+	return f, nil
+}
+
+func unmarshalPriorityUpdatePayload(c FrameCodec, frameFlags uint8, streamId uint32, payload string) (Frame, error) {
+	if streamId != 0 {
+		return nil, ConnectionError{
+			PROTOCOL_ERROR,
+			"PRIORITY_UPDATE frame must not have stream identifier",
+		}
+	}
+	if len(payload) < 4 {
+		return nil, ConnectionError{
+			FRAME_SIZE_ERROR,
+			"PRIORITY_UPDATE payload must have length of at least 4",
+		}
+	}
+
+	f := PRIORITY_UPDATE{
+		PrioritizedStreamId: uint31(payload[0:4]),
+		PriorityFieldValue:  payload[4:],
+	}
+	if f.PrioritizedStreamId == 0 {
+		return nil, ConnectionError{
+			PROTOCOL_ERROR,
+			"PRIORITY_UPDATE frame must have prioritized stream identifier",
+		}
+	}
 
 	return f, nil
 }
 
+func unmarshalBlockedPayload(c FrameCodec, frameFlags uint8, streamId uint32, payload string) (Frame, error) {
+	if len(payload) != 0 {
+		return nil, ConnectionError{
+			PROTOCOL_ERROR,
+			"BLOCKED frame must have length of 0",
+		}
+	}
+
+	return BLOCKED{StreamId: streamId}, nil
+}
+
 func uint31(payload string) uint32 {
 	return binary.BigEndian.Uint32([]byte{
 		payload[0] & 0x7F,
@@ -722,3 +1003,13 @@ func uint31(payload string) uint32 {
 		payload[3],
 	})
 }
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v >> 16)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v)
+}
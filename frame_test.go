@@ -2,7 +2,9 @@ package main
 
 import (
 	"encoding/binary"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"strings"
 	"testing"
 )
 
@@ -11,21 +13,41 @@ type stringWrapper struct {
 }
 
 func frameType(marshalled []byte) uint8 {
-	return uint8(marshalled[2])
+	return uint8(marshalled[3])
 }
 
-func frameLength(marshalled []byte) uint16 {
-	return binary.BigEndian.Uint16(marshalled[0:2]) & 0x7F
+func frameLength(marshalled []byte) uint32 {
+	return uint32(marshalled[0])<<16 | uint32(marshalled[1])<<8 | uint32(marshalled[2])
 }
 
 func frameFlags(marshalled []byte) uint8 {
-	return uint8(marshalled[3])
+	return uint8(marshalled[4])
+}
+
+func TestErrCodeString(t *testing.T) {
+	assert.Equal(t, NO_ERROR.String(), "NO_ERROR")
+	assert.Equal(t, HTTP_1_1_REQUIRED.String(), "HTTP_1_1_REQUIRED")
+	assert.Equal(t, ErrCode(0xbadcafe).String(), "unknown error code 0xbadcafe")
+}
+
+func TestErrorMessagesNameTheirCode(t *testing.T) {
+	assert.Equal(t, ConnectionError{FLOW_CONTROL_ERROR, "Window overflowed"}.Error(),
+		"ConnectionError: Window overflowed (FLOW_CONTROL_ERROR)")
+	assert.Equal(t, StreamError{3, CANCEL, "Cancelled"}.Error(),
+		"StreamError: Cancelled (stream 3, CANCEL)")
+}
+
+func TestUnmarshalKeepsUnknownErrorCodes(t *testing.T) {
+	_, f, err := Unmarshal(RST_STREAM{1, 0xFFFFFFFF}.Marshal())
+
+	assert.Nil(t, err)
+	assert.Equal(t, f.(RST_STREAM).ErrorCode, ErrCode(0xFFFFFFFF))
 }
 
 func TestMarshalEmptyFrame(t *testing.T) {
 	f := base{}
 
-	assert.Equal(t, frameLength(f.Marshal()), uint16(0),
+	assert.Equal(t, frameLength(f.Marshal()), uint32(0),
 		"Length should have been nothing")
 }
 
@@ -36,16 +58,27 @@ func TestMarshalFrame_WithPayloadIncludesLength(t *testing.T) {
 	marshalled := f.Marshal()
 
 	assert.Equal(t, frameLength(marshalled),
-		uint16(len("this is the payload of the frame")),
+		uint32(len("this is the payload of the frame")),
 		"Length field in header should have been the length of payload")
 }
 
+func TestMarshalFrame_WithLargePayloadUses24BitLength(t *testing.T) {
+	f := base{}
+	f.Payload = strings.Repeat("a", 70000)
+
+	marshalled := f.Marshal()
+
+	assert.Equal(t, frameLength(marshalled), uint32(70000),
+		"Length field should have been able to represent more than 16 bits")
+	assert.Equal(t, len(marshalled), 9+70000)
+}
+
 func TestMarshalFrame_WithType(t *testing.T) {
 	f := base{}
 	f.Type = uint8(8)
 
 	assert.Equal(t, uint8(8), frameType(f.Marshal()),
-		"Type should have been marshalled as the third octet")
+		"Type should have been marshalled as the fourth octet")
 }
 
 func TestMarshalFrame_WithFlags(t *testing.T) {
@@ -53,7 +86,7 @@ func TestMarshalFrame_WithFlags(t *testing.T) {
 	f.Flags = uint8(0xD)
 
 	assert.Equal(t, uint8(0xD), frameFlags(f.Marshal()),
-		"Flags should have been marshalled as the fourth octet")
+		"Flags should have been marshalled as the fifth octet")
 }
 
 func TestMarshalFrame_WithStreamId(t *testing.T) {
@@ -62,10 +95,10 @@ func TestMarshalFrame_WithStreamId(t *testing.T) {
 
 	marshalled := f.Marshal()
 
-	stream_identifier := binary.BigEndian.Uint32(marshalled[4:8]) & uint32(0x7FFFFFFF)
+	stream_identifier := binary.BigEndian.Uint32(marshalled[5:9]) & uint32(0x7FFFFFFF)
 
 	assert.Equal(t, stream_identifier, f.StreamId,
-		"Stream identifier should have been marshalled as fifth through eighth octets")
+		"Stream identifier should have been marshalled as sixth through ninth octets")
 }
 
 func TestMarshalGOAWAY(t *testing.T) {
@@ -79,10 +112,10 @@ func TestMarshalGOAWAY(t *testing.T) {
 		"Type should have been marshalled as 0x7")
 	assert.Equal(t, frameFlags(marshalled), uint8(0),
 		"Should have set no flags")
-	assert.Equal(t, frameLength(marshalled), uint16(8+len(f.AdditionalDebugData)),
+	assert.Equal(t, frameLength(marshalled), uint32(8+len(f.AdditionalDebugData)),
 		"Length should have been 8 octets")
 
-	lastStreamId := binary.BigEndian.Uint32(marshalled[8:12])
+	lastStreamId := binary.BigEndian.Uint32(marshalled[9:13])
 	assert.Equal(t, lastStreamId, f.LastStreamId,
 		"Marshalled frame should have included last stream id")
 }
@@ -94,7 +127,7 @@ func TestMarshalGOAWAY_WithDebugInfoSetsLength(t *testing.T) {
 	expectedLength := len(f.AdditionalDebugData) + 8
 
 	assert.Equal(t, frameLength(f.Marshal()),
-		uint16(expectedLength),
+		uint32(expectedLength),
 		"Length should included the additional debug data")
 }
 
@@ -109,7 +142,7 @@ func TestMarshalWINDOW_UPDATE(t *testing.T) {
 		"Type should have been marshalled as 0x8")
 	assert.Equal(t, frameFlags(marshalled), uint8(0),
 		"Should have set no flags")
-	assert.Equal(t, frameLength(marshalled), uint16(4),
+	assert.Equal(t, frameLength(marshalled), uint32(4),
 		"Length should have been 4 octets")
 }
 
@@ -121,11 +154,11 @@ func TestMarshalPING(t *testing.T) {
 	assert.Equal(t, frameType(marshalled), uint8(6),
 		"Ping frame must have had a type of 0x6")
 
-	opaqueData := binary.BigEndian.Uint64(marshalled[8:16])
+	opaqueData := binary.BigEndian.Uint64(marshalled[9:17])
 	assert.Equal(t, opaqueData, f.OpaqueData,
 		"Ping frame should have included opaque data")
 
-	assert.Equal(t, frameLength(marshalled), uint8(8),
+	assert.Equal(t, frameLength(marshalled), uint32(8),
 		"Ping frame must have had a length field value of 8")
 }
 
@@ -157,14 +190,12 @@ func TestMarshalDATA_WithoutPadding(t *testing.T) {
 
 	assert.Equal(t, frameType(marshalled), uint8(0x0),
 		"Data frame should have type 0x0")
-	assert.Equal(t, frameLength(marshalled), uint16(len(f.Data)))
+	assert.Equal(t, frameLength(marshalled), uint32(len(f.Data)))
 
 	assert.Equal(t, frameFlags(marshalled)&0x08, byte(0),
-		"Padding low flag should not have been set")
-	assert.Equal(t, frameFlags(marshalled)&0x10, byte(0),
-		"Padding high flag should not have been set")
+		"Padded flag should not have been set")
 
-	assert.Equal(t, []byte(f.Data), marshalled[8:], "Data did not match")
+	assert.Equal(t, []byte(f.Data), marshalled[9:], "Data did not match")
 }
 
 func TestMarshalDATA_WithEndStreamFlag(t *testing.T) {
@@ -176,67 +207,37 @@ func TestMarshalDATA_WithEndStreamFlag(t *testing.T) {
 		"Data frame should have end stream flag set")
 }
 
-func TestMarshalDATA_WithEndSegmentFlag(t *testing.T) {
-	f := DATA{}
-	f.Flags.END_SEGMENT = true
-
-	marshalled := f.Marshal()
-	assert.Equal(t, frameFlags(marshalled)&0x2, uint8(0x2),
-		"Data frame should have end segment flag set")
-}
-
-func TestMarshalDATA_WithCompressedFlag(t *testing.T) {
-	f := DATA{}
-	f.Flags.COMPRESSED = true
-
-	marshalled := f.Marshal()
-	assert.Equal(t, frameFlags(marshalled)&0x20, uint8(0x20),
-		"Data frame should have compressed flag set")
-}
-
 func TestMarshalDATA_WithSmallAmountOfPadding(t *testing.T) {
 	f := DATA{}
 	f.Data = "This is the data associated with the frame"
 	f.Padding = "This padding is less than 256 bytes"
 
 	marshalled := f.Marshal()
-	expectedLength := uint16(len(f.Data) + len(f.Padding) + 1)
+	expectedLength := uint32(len(f.Data) + len(f.Padding) + 1)
 
 	assert.Equal(t, frameLength(marshalled), expectedLength,
-		"Length did not include the data, the padding, and the padding header fields")
+		"Length did not include the data, the padding, and the pad length field")
 
 	assert.Equal(t, frameFlags(marshalled)&0x08, byte(0x08),
-		"Padding low flag should have been set")
-	assert.Equal(t, marshalled[8], uint8(len(f.Padding)),
-		"Padding low should have been the length of the padding")
-	assert.Equal(t, marshalled[9:9+len(f.Data)], []byte(f.Data),
+		"Padded flag should have been set")
+	assert.Equal(t, marshalled[9], uint8(len(f.Padding)),
+		"Pad length should have been the length of the padding")
+	assert.Equal(t, marshalled[10:10+len(f.Data)], []byte(f.Data),
 		"Data did not match")
-	assert.Equal(t, marshalled[9+len(f.Data):], []byte(f.Padding),
+	assert.Equal(t, marshalled[10+len(f.Data):], []byte(f.Padding),
 		"Padding did not match")
 }
 
-func TestMarshalDATA_WithPaddingHighSet(t *testing.T) {
+func TestMarshalDATA_WithPaddingLongerThanPadLength(t *testing.T) {
 	f := DATA{}
 	f.Data = "This is the data associated with the data frame"
-
-	paddingLength := 310
-	for i := 0; i < paddingLength; i++ {
-		f.Padding += "a"
-	}
+	f.Padding = strings.Repeat("a", 310)
 
 	marshalled := f.Marshal()
 
-	assert.Equal(t, frameFlags(marshalled)&0x08, byte(0x08),
-		"Padding low flag should have been set")
-	assert.Equal(t, frameFlags(marshalled)&0x10, byte(0x10),
-		"Padding high flag should have been set")
-
-	assert.Equal(t, binary.BigEndian.Uint16(marshalled[8:10]),
-		uint16(len(f.Padding)),
-		"Padding length should have been equal to length of padding")
-	assert.Equal(t, marshalled[10:10+len(f.Data)], []byte(f.Data),
-		"Data did not match")
-	assert.Equal(t, marshalled[10+len(f.Data):], []byte(f.Padding),
+	assert.Equal(t, marshalled[9], uint8(255),
+		"Pad length should have matched the padding written")
+	assert.Equal(t, marshalled[10+len(f.Data):], []byte(f.Padding[0:255]),
 		"Padding did not match")
 }
 
@@ -250,34 +251,34 @@ func TestMarshalHEADERS(t *testing.T) {
 		"Type of HEADERS frame should have been 0x01")
 
 	assert.Equal(t,
-		marshalled[8:],
+		marshalled[9:],
 		[]byte("accept-encoding:gzip"))
 }
 
-func TestMarshalHEADERS_WithPriorityDependency(t *testing.T) {
+func TestMarshalHEADERS_WithPriority(t *testing.T) {
 	f := HEADERS{}
 	f.StreamDependency = 39781097
 	f.Weight = 21
-	f.Flags.PRIORITY_DEPENDENCY = true
+	f.Flags.PRIORITY = true
 	f.Flags.EXCLUSIVE = true
 	f.HeaderBlockFragment = "accept-encoding:gzip"
 
 	marshalled := f.Marshal()
 
-	assert.Equal(t, frameFlags(marshalled)&0x40, byte(0x40),
-		"Flag for PRIORITY_DEPENDENCY should have been set")
+	assert.Equal(t, frameFlags(marshalled)&0x20, byte(0x20),
+		"Flag for PRIORITY should have been set")
 
-	assert.Equal(t, marshalled[8]&0x80, byte(0x80),
-		"E bit for PRIORITY_DEPENDENCY should have been set")
+	assert.Equal(t, marshalled[9]&0x80, byte(0x80),
+		"E bit for PRIORITY should have been set")
 
 	assert.Equal(t,
-		binary.BigEndian.Uint32(marshalled[8:12])^0x80000000,
+		binary.BigEndian.Uint32(marshalled[9:13])^0x80000000,
 		f.StreamDependency,
 		"Stream dependency did not match")
 
-	assert.Equal(t, marshalled[12], f.Weight, "Weight did not match")
+	assert.Equal(t, marshalled[13], f.Weight, "Weight did not match")
 	assert.Equal(t,
-		marshalled[13:],
+		marshalled[14:],
 		[]byte("accept-encoding:gzip"))
 }
 
@@ -288,46 +289,39 @@ func TestMarshalHEADERS_WithSmallAmountOfPadding(t *testing.T) {
 
 	marshalled := f.Marshal()
 
-	assert.Equal(t,
-		marshalled[8],
-		byte(len(f.Padding)))
-
 	assert.Equal(t, frameFlags(marshalled)&0x08, byte(0x08),
-		"Padding low flag should have been set")
-	assert.Equal(t, marshalled[8], byte(len(f.Padding)),
-		"Padding low length should have been set")
-	assert.Equal(t, marshalled[9:9+len(f.HeaderBlockFragment)],
+		"Padded flag should have been set")
+	assert.Equal(t, marshalled[9], byte(len(f.Padding)),
+		"Pad length should have been set")
+	assert.Equal(t, marshalled[10:10+len(f.HeaderBlockFragment)],
 		[]byte(f.HeaderBlockFragment),
 		"Header block fragment should have matched")
-	assert.Equal(t, marshalled[9+len(f.HeaderBlockFragment):],
+	assert.Equal(t, marshalled[10+len(f.HeaderBlockFragment):],
 		[]byte(f.Padding),
 		"Padding should have matched")
 }
 
-func TestMarshalHEADERS_WithPaddingHighSet(t *testing.T) {
+func TestMarshalHEADERS_WithPaddingAndPriority(t *testing.T) {
 	f := HEADERS{}
 	f.HeaderBlockFragment = "content-type:application/json"
-
-	paddingLength := 371
-	for i := 0; i < paddingLength; i++ {
-		f.Padding += "b"
-	}
+	f.Padding = "padding"
+	f.StreamDependency = 3
+	f.Weight = 200
+	f.Flags.PRIORITY = true
 
 	marshalled := f.Marshal()
 
-	assert.Equal(t, binary.BigEndian.Uint16(marshalled[8:10]),
-		uint16(len(f.Padding)),
-		"Padding length should have been equal to length of padding")
-
-	assert.Equal(t, frameFlags(marshalled)&0x08, byte(0x08),
-		"Padding low flag should have been set")
-	assert.Equal(t, frameFlags(marshalled)&0x10, byte(0x10),
-		"Padding high flag should have been set")
-
-	assert.Equal(t, marshalled[10:10+len(f.HeaderBlockFragment)],
+	assert.Equal(t, frameFlags(marshalled)&0x28, byte(0x28),
+		"Padded and priority flags should have been set")
+	assert.Equal(t, marshalled[9], byte(len(f.Padding)),
+		"Pad length should have come first")
+	assert.Equal(t, binary.BigEndian.Uint32(marshalled[10:14]), f.StreamDependency,
+		"Stream dependency should have followed the pad length")
+	assert.Equal(t, marshalled[14], f.Weight, "Weight did not match")
+	assert.Equal(t, marshalled[15:15+len(f.HeaderBlockFragment)],
 		[]byte(f.HeaderBlockFragment),
 		"Header block fragment should have matched")
-	assert.Equal(t, marshalled[10+len(f.HeaderBlockFragment):],
+	assert.Equal(t, marshalled[15+len(f.HeaderBlockFragment):],
 		[]byte(f.Padding),
 		"Padding should have matched")
 }
@@ -341,15 +335,6 @@ func TestMarshalHEADERS_WithEndStreamFlag(t *testing.T) {
 		"Headers frame should have end stream flag set")
 }
 
-func TestMarshalHEADERS_WithEndSegmentFlag(t *testing.T) {
-	f := HEADERS{}
-	f.Flags.END_SEGMENT = true
-
-	marshalled := f.Marshal()
-	assert.Equal(t, frameFlags(marshalled)&0x2, uint8(0x2),
-		"Headers frame should have end segment flag set")
-}
-
 func TestMarshalHEADERS_WithEndHeadersFlag(t *testing.T) {
 	f := HEADERS{}
 	f.Flags.END_HEADERS = true
@@ -359,26 +344,28 @@ func TestMarshalHEADERS_WithEndHeadersFlag(t *testing.T) {
 		"Headers frame should have end headers flag set")
 }
 
-func TestMarshalPRIORITY_WithPriorityDependency(t *testing.T) {
+func TestMarshalPRIORITY(t *testing.T) {
 	f := PRIORITY{}
-	f.Flags.PRIORITY_DEPENDENCY = true
 	f.StreamId = 1111
 	f.StreamDependency = 123456
+	f.Weight = 31
 
 	marshalled := f.Marshal()
 	assert.Equal(t, frameType(marshalled), uint8(0x2),
 		"Expected frame type of priority to be 0x2")
-	assert.Equal(t, frameFlags(marshalled)&0x40, uint8(0x40),
-		"Headers frame should have had priority group set")
-	assert.Equal(t, binary.BigEndian.Uint32(marshalled[4:8]), f.StreamId,
-		"Stream identifier was not correct in the payload")
-	assert.Equal(t, binary.BigEndian.Uint32(marshalled[8:12]), f.StreamDependency,
+	assert.Equal(t, frameFlags(marshalled), uint8(0),
+		"Priority frame defines no flags")
+	assert.Equal(t, frameLength(marshalled), uint32(5),
+		"Priority frame payload should always be 5 octets")
+	assert.Equal(t, binary.BigEndian.Uint32(marshalled[5:9]), f.StreamId,
+		"Stream identifier was not correct in the header")
+	assert.Equal(t, binary.BigEndian.Uint32(marshalled[9:13]), f.StreamDependency,
 		"Stream dependency was not correct in the payload")
+	assert.Equal(t, marshalled[13], f.Weight, "Weight did not match")
 }
 
-func TestMarshalPRIORITY_WithExclusivePriorityDependency(t *testing.T) {
+func TestMarshalPRIORITY_WithExclusiveDependency(t *testing.T) {
 	f := PRIORITY{}
-	f.Flags.PRIORITY_DEPENDENCY = true
 	f.StreamDependency = 123456
 	f.Weight = 31
 	f.Flags.EXCLUSIVE = true
@@ -386,18 +373,30 @@ func TestMarshalPRIORITY_WithExclusivePriorityDependency(t *testing.T) {
 	marshalled := f.Marshal()
 	assert.Equal(t, frameType(marshalled), uint8(0x2),
 		"Expected frame type of priority to be 0x2")
-	assert.Equal(t, frameFlags(marshalled)&0x40, uint8(0x40),
-		"Headers frame should have had priority group set")
 
 	dependency := binary.BigEndian.Uint32([]byte{
-		marshalled[8] & 0x7F,
-		marshalled[9],
+		marshalled[9] & 0x7F,
 		marshalled[10],
 		marshalled[11],
+		marshalled[12],
 	})
 	assert.Equal(t, dependency, f.StreamDependency,
 		"Stream dependency was not correct in the payload")
-	assert.Equal(t, marshalled[8]&0x80, uint8(0x80))
+	assert.Equal(t, marshalled[9]&0x80, uint8(0x80))
+}
+
+func TestMarshalPRIORITY_UPDATE(t *testing.T) {
+	f := PRIORITY_UPDATE{PrioritizedStreamId: 123456, PriorityFieldValue: "u=1, i"}
+
+	marshalled := f.Marshal()
+	assert.Equal(t, frameType(marshalled), uint8(0x10),
+		"Expected frame type of priority update to be 0x10")
+	assert.Equal(t, frameLength(marshalled), uint32(10))
+	assert.Equal(t, binary.BigEndian.Uint32(marshalled[5:9]), uint32(0),
+		"PRIORITY_UPDATE is always sent on stream 0")
+	assert.Equal(t, binary.BigEndian.Uint32(marshalled[9:13]), f.PrioritizedStreamId,
+		"Prioritized stream identifier was not correct in the payload")
+	assert.Equal(t, string(marshalled[13:]), f.PriorityFieldValue)
 }
 
 func TestMarshalRST_STREAM(t *testing.T) {
@@ -409,36 +408,36 @@ func TestMarshalRST_STREAM(t *testing.T) {
 
 	assert.Equal(t, frameType(marshalled), uint8(0x3),
 		"Expected frame type of settings to be 0x3")
-	assert.Equal(t, frameLength(marshalled), uint16(4),
+	assert.Equal(t, frameLength(marshalled), uint32(4),
 		"Expected frame length to be 4 octets")
-	assert.Equal(t, binary.BigEndian.Uint32(marshalled[4:8]), f.StreamId,
+	assert.Equal(t, binary.BigEndian.Uint32(marshalled[5:9]), f.StreamId,
 		"Expected stream identifier to match")
-	assert.Equal(t, binary.BigEndian.Uint32(marshalled[8:12]), f.ErrorCode,
+	assert.Equal(t, ErrCode(binary.BigEndian.Uint32(marshalled[9:13])), f.ErrorCode,
 		"Expected error code to match")
 }
 
 func TestMarshalSETTINGS(t *testing.T) {
 	f := SETTINGS{}
-	f.Parameters = []Parameter{{uint8(1), uint32(1298431729)},
-		{uint8(2), uint32(1478921795)}}
+	f.Parameters = []Parameter{{uint16(1), uint32(1298431729)},
+		{uint16(2), uint32(1478921795)}}
 
 	marshalled := f.Marshal()
 
 	assert.Equal(t, frameType(marshalled), uint8(0x4),
 		"Expected frame type of settings to be 0x4")
-	assert.Equal(t, frameLength(marshalled), uint16(10),
-		"Expected frame length to be 10 octets (two parameters)")
+	assert.Equal(t, frameLength(marshalled), uint32(12),
+		"Expected frame length to be 12 octets (two parameters)")
 
-	assert.Equal(t, marshalled[8],
-		f.Parameters[0].Id,
+	assert.Equal(t, binary.BigEndian.Uint16(marshalled[9:11]),
+		uint16(f.Parameters[0].Id),
 		"Expected first frame parameter to match")
-	assert.Equal(t, binary.BigEndian.Uint32(marshalled[9:13]),
+	assert.Equal(t, binary.BigEndian.Uint32(marshalled[11:15]),
 		f.Parameters[0].Value,
 		"Expected first frame value to match")
-	assert.Equal(t, marshalled[13],
-		f.Parameters[1].Id,
+	assert.Equal(t, binary.BigEndian.Uint16(marshalled[15:17]),
+		uint16(f.Parameters[1].Id),
 		"Expected second frame parameter to match")
-	assert.Equal(t, binary.BigEndian.Uint32(marshalled[14:18]),
+	assert.Equal(t, binary.BigEndian.Uint32(marshalled[17:21]),
 		f.Parameters[1].Value,
 		"Expected second frame value to match")
 }
@@ -465,14 +464,13 @@ func TestMarshalPUSH_PROMISE(t *testing.T) {
 	assert.Equal(t, frameType(marshalled), uint8(0x5),
 		"Expected frame type for push promise frame to be 0x5")
 	assert.Equal(t, frameFlags(marshalled)&0x8, uint8(0x8),
-		"PAD_LOW flag should have been set")
-	assert.Equal(t, frameFlags(marshalled)&0x10, uint8(0x0),
-		"PAD_HIGH flag should not have been set")
-	assert.Equal(t, marshalled[8], uint8(len(f.Padding)))
-	assert.Equal(t, binary.BigEndian.Uint32(marshalled[9:13]), f.PromisedStreamId)
-	assert.Equal(t, string(marshalled[13:13+len(f.HeaderBlockFragment)]), f.HeaderBlockFragment)
-	assert.Equal(t, string(marshalled[13+len(f.HeaderBlockFragment):]), f.Padding)
+		"PADDED flag should have been set")
+	assert.Equal(t, marshalled[9], uint8(len(f.Padding)))
+	assert.Equal(t, binary.BigEndian.Uint32(marshalled[10:14]), f.PromisedStreamId)
+	assert.Equal(t, string(marshalled[14:14+len(f.HeaderBlockFragment)]), f.HeaderBlockFragment)
+	assert.Equal(t, string(marshalled[14+len(f.HeaderBlockFragment):]), f.Padding)
 }
+
 func TestMarshalPUSH_PROMISE_WithEndHeadersFlag(t *testing.T) {
 	f := PUSH_PROMISE{}
 	f.StreamId = 123
@@ -487,19 +485,15 @@ func TestMarshalCONTINUATION(t *testing.T) {
 	f := CONTINUATION{}
 	f.StreamId = 123
 	f.HeaderBlockFragment = "fragment of header block"
-	f.Padding = "aaaaaaaaaaaaa"
 
 	marshalled := f.Marshal()
 
 	assert.Equal(t, frameType(marshalled), uint8(0x9),
 		"Expected frame type for continuation frame to be 0x9")
-	assert.Equal(t, frameFlags(marshalled)&0x8, uint8(0x8),
-		"PAD_LOW flag should have been set")
-	assert.Equal(t, frameFlags(marshalled)&0x10, uint8(0x0),
-		"PAD_HIGH flag should not have been set")
-	assert.Equal(t, marshalled[8], uint8(len(f.Padding)))
-	assert.Equal(t, string(marshalled[9:9+len(f.HeaderBlockFragment)]), f.HeaderBlockFragment)
-	assert.Equal(t, string(marshalled[9+len(f.HeaderBlockFragment):]), f.Padding)
+	assert.Equal(t, frameFlags(marshalled), uint8(0x0),
+		"Continuation frame cannot be padded")
+	assert.Equal(t, frameLength(marshalled), uint32(len(f.HeaderBlockFragment)))
+	assert.Equal(t, string(marshalled[9:]), f.HeaderBlockFragment)
 }
 
 func TestMarshalCONTINUATION_WithEndHeadersFlag(t *testing.T) {
@@ -513,25 +507,13 @@ func TestMarshalCONTINUATION_WithEndHeadersFlag(t *testing.T) {
 		"END_HEADERS flag should have been set")
 }
 
-func TestMarshalBLOCKED(t *testing.T) {
-	f := BLOCKED{}
-	f.StreamId = 123
-
-	marshalled := f.Marshal()
-
-	assert.Equal(t, frameType(marshalled), uint8(0xB),
-		"Expected frame type for blocked frame to be 0xB")
-	assert.Equal(t, frameLength(marshalled), uint8(0),
-		"Expected frame length for blocked frame to be 0")
-	assert.Equal(t, binary.BigEndian.Uint32(marshalled[4:8]), f.StreamId)
-}
-
 func TestUnmarshalDATA_WithSmallPadding(t *testing.T) {
 	f := DATA{
 		StreamId: 37,
 		Data:     "This is the data associated with the data frame",
 		Padding:  "This padding is less than 256 bytes",
 	}
+	f.Flags.PADDED = true
 	b := f.Marshal()
 	advance, uf, err := Unmarshal(b)
 
@@ -547,10 +529,8 @@ func TestUnmarshalDATA_WithLargePadding(t *testing.T) {
 		Data:     "This is the data associated with the data frame",
 		Padding:  "",
 	}
-	paddingLength := 310
-	for i := 0; i < paddingLength; i++ {
-		f.Padding += string(0x00)
-	}
+	f.Padding = strings.Repeat("\x00", 255)
+	f.Flags.PADDED = true
 
 	b := f.Marshal()
 	_, uf, err := Unmarshal(b)
@@ -572,28 +552,20 @@ func TestUnmarshalDATA_WithEndStream(t *testing.T) {
 	assert.True(t, uf.(DATA).Flags.END_STREAM)
 }
 
-func TestUnmarshalDATA_WithEndSegment(t *testing.T) {
-	f := DATA{StreamId: 123}
-	f.Flags.END_SEGMENT = true
-
+func TestUnmarshalDATA_WithEmptyPadding(t *testing.T) {
+	f := DATA{StreamId: 123, Data: "data"}
 	b := f.Marshal()
-	_, uf, err := Unmarshal(b)
-
-	assert.Nil(t, err)
-	assert.IsType(t, DATA{}, uf)
-	assert.True(t, uf.(DATA).Flags.END_SEGMENT)
-}
+	b = append(b[0:9], append([]byte{0x00}, b[9:]...)...)
+	b[2] += 1
+	b[4] |= 0x8
 
-func TestUnmarshalDATA_WithCompressed(t *testing.T) {
-	f := DATA{StreamId: 123}
-	f.Flags.COMPRESSED = true
-
-	b := f.Marshal()
 	_, uf, err := Unmarshal(b)
 
+	f.Flags.PADDED = true
 	assert.Nil(t, err)
-	assert.IsType(t, DATA{}, uf)
-	assert.True(t, uf.(DATA).Flags.COMPRESSED)
+	assert.Equal(t, uf, f)
+	assert.Equal(t, uf.Marshal(), b, "A Pad Length of zero should have been kept")
+	assert.Equal(t, flowControlledLength(uf.(DATA)), int64(5))
 }
 
 func assertUnmarshalError(t *testing.T, b []byte, expectedError error) {
@@ -603,6 +575,39 @@ func assertUnmarshalError(t *testing.T, b []byte, expectedError error) {
 	assert.Equal(t, err, expectedError)
 }
 
+func TestUnmarshalTruncatedPayloads(t *testing.T) {
+	padded, priority := uint8(0x8), uint8(0x20)
+	truncated := []struct {
+		f   base
+		err ConnectionError
+	}{
+		{base{0x0, padded, 1, ""}, errMissingPadLength},
+		{base{0x1, padded, 1, ""}, errMissingPadLength},
+		{base{0x1, priority, 1, "\x00\x00\x00"}, ConnectionError{FRAME_SIZE_ERROR, "HEADERS frame was too short to include priority fields"}},
+		{base{0x1, padded | priority, 1, "\x02\x00\x00\x00\x01\x10"}, ConnectionError{PROTOCOL_ERROR, "Padding length exceeded length of payload"}},
+		{base{0x2, 0, 1, "\x00\x00\x00\x01"}, ConnectionError{FRAME_SIZE_ERROR, "PRIORITY payload must have length of 5"}},
+		{base{0x3, 0, 1, "\x00"}, ConnectionError{FRAME_SIZE_ERROR, "RST_STREAM payload must have length of 4"}},
+		{base{0x5, 0, 1, "\x00\x00"}, ConnectionError{FRAME_SIZE_ERROR, "PUSH_PROMISE frame was too short to include promised stream identifier"}},
+		{base{0x5, padded, 1, "\x02\x00\x00\x00\x02\x00"}, ConnectionError{PROTOCOL_ERROR, "Padding length exceeded length of payload"}},
+		{base{0x7, 0, 0, "\x00\x00\x00\x01\x00\x00"}, ConnectionError{FRAME_SIZE_ERROR, "GOAWAY payload must have length of at least 8"}},
+		{base{0x7, 0, 1, "\x00\x00\x00\x01\x00\x00\x00\x00"}, ConnectionError{PROTOCOL_ERROR, "GOAWAY frame must not have stream identifier"}},
+		{base{0x8, 0, 1, "\x00\x00\x01"}, ConnectionError{FRAME_SIZE_ERROR, "WINDOW_UPDATE payload must have length of 4"}},
+	}
+
+	for _, tc := range truncated {
+		assertUnmarshalError(t, tc.f.Marshal(), tc.err)
+	}
+}
+
+func TestDraft12UnmarshalWithoutPaddingLength(t *testing.T) {
+	f := base{Type: 0x0, Flags: 0x18, StreamId: 1, Payload: "\x01"}
+
+	_, uf, err := draft12.Unmarshal(f.marshal(draft12))
+
+	assert.Nil(t, uf)
+	assert.Equal(t, err, errMissingPadLength)
+}
+
 func TestUnmarshalDATA_NoStreamId(t *testing.T) {
 	f := DATA{}
 	f.StreamId = 0
@@ -610,12 +615,12 @@ func TestUnmarshalDATA_NoStreamId(t *testing.T) {
 	assertUnmarshalError(t, f.Marshal(), ConnectionError{PROTOCOL_ERROR, "DATA frame must have stream identifier"})
 }
 
-func TestUnmarshalDATA_IncompatiblePaddingFlags(t *testing.T) {
+func TestUnmarshalDATA_PaddingExceedsPayload(t *testing.T) {
 	f := DATA{StreamId: 123, Data: "dagljkjagldka"}
 	b := f.Marshal()
-	b[3] = 0x10
+	b[4] = 0x8
 
-	assertUnmarshalError(t, b, ConnectionError{PROTOCOL_ERROR, "PAD_HIGH was set but PAD_LOW was not set"})
+	assertUnmarshalError(t, b, ConnectionError{PROTOCOL_ERROR, "Padding length exceeded length of payload"})
 }
 
 func TestUnmarshalPING(t *testing.T) {
@@ -648,7 +653,7 @@ func TestUnmarshalPING_WithStreamId(t *testing.T) {
 	f.OpaqueData = 2198179
 
 	b := f.Marshal()
-	b[4] = 10
+	b[8] = 10
 	assertUnmarshalError(t, b, ConnectionError{PROTOCOL_ERROR, "PING frame must not have stream identifier"})
 }
 
@@ -656,7 +661,7 @@ func TestUnmarshalPING_WithBadLength(t *testing.T) {
 	f := PING{}
 	f.OpaqueData = 2198179
 	b := f.Marshal()
-	b[1] = 7
+	b[2] = 7
 
 	assertUnmarshalError(t, b, ConnectionError{FRAME_SIZE_ERROR, "PING payload must have length of 8"})
 }
@@ -690,12 +695,12 @@ func TestUnmarshalHEADERS(t *testing.T) {
 	assert.Equal(t, f, uf)
 }
 
-func TestUnmarshalHEADERS_WithPriorityDependency(t *testing.T) {
+func TestUnmarshalHEADERS_WithPriority(t *testing.T) {
 	f := HEADERS{}
 	f.StreamId = 2139480
 	f.StreamDependency = 39781097
 	f.Weight = 5
-	f.Flags.PRIORITY_DEPENDENCY = true
+	f.Flags.PRIORITY = true
 	f.Flags.EXCLUSIVE = true
 	f.HeaderBlockFragment = "accept-encoding:gzip"
 
@@ -707,6 +712,24 @@ func TestUnmarshalHEADERS_WithPriorityDependency(t *testing.T) {
 	assert.Equal(t, f, uf)
 }
 
+func TestUnmarshalHEADERS_WithPaddingAndPriority(t *testing.T) {
+	f := HEADERS{}
+	f.StreamId = 3
+	f.StreamDependency = 1
+	f.Weight = 15
+	f.Flags.PRIORITY = true
+	f.Flags.END_STREAM = true
+	f.Flags.END_HEADERS = true
+	f.HeaderBlockFragment = "accept-encoding:gzip"
+	f.Padding = "\x00\x00\x00\x00"
+
+	b := f.Marshal()
+	_, uf, err := Unmarshal(b)
+
+	assert.Nil(t, err)
+	assert.Equal(t, f, uf)
+}
+
 func TestUnmarshalHEADERS_WithNoStreamId(t *testing.T) {
 	f := HEADERS{}
 
@@ -715,12 +738,11 @@ func TestUnmarshalHEADERS_WithNoStreamId(t *testing.T) {
 	assertUnmarshalError(t, b, ConnectionError{PROTOCOL_ERROR, "HEADERS frame must have stream identifier"})
 }
 
-func TestUnmarshalPRIORITY_WithExclusivePriorityDependency(t *testing.T) {
+func TestUnmarshalPRIORITY_WithExclusiveDependency(t *testing.T) {
 	f := PRIORITY{}
 	f.StreamId = 111
 	f.StreamDependency = 123
 	f.Weight = 5
-	f.Flags.PRIORITY_DEPENDENCY = true
 	f.Flags.EXCLUSIVE = true
 
 	b := f.Marshal()
@@ -738,6 +760,34 @@ func TestUnmarshalPRIORITY_WithNoStreamId(t *testing.T) {
 	assertUnmarshalError(t, b, ConnectionError{PROTOCOL_ERROR, "PRIORITY frame must have stream identifier"})
 }
 
+func TestUnmarshalPRIORITY_UPDATE(t *testing.T) {
+	f := PRIORITY_UPDATE{PrioritizedStreamId: 5, PriorityFieldValue: "u=0"}
+
+	_, uf, err := Unmarshal(f.Marshal())
+
+	assert.Nil(t, err)
+	assert.Equal(t, f, uf)
+}
+
+func TestUnmarshalPRIORITY_UPDATE_WithStreamId(t *testing.T) {
+	b := PRIORITY_UPDATE{PrioritizedStreamId: 5}.Marshal()
+	b[8] = 1
+
+	assertUnmarshalError(t, b, ConnectionError{PROTOCOL_ERROR, "PRIORITY_UPDATE frame must not have stream identifier"})
+}
+
+func TestUnmarshalPRIORITY_UPDATE_WithNoPrioritizedStreamId(t *testing.T) {
+	f := PRIORITY_UPDATE{PriorityFieldValue: "u=0"}
+
+	assertUnmarshalError(t, f.Marshal(), ConnectionError{PROTOCOL_ERROR, "PRIORITY_UPDATE frame must have prioritized stream identifier"})
+}
+
+func TestUnmarshalPRIORITY_UPDATE_WithShortPayload(t *testing.T) {
+	b := []byte{0, 0, 2, 0x10, 0, 0, 0, 0, 0, 0, 1}
+
+	assertUnmarshalError(t, b, ConnectionError{FRAME_SIZE_ERROR, "PRIORITY_UPDATE payload must have length of at least 4"})
+}
+
 func TestUnmarshalRST_STREAM(t *testing.T) {
 	f := RST_STREAM{}
 	f.ErrorCode = 12390
@@ -784,11 +834,82 @@ func TestUnmarshalSETTINGS_WithAck(t *testing.T) {
 	assert.Equal(t, f, uf)
 }
 
-func TestUnmarshalSETTINGS_WithInvalidId(t *testing.T) {
+func TestUnmarshalSETTINGS_PassesThroughUnknownIds(t *testing.T) {
+	f := SETTINGS{}
+	// 0x0a0a is reserved for exercising the handling of unknown settings
+	f.Parameters = []Parameter{{0, 1}, {15, 512}, {0x0a0a, 3}}
+
+	_, uf, err := Unmarshal(f.Marshal())
+
+	assert.Nil(t, err)
+	assert.Equal(t, f, uf)
+}
+
+func TestUnmarshalSETTINGS_WithRegisteredSettings(t *testing.T) {
 	f := SETTINGS{}
-	f.Parameters = []Parameter{{15, 512}}
+	f.Parameters = []Parameter{
+		{SETTINGS_MAX_FRAME_SIZE, maxMaxFrameSize},
+		{SETTINGS_MAX_HEADER_LIST_SIZE, 1 << 20},
+		{SETTINGS_ENABLE_CONNECT_PROTOCOL, 1},
+	}
+
+	_, uf, err := Unmarshal(f.Marshal())
 
-	assertUnmarshalError(t, f.Marshal(), ConnectionError{PROTOCOL_ERROR, "Settings frame specified invalid identifier: 15"})
+	assert.Nil(t, err)
+	assert.Equal(t, f, uf)
+}
+
+func TestUnmarshalSETTINGS_WithInvalidEnablePush(t *testing.T) {
+	f := SETTINGS{}
+	f.Parameters = []Parameter{{SETTINGS_ENABLE_PUSH, 2}}
+
+	assertUnmarshalError(t, f.Marshal(), ConnectionError{PROTOCOL_ERROR, "Setting 2 must be 0 or 1, was 2"})
+}
+
+func TestUnmarshalSETTINGS_WithInvalidInitialWindowSize(t *testing.T) {
+	f := SETTINGS{}
+	f.Parameters = []Parameter{{SETTINGS_INITIAL_WINDOW_SIZE, 1 << 31}}
+
+	assertUnmarshalError(t, f.Marshal(), ConnectionError{
+		FLOW_CONTROL_ERROR,
+		"SETTINGS_INITIAL_WINDOW_SIZE of 2147483648 exceeded the maximum flow-control window",
+	})
+}
+
+func TestUnmarshalSETTINGS_WithInvalidMaxFrameSize(t *testing.T) {
+	for _, size := range []uint32{minMaxFrameSize - 1, maxMaxFrameSize + 1} {
+		f := SETTINGS{}
+		f.Parameters = []Parameter{{SETTINGS_MAX_FRAME_SIZE, size}}
+
+		assertUnmarshalError(t, f.Marshal(), ConnectionError{
+			PROTOCOL_ERROR,
+			fmt.Sprintf("SETTINGS_MAX_FRAME_SIZE of %d was outside the allowed range", size),
+		})
+	}
+}
+
+func TestUnmarshalSETTINGS_WithNoRFC7540Priorities(t *testing.T) {
+	f := SETTINGS{}
+	f.Parameters = []Parameter{{SETTINGS_NO_RFC7540_PRIORITIES, 1}}
+
+	_, uf, err := Unmarshal(f.Marshal())
+
+	assert.Nil(t, err)
+	assert.Equal(t, f, uf)
+}
+
+func TestUnmarshalSETTINGS_WithInvalidNoRFC7540Priorities(t *testing.T) {
+	f := SETTINGS{}
+	f.Parameters = []Parameter{{SETTINGS_NO_RFC7540_PRIORITIES, 2}}
+
+	assertUnmarshalError(t, f.Marshal(), ConnectionError{PROTOCOL_ERROR, "Setting 9 must be 0 or 1, was 2"})
+}
+
+func TestUnmarshalSETTINGS_WithStreamId(t *testing.T) {
+	b := SETTINGS{Parameters: []Parameter{{SETTINGS_ENABLE_PUSH, 0}}}.Marshal()
+	b[8] = 1
+
+	assertUnmarshalError(t, b, ConnectionError{PROTOCOL_ERROR, "SETTINGS frame must not have stream identifier"})
 }
 
 func TestUnmarshalSETTINGS_WithAckAndPayload(t *testing.T) {
@@ -838,7 +959,6 @@ func TestUnmarshalCONTINUATION(t *testing.T) {
 	f := CONTINUATION{}
 	f.StreamId = 123
 	f.HeaderBlockFragment = "fragment of header block"
-	f.Padding = "aaaaaaaaaaaaa"
 	f.Flags.END_HEADERS = true
 
 	b := f.Marshal()
@@ -855,18 +975,6 @@ func TestUnmarshalCONTINUATION_NoStreamId(t *testing.T) {
 	assertUnmarshalError(t, f.Marshal(), ConnectionError{PROTOCOL_ERROR, "CONTINUATION frame must have stream identifier"})
 }
 
-func TestUnmarshalBLOCKED(t *testing.T) {
-	f := BLOCKED{}
-	f.StreamId = 1234
-
-	b := f.Marshal()
-	_, uf, err := Unmarshal(b)
-
-	assert.Nil(t, err)
-	assert.IsType(t, BLOCKED{}, uf)
-	assert.Equal(t, f, uf)
-}
-
 func TestUnmarshalIncompleteHeader(t *testing.T) {
 	f := PING{}
 	f.OpaqueData = 2198179
@@ -882,7 +990,7 @@ func TestUnmarshalIncompletePayload(t *testing.T) {
 	f := PING{}
 	f.OpaqueData = 2198179
 
-	b := f.Marshal()[0:11]
+	b := f.Marshal()[0:12]
 	_, uf, err := Unmarshal(b)
 
 	assert.Nil(t, err)
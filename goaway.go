@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// shutdownPingData identifies the PING sent between the two GOAWAY frames of
+// a graceful shutdown.
+const shutdownPingData = 0x474F415741592D50 // "GOAWAY-P"
+
+var ErrServerClosed = errors.New("Server is shutting down")
+
+// Close closes the connection immediately, without a GOAWAY frame.
+func (c *Connection) Close() error {
+	c.closeWithError(nil)
+	return nil
+}
+
+// Shutdown gracefully closes the connection.  A first GOAWAY tells the peer
+// to stop opening streams without refusing any already on their way; after
+// a PING round trip a second GOAWAY gives the last stream that will be
+// processed.  Streams in progress may then finish until ctx expires, when
+// the connection is closed regardless.  Serve must be running for the PING
+// acknowledgement to be seen.
+// http://tools.ietf.org/html/rfc9113#section-6.8
+func (c *Connection) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	if c.closed || c.goingAway {
+		c.mu.Unlock()
+		return ErrConnectionClosed
+	}
+	c.goingAway = true
+	c.goAwayStreamId = maxStreamId
+	c.mu.Unlock()
+
+	if err := c.writeFrame(GOAWAY{maxStreamId, NO_ERROR, ""}); err != nil {
+		c.closeWithError(err)
+		return err
+	}
+	if err := c.writeFrame(PING{OpaqueData: shutdownPingData}); err != nil {
+		c.closeWithError(err)
+		return err
+	}
+
+	select {
+	case <-c.shutdownPingAck:
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		c.Close()
+		return ctx.Err()
+	}
+
+	// The acknowledgement set goAwayStreamId to the last stream opened
+	// before it arrived
+	c.mu.Lock()
+	lastStreamId := c.goAwayStreamId
+	c.mu.Unlock()
+
+	if err := c.writeFrame(GOAWAY{lastStreamId, NO_ERROR, ""}); err != nil {
+		c.closeWithError(err)
+		return err
+	}
+
+	for c.activeStreams() > 0 {
+		select {
+		case <-c.streamClosed:
+		case <-c.done:
+			return nil
+		case <-ctx.Done():
+			c.Close()
+			return ctx.Err()
+		}
+	}
+
+	return c.Close()
+}
+
+// activeStreams counts the streams that have not yet closed.
+func (c *Connection) activeStreams() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for _, s := range c.streams.streams {
+		if s.state != StreamIdle {
+			n++
+		}
+	}
+
+	return n
+}
+
+// refusedAfterGoAway is true for frames on streams that the peer opened
+// after the last stream identifier we sent in a GOAWAY, which are ignored.
+func (c *Connection) refusedAfterGoAway(streamId uint32) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, tracked := c.streams.streams[streamId]
+	return c.goingAway && !tracked && !c.streams.isLocal(streamId) && streamId > c.goAwayStreamId
+}
+
+// ignoreData discards DATA on a refused stream, returning its length to the
+// connection flow-control window at once.
+// http://tools.ietf.org/html/rfc9113#section-6.9
+func (c *Connection) ignoreData(f DATA) error {
+	n := flowControlledLength(f)
+
+	c.mu.Lock()
+	if n > c.recvWindow {
+		c.mu.Unlock()
+		return ConnectionError{
+			FLOW_CONTROL_ERROR,
+			"DATA frame exceeded the connection flow-control window",
+		}
+	}
+	c.recvWindow -= n
+	c.mu.Unlock()
+
+	return c.discardData(n)
+}
+
+// Shutdown stops the server accepting connections and gracefully shuts
+// down those it has, returning once they have all closed or ctx expires.
+// The first error from any connection is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shuttingDown = true
+	conns := []*Connection{}
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	errs := make(chan error, len(conns))
+	for _, c := range conns {
+		go func(c *Connection) {
+			errs <- c.Shutdown(ctx)
+		}(c)
+	}
+
+	// Connections that closed by themselves in the meantime have not
+	// failed
+	var err error
+	for range conns {
+		if e := <-errs; e != nil && e != ErrConnectionClosed && err == nil {
+			err = e
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// waitForFrames polls until at least n frames have been written.
+func waitForFrames(t *testing.T, conn *MockConn, n int) []Frame {
+	for i := 0; i < 1000; i++ {
+		if frames := conn.writtenFrames(t); len(frames) >= n {
+			return frames
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("%d frames were never written", n)
+	return nil
+}
+
+func TestShutdownSendsTwoGoAways(t *testing.T) {
+	c, conn, _ := NewTestConnection(nil)
+	NewTestStream(t, c, 1)
+
+	result := make(chan error)
+	go func() {
+		result <- c.Shutdown(context.Background())
+	}()
+
+	assert.Equal(t, waitForFrames(t, conn, 2), []Frame{
+		GOAWAY{maxStreamId, NO_ERROR, ""},
+		PING{OpaqueData: shutdownPingData},
+	})
+
+	assert.Nil(t, c.handleFrame(headersFrame(3, false)),
+		"Streams opened before the PING round trip should be accepted")
+	assert.Nil(t, c.handleFrame(pingAck(shutdownPingData)))
+	assert.Equal(t, waitForFrames(t, conn, 3)[2], GOAWAY{3, NO_ERROR, ""})
+
+	assert.Nil(t, c.handleFrame(headersFrame(5, false)))
+	assert.Nil(t, c.handleFrame(DATA{StreamId: 5, Data: "ignored"}))
+	_, tracked := c.streams.get(5)
+	assert.False(t, tracked, "Streams after the final GOAWAY should have been ignored")
+
+	assert.Nil(t, c.handleFrame(RST_STREAM{1, CANCEL}))
+	assert.False(t, conn.isClosed(), "Stream 3 is still in progress")
+	assert.Nil(t, c.handleFrame(RST_STREAM{3, CANCEL}))
+
+	assert.Nil(t, <-result)
+	assert.True(t, conn.isClosed())
+}
+
+func TestShutdownClosesWhenContextExpires(t *testing.T) {
+	c, conn, _ := NewTestConnection(nil)
+	NewTestStream(t, c, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() {
+		result <- c.Shutdown(ctx)
+	}()
+
+	waitForFrames(t, conn, 2)
+	assert.Nil(t, c.handleFrame(pingAck(shutdownPingData)))
+	waitForFrames(t, conn, 3)
+	cancel()
+
+	assert.Equal(t, <-result, context.Canceled)
+	assert.True(t, conn.isClosed())
+}
+
+func TestServerShutdown(t *testing.T) {
+	server, conn := NewTestServer()
+	conn.readData = [][]byte{[]byte(preface), SETTINGS{}.Marshal()}
+	c, err := server.InitiateConn(conn)
+	assert.Nil(t, err)
+
+	result := make(chan error)
+	go func() {
+		result <- server.Shutdown(context.Background())
+	}()
+
+	waitForFrames(t, conn, 3)
+	assert.Nil(t, c.handleFrame(pingAck(shutdownPingData)))
+
+	assert.Nil(t, <-result)
+	assert.True(t, conn.isClosed())
+	assert.Equal(t, len(server.conns), 0)
+
+	conn = NewMockConn()
+	conn.readData = [][]byte{[]byte(preface), SETTINGS{}.Marshal()}
+	_, err = server.InitiateConn(conn)
+	assert.Equal(t, err, ErrServerClosed)
+	assert.True(t, conn.isClosed())
+}
+
+func TestServerShutdownReturnsConnectionErrors(t *testing.T) {
+	server, conn := NewTestServer()
+	conn.readData = [][]byte{[]byte(preface), SETTINGS{}.Marshal()}
+	_, err := server.InitiateConn(conn)
+	assert.Nil(t, err)
+	conn.writeErr = errors.New("broken pipe")
+
+	assert.Equal(t, server.Shutdown(context.Background()), errors.New("broken pipe"))
+	assert.True(t, conn.isClosed(), "The connection that failed should have been closed")
+	assert.Equal(t, len(server.conns), 0)
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// http://tools.ietf.org/html/rfc7541
+
+// HeaderField is a single name-value pair of a header list.  Sensitive
+// fields are never added to a dynamic table.
+type HeaderField struct {
+	Name      string
+	Value     string
+	Sensitive bool
+}
+
+// http://tools.ietf.org/html/rfc7541#section-4.1
+func (f HeaderField) size() uint32 {
+	return uint32(len(f.Name) + len(f.Value) + 32)
+}
+
+const defaultHeaderTableSize = 4096
+
+// http://tools.ietf.org/html/rfc7541#section-2.3.2
+type dynamicTable struct {
+	// entries are ordered oldest first, so index 1 is the last entry
+	entries []HeaderField
+	size    uint32
+	maxSize uint32
+}
+
+func (t *dynamicTable) add(f HeaderField) {
+	t.entries = append(t.entries, f)
+	t.size += f.size()
+	t.evict()
+}
+
+func (t *dynamicTable) setMaxSize(maxSize uint32) {
+	t.maxSize = maxSize
+	t.evict()
+}
+
+// http://tools.ietf.org/html/rfc7541#section-4.4
+func (t *dynamicTable) evict() {
+	n := 0
+	for t.size > t.maxSize && n < len(t.entries) {
+		t.size -= t.entries[n].size()
+		n++
+	}
+	t.entries = t.entries[n:]
+}
+
+// get returns the entry at the combined static and dynamic index space.
+// http://tools.ietf.org/html/rfc7541#section-2.3.3
+func (t *dynamicTable) get(index uint64) (HeaderField, bool) {
+	if index == 0 {
+		return HeaderField{}, false
+	}
+	if index <= uint64(len(staticTable)) {
+		return staticTable[index-1], true
+	}
+	index -= uint64(len(staticTable))
+	if index > uint64(len(t.entries)) {
+		return HeaderField{}, false
+	}
+	return t.entries[uint64(len(t.entries))-index], true
+}
+
+// search returns the index of an entry matching both name and value, or
+// failing that the index of an entry matching only the name.  The static
+// table is preferred.
+func (t *dynamicTable) search(f HeaderField) (index uint64, nameMatch bool) {
+	for i, e := range staticTable {
+		if e.Name != f.Name {
+			continue
+		}
+		if e.Value == f.Value {
+			return uint64(i + 1), false
+		}
+		if index == 0 {
+			index = uint64(i + 1)
+		}
+	}
+	for i := len(t.entries) - 1; i >= 0; i-- {
+		e := t.entries[i]
+		if e.Name != f.Name {
+			continue
+		}
+		dynamicIndex := uint64(len(staticTable) + len(t.entries) - i)
+		if e.Value == f.Value {
+			return dynamicIndex, false
+		}
+		if index == 0 {
+			index = dynamicIndex
+		}
+	}
+
+	return index, index != 0
+}
+
+// Encoder produces header block fragments for a single connection.  The
+// dynamic table state is shared across every header block it encodes.
+type Encoder struct {
+	// DisableHuffman writes every string literal without Huffman coding.
+	DisableHuffman bool
+
+	table             dynamicTable
+	pendingSizeUpdate bool
+	minSizeUpdate     uint32
+}
+
+// NewEncoder returns an Encoder whose dynamic table may hold maxTableSize
+// octets, which must not exceed the peer's SETTINGS_HEADER_TABLE_SIZE.
+func NewEncoder(maxTableSize uint32) *Encoder {
+	e := &Encoder{}
+	e.table.maxSize = maxTableSize
+
+	return e
+}
+
+// SetMaxTableSize changes the size of the dynamic table, for example after
+// the peer changes SETTINGS_HEADER_TABLE_SIZE.  The change is signalled at
+// the start of the next header block.
+func (e *Encoder) SetMaxTableSize(maxTableSize uint32) {
+	if !e.pendingSizeUpdate && maxTableSize == e.table.maxSize {
+		return
+	}
+	if !e.pendingSizeUpdate || maxTableSize < e.minSizeUpdate {
+		e.minSizeUpdate = maxTableSize
+	}
+	e.pendingSizeUpdate = true
+	e.table.setMaxSize(maxTableSize)
+}
+
+func (e *Encoder) Encode(fields []HeaderField) string {
+	buf := make([]byte, 0, 64)
+
+	if e.pendingSizeUpdate {
+		// http://tools.ietf.org/html/rfc7541#section-4.2
+		if e.minSizeUpdate < e.table.maxSize {
+			buf = appendInteger(buf, 5, 0x20, uint64(e.minSizeUpdate))
+		}
+		buf = appendInteger(buf, 5, 0x20, uint64(e.table.maxSize))
+		e.pendingSizeUpdate = false
+	}
+
+	for _, f := range fields {
+		index, nameMatch := e.table.search(f)
+
+		switch {
+		case index != 0 && !nameMatch && !f.Sensitive:
+			// http://tools.ietf.org/html/rfc7541#section-6.1
+			buf = appendInteger(buf, 7, 0x80, index)
+			continue
+		case f.Sensitive:
+			// http://tools.ietf.org/html/rfc7541#section-6.2.3
+			buf = appendInteger(buf, 4, 0x10, index)
+		default:
+			// http://tools.ietf.org/html/rfc7541#section-6.2.1
+			buf = appendInteger(buf, 6, 0x40, index)
+		}
+
+		if index == 0 {
+			buf = e.appendString(buf, f.Name)
+		}
+		buf = e.appendString(buf, f.Value)
+
+		if !f.Sensitive {
+			e.table.add(HeaderField{Name: f.Name, Value: f.Value})
+		}
+	}
+
+	return string(buf)
+}
+
+// http://tools.ietf.org/html/rfc7541#section-5.2
+func (e *Encoder) appendString(dst []byte, s string) []byte {
+	if !e.DisableHuffman {
+		if n := huffmanEncodedLength(s); n <= uint64(len(s)) {
+			dst = appendInteger(dst, 7, 0x80, n)
+			return appendHuffman(dst, s)
+		}
+	}
+
+	dst = appendInteger(dst, 7, 0x00, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// Decoder consumes complete header blocks for a single connection.
+type Decoder struct {
+	table             dynamicTable
+	maxTableSize      uint32
+	maxHeaderListSize uint32
+}
+
+// HeaderListSizeError is returned by Decode for a header list larger than
+// the limit we advertise as SETTINGS_MAX_HEADER_LIST_SIZE.
+// http://tools.ietf.org/html/rfc9113#section-6.5.2
+type HeaderListSizeError struct {
+	Size    uint64
+	MaxSize uint32
+}
+
+func (e HeaderListSizeError) Error() string {
+	return fmt.Sprintf("Header list of %d octets exceeded the maximum of %d", e.Size, e.MaxSize)
+}
+
+// NewDecoder returns a Decoder that allows the peer to use up to
+// maxTableSize octets, the value we advertise as SETTINGS_HEADER_TABLE_SIZE.
+func NewDecoder(maxTableSize uint32) *Decoder {
+	d := &Decoder{maxTableSize: maxTableSize, maxHeaderListSize: Unlimited}
+	d.table.maxSize = maxTableSize
+
+	return d
+}
+
+// SetMaxHeaderListSize changes the largest header list Decode returns,
+// once the peer acknowledges a new SETTINGS_MAX_HEADER_LIST_SIZE.
+func (d *Decoder) SetMaxHeaderListSize(maxHeaderListSize uint32) {
+	d.maxHeaderListSize = maxHeaderListSize
+}
+
+// SetMaxTableSize changes the largest dynamic table size the peer may
+// select, for example after it acknowledges a new SETTINGS_HEADER_TABLE_SIZE.
+func (d *Decoder) SetMaxTableSize(maxTableSize uint32) {
+	d.maxTableSize = maxTableSize
+	if d.table.maxSize > maxTableSize {
+		d.table.setMaxSize(maxTableSize)
+	}
+}
+
+func compressionError(format string, a ...interface{}) error {
+	return ConnectionError{COMPRESSION_ERROR, fmt.Sprintf(format, a...)}
+}
+
+// Decode decodes a complete header block, the concatenation of the header
+// block fragments of a HEADERS or PUSH_PROMISE frame and any CONTINUATION
+// frames that followed it.  A header list that decodes to more than the
+// maximum size is a HeaderListSizeError; the rest of the block is still
+// decoded, without keeping its fields, so that the dynamic table stays in
+// step with the peer's.
+func (d *Decoder) Decode(block string) ([]HeaderField, error) {
+	fields := make([]HeaderField, 0)
+	sawField := false
+	var listSize uint64
+
+	for len(block) > 0 {
+		b := block[0]
+		var err error
+
+		switch {
+		case b&0x80 == 0x80:
+			// http://tools.ietf.org/html/rfc7541#section-6.1
+			var index uint64
+			index, block, err = decodeInteger(block, 7)
+			if err != nil {
+				return nil, err
+			}
+			f, ok := d.table.get(index)
+			if !ok {
+				return nil, compressionError("Invalid header table index: %d", index)
+			}
+			fields = d.appendField(fields, &listSize, HeaderField{Name: f.Name, Value: f.Value})
+		case b&0xE0 == 0x20:
+			// http://tools.ietf.org/html/rfc7541#section-6.3
+			if sawField {
+				return nil, compressionError("Dynamic table size update must occur at the start of a header block")
+			}
+			var size uint64
+			size, block, err = decodeInteger(block, 5)
+			if err != nil {
+				return nil, err
+			}
+			if size > uint64(d.maxTableSize) {
+				return nil, compressionError("Dynamic table size update of %d exceeds maximum of %d", size, d.maxTableSize)
+			}
+			d.table.setMaxSize(uint32(size))
+			continue
+		default:
+			// http://tools.ietf.org/html/rfc7541#section-6.2
+			prefix := uint8(4)
+			indexing := false
+			if b&0xC0 == 0x40 {
+				prefix = 6
+				indexing = true
+			}
+			var f HeaderField
+			f, block, err = d.decodeLiteral(block, prefix)
+			if err != nil {
+				return nil, err
+			}
+			f.Sensitive = b&0xF0 == 0x10
+			if indexing {
+				d.table.add(HeaderField{Name: f.Name, Value: f.Value})
+			}
+			fields = d.appendField(fields, &listSize, f)
+		}
+
+		sawField = true
+	}
+
+	if listSize > uint64(d.maxHeaderListSize) {
+		return nil, HeaderListSizeError{listSize, d.maxHeaderListSize}
+	}
+	return fields, nil
+}
+
+// appendField adds f to the size of the header list, and to fields unless
+// the list has grown too large to be returned.
+func (d *Decoder) appendField(fields []HeaderField, listSize *uint64, f HeaderField) []HeaderField {
+	*listSize += uint64(f.size())
+	if *listSize > uint64(d.maxHeaderListSize) {
+		return fields[0:0]
+	}
+	return append(fields, f)
+}
+
+func (d *Decoder) decodeLiteral(block string, prefix uint8) (HeaderField, string, error) {
+	f := HeaderField{}
+
+	index, block, err := decodeInteger(block, prefix)
+	if err != nil {
+		return f, block, err
+	}
+
+	if index == 0 {
+		f.Name, block, err = decodeString(block)
+		if err != nil {
+			return f, block, err
+		}
+	} else {
+		entry, ok := d.table.get(index)
+		if !ok {
+			return f, block, compressionError("Invalid header table index: %d", index)
+		}
+		f.Name = entry.Name
+	}
+
+	f.Value, block, err = decodeString(block)
+
+	return f, block, err
+}
+
+// http://tools.ietf.org/html/rfc7541#section-5.1
+func appendInteger(dst []byte, prefix uint8, flags byte, i uint64) []byte {
+	max := uint64(1)<<prefix - 1
+	if i < max {
+		return append(dst, flags|byte(i))
+	}
+
+	dst = append(dst, flags|byte(max))
+	i -= max
+	for i >= 0x80 {
+		dst = append(dst, byte(i&0x7F)|0x80)
+		i >>= 7
+	}
+
+	return append(dst, byte(i))
+}
+
+func decodeInteger(b string, prefix uint8) (uint64, string, error) {
+	if len(b) == 0 {
+		return 0, b, compressionError("Truncated integer")
+	}
+
+	max := uint64(1)<<prefix - 1
+	i := uint64(b[0]) & max
+	b = b[1:]
+	if i < max {
+		return i, b, nil
+	}
+
+	for shift := uint(0); len(b) > 0; shift += 7 {
+		if shift > 56 {
+			return 0, b, compressionError("Integer overflow")
+		}
+		octet := b[0]
+		b = b[1:]
+		i += uint64(octet&0x7F) << shift
+		if octet&0x80 == 0 {
+			return i, b, nil
+		}
+	}
+
+	return 0, b, compressionError("Truncated integer")
+}
+
+// http://tools.ietf.org/html/rfc7541#section-5.2
+func decodeString(b string) (string, string, error) {
+	if len(b) == 0 {
+		return "", b, compressionError("Truncated string literal")
+	}
+	huffman := b[0]&0x80 == 0x80
+
+	length, b, err := decodeInteger(b, 7)
+	if err != nil {
+		return "", b, err
+	}
+	if length > uint64(len(b)) {
+		return "", b, compressionError("String literal length exceeded header block")
+	}
+
+	s := b[0:length]
+	b = b[length:]
+	if huffman {
+		s, err = decodeHuffman(s)
+	}
+
+	return s, b, err
+}
+
+func huffmanEncodedLength(s string) uint64 {
+	bits := uint64(0)
+	for i := 0; i < len(s); i++ {
+		bits += uint64(huffmanCodes[s[i]].length)
+	}
+
+	return (bits + 7) / 8
+}
+
+// http://tools.ietf.org/html/rfc7541#section-5.2
+func appendHuffman(dst []byte, s string) []byte {
+	var acc uint64
+	var bits uint
+
+	for i := 0; i < len(s); i++ {
+		c := huffmanCodes[s[i]]
+		acc = acc<<c.length | uint64(c.code)
+		bits += uint(c.length)
+		for bits >= 8 {
+			bits -= 8
+			dst = append(dst, byte(acc>>bits))
+		}
+	}
+
+	if bits > 0 {
+		// pad with the most significant bits of EOS
+		acc = acc<<(8-bits) | 0xFF>>bits
+		dst = append(dst, byte(acc))
+	}
+
+	return dst
+}
+
+type huffmanNode struct {
+	children [2]*huffmanNode
+	sym      int
+}
+
+var huffmanTree *huffmanNode
+var huffmanTreeOnce sync.Once
+
+func buildHuffmanTree() {
+	huffmanTree = &huffmanNode{sym: -1}
+	for sym, c := range huffmanCodes {
+		n := huffmanTree
+		for i := int(c.length) - 1; i >= 0; i-- {
+			bit := (c.code >> uint(i)) & 0x1
+			if n.children[bit] == nil {
+				n.children[bit] = &huffmanNode{sym: -1}
+			}
+			n = n.children[bit]
+		}
+		n.sym = sym
+	}
+}
+
+func decodeHuffman(s string) (string, error) {
+	huffmanTreeOnce.Do(buildHuffmanTree)
+
+	dst := make([]byte, 0, len(s)*8/5)
+	n := huffmanTree
+	// depth and ones track the bits consumed since the last symbol, which
+	// must be a prefix of EOS no longer than 7 bits at the end
+	depth, ones := 0, true
+
+	for i := 0; i < len(s); i++ {
+		for shift := 7; shift >= 0; shift-- {
+			bit := (s[i] >> uint(shift)) & 0x1
+			n = n.children[bit]
+			if n == nil {
+				return "", compressionError("Invalid Huffman code")
+			}
+			depth++
+			ones = ones && bit == 1
+
+			if n.sym == 256 {
+				return "", compressionError("Huffman string contained EOS")
+			}
+			if n.sym >= 0 {
+				dst = append(dst, byte(n.sym))
+				n = huffmanTree
+				depth, ones = 0, true
+			}
+		}
+	}
+
+	if depth > 7 || !ones {
+		return "", compressionError("Invalid Huffman padding")
+	}
+
+	return string(dst), nil
+}
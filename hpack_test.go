@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func fromHex(s string) string {
+	b, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+func dynamicTableEntries(t dynamicTable) []HeaderField {
+	entries := make([]HeaderField, len(t.entries))
+	for i, e := range t.entries {
+		entries[len(entries)-i-1] = e
+	}
+	return entries
+}
+
+type hpackExample struct {
+	fields []HeaderField
+	wire   string
+	table  []HeaderField
+	size   uint32
+}
+
+func assertHpackExamples(t *testing.T, tableSize uint32, huffman bool, examples []hpackExample) {
+	e := NewEncoder(tableSize)
+	e.DisableHuffman = !huffman
+	d := NewDecoder(tableSize)
+
+	for _, example := range examples {
+		wire := fromHex(example.wire)
+
+		assert.Equal(t, hex.EncodeToString([]byte(e.Encode(example.fields))),
+			hex.EncodeToString([]byte(wire)))
+		assert.Equal(t, dynamicTableEntries(e.table), example.table)
+		assert.Equal(t, e.table.size, example.size)
+
+		fields, err := d.Decode(wire)
+		assert.Nil(t, err)
+		assert.Equal(t, fields, example.fields)
+		assert.Equal(t, dynamicTableEntries(d.table), example.table)
+		assert.Equal(t, d.table.size, example.size)
+	}
+}
+
+// http://tools.ietf.org/html/rfc7541#appendix-C.1
+func TestHpackIntegerRepresentation(t *testing.T) {
+	assert.Equal(t, appendInteger(nil, 5, 0x00, 10), []byte{0x0A})
+	assert.Equal(t, appendInteger(nil, 5, 0x00, 1337), []byte{0x1F, 0x9A, 0x0A})
+	assert.Equal(t, appendInteger(nil, 8, 0x00, 42), []byte{0x2A})
+
+	i, rest, err := decodeInteger("\x1F\x9A\x0Arest", 5)
+	assert.Nil(t, err)
+	assert.Equal(t, i, uint64(1337))
+	assert.Equal(t, rest, "rest")
+}
+
+func TestHpackIntegerOverflow(t *testing.T) {
+	_, _, err := decodeInteger("\x1F"+strings.Repeat("\xFF", 10)+"\x01", 5)
+
+	assert.Equal(t, err, ConnectionError{COMPRESSION_ERROR, "Integer overflow"})
+}
+
+func TestHpackTruncatedInteger(t *testing.T) {
+	_, _, err := decodeInteger("\x1F\x9A", 5)
+
+	assert.Equal(t, err, ConnectionError{COMPRESSION_ERROR, "Truncated integer"})
+}
+
+// http://tools.ietf.org/html/rfc7541#appendix-C.2.1
+func TestHpackLiteralWithIndexing(t *testing.T) {
+	d := NewDecoder(defaultHeaderTableSize)
+	fields, err := d.Decode(fromHex("400a 6375 7374 6f6d 2d6b 6579 0d63 7573 746f 6d2d 6865 6164 6572"))
+
+	assert.Nil(t, err)
+	assert.Equal(t, fields, []HeaderField{{Name: "custom-key", Value: "custom-header"}})
+	assert.Equal(t, d.table.size, uint32(55))
+}
+
+// http://tools.ietf.org/html/rfc7541#appendix-C.2.2
+func TestHpackLiteralWithoutIndexing(t *testing.T) {
+	d := NewDecoder(defaultHeaderTableSize)
+	fields, err := d.Decode(fromHex("040c 2f73 616d 706c 652f 7061 7468"))
+
+	assert.Nil(t, err)
+	assert.Equal(t, fields, []HeaderField{{Name: ":path", Value: "/sample/path"}})
+	assert.Equal(t, len(d.table.entries), 0)
+}
+
+// http://tools.ietf.org/html/rfc7541#appendix-C.2.3
+func TestHpackLiteralNeverIndexed(t *testing.T) {
+	wire := fromHex("1008 7061 7373 776f 7264 0673 6563 7265 74")
+	field := HeaderField{Name: "password", Value: "secret", Sensitive: true}
+
+	e := NewEncoder(defaultHeaderTableSize)
+	e.DisableHuffman = true
+	assert.Equal(t, e.Encode([]HeaderField{field}), wire)
+	assert.Equal(t, len(e.table.entries), 0)
+
+	d := NewDecoder(defaultHeaderTableSize)
+	fields, err := d.Decode(wire)
+
+	assert.Nil(t, err)
+	assert.Equal(t, fields, []HeaderField{field})
+	assert.Equal(t, len(d.table.entries), 0)
+}
+
+// http://tools.ietf.org/html/rfc7541#appendix-C.2.4
+func TestHpackIndexedField(t *testing.T) {
+	e := NewEncoder(defaultHeaderTableSize)
+	assert.Equal(t, e.Encode([]HeaderField{{Name: ":method", Value: "GET"}}), "\x82")
+
+	d := NewDecoder(defaultHeaderTableSize)
+	fields, err := d.Decode("\x82")
+
+	assert.Nil(t, err)
+	assert.Equal(t, fields, []HeaderField{{Name: ":method", Value: "GET"}})
+}
+
+var hpackRequestFields = [][]HeaderField{
+	{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/"},
+		{Name: ":authority", Value: "www.example.com"},
+	},
+	{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/"},
+		{Name: ":authority", Value: "www.example.com"},
+		{Name: "cache-control", Value: "no-cache"},
+	},
+	{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":path", Value: "/index.html"},
+		{Name: ":authority", Value: "www.example.com"},
+		{Name: "custom-key", Value: "custom-value"},
+	},
+}
+
+var hpackRequestTables = [][]HeaderField{
+	{
+		{Name: ":authority", Value: "www.example.com"},
+	},
+	{
+		{Name: "cache-control", Value: "no-cache"},
+		{Name: ":authority", Value: "www.example.com"},
+	},
+	{
+		{Name: "custom-key", Value: "custom-value"},
+		{Name: "cache-control", Value: "no-cache"},
+		{Name: ":authority", Value: "www.example.com"},
+	},
+}
+
+// http://tools.ietf.org/html/rfc7541#appendix-C.3
+func TestHpackRequestsWithoutHuffman(t *testing.T) {
+	assertHpackExamples(t, defaultHeaderTableSize, false, []hpackExample{
+		{hpackRequestFields[0], "8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d", hpackRequestTables[0], 57},
+		{hpackRequestFields[1], "8286 84be 5808 6e6f 2d63 6163 6865", hpackRequestTables[1], 110},
+		{hpackRequestFields[2], "8287 85bf 400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65", hpackRequestTables[2], 164},
+	})
+}
+
+// http://tools.ietf.org/html/rfc7541#appendix-C.4
+func TestHpackRequestsWithHuffman(t *testing.T) {
+	assertHpackExamples(t, defaultHeaderTableSize, true, []hpackExample{
+		{hpackRequestFields[0], "8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff", hpackRequestTables[0], 57},
+		{hpackRequestFields[1], "8286 84be 5886 a8eb 1064 9cbf", hpackRequestTables[1], 110},
+		{hpackRequestFields[2], "8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf", hpackRequestTables[2], 164},
+	})
+}
+
+var hpackResponseFields = [][]HeaderField{
+	{
+		{Name: ":status", Value: "302"},
+		{Name: "cache-control", Value: "private"},
+		{Name: "date", Value: "Mon, 21 Oct 2013 20:13:21 GMT"},
+		{Name: "location", Value: "https://www.example.com"},
+	},
+	{
+		{Name: ":status", Value: "307"},
+		{Name: "cache-control", Value: "private"},
+		{Name: "date", Value: "Mon, 21 Oct 2013 20:13:21 GMT"},
+		{Name: "location", Value: "https://www.example.com"},
+	},
+	{
+		{Name: ":status", Value: "200"},
+		{Name: "cache-control", Value: "private"},
+		{Name: "date", Value: "Mon, 21 Oct 2013 20:13:22 GMT"},
+		{Name: "location", Value: "https://www.example.com"},
+		{Name: "content-encoding", Value: "gzip"},
+		{Name: "set-cookie", Value: "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1"},
+	},
+}
+
+var hpackResponseTables = [][]HeaderField{
+	{
+		{Name: "location", Value: "https://www.example.com"},
+		{Name: "date", Value: "Mon, 21 Oct 2013 20:13:21 GMT"},
+		{Name: "cache-control", Value: "private"},
+		{Name: ":status", Value: "302"},
+	},
+	{
+		{Name: ":status", Value: "307"},
+		{Name: "location", Value: "https://www.example.com"},
+		{Name: "date", Value: "Mon, 21 Oct 2013 20:13:21 GMT"},
+		{Name: "cache-control", Value: "private"},
+	},
+	{
+		{Name: "set-cookie", Value: "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1"},
+		{Name: "content-encoding", Value: "gzip"},
+		{Name: "date", Value: "Mon, 21 Oct 2013 20:13:22 GMT"},
+	},
+}
+
+// http://tools.ietf.org/html/rfc7541#appendix-C.5
+func TestHpackResponsesWithoutHuffman(t *testing.T) {
+	assertHpackExamples(t, 256, false, []hpackExample{
+		{hpackResponseFields[0], "4803 3330 3258 0770 7269 7661 7465 611d 4d6f 6e2c 2032 3120 4f63 7420 3230 3133 2032 303a 3133 3a32 3120 474d 546e 1768 7474 7073 3a2f 2f77 7777 2e65 7861 6d70 6c65 2e63 6f6d", hpackResponseTables[0], 222},
+		{hpackResponseFields[1], "4803 3330 37c1 c0bf", hpackResponseTables[1], 222},
+		{hpackResponseFields[2], "88c1 611d 4d6f 6e2c 2032 3120 4f63 7420 3230 3133 2032 303a 3133 3a32 3220 474d 54c0 5a04 677a 6970 7738 666f 6f3d 4153 444a 4b48 514b 425a 584f 5157 454f 5049 5541 5851 5745 4f49 553b 206d 6178 2d61 6765 3d33 3630 303b 2076 6572 7369 6f6e 3d31", hpackResponseTables[2], 215},
+	})
+}
+
+// http://tools.ietf.org/html/rfc7541#appendix-C.6
+func TestHpackResponsesWithHuffman(t *testing.T) {
+	assertHpackExamples(t, 256, true, []hpackExample{
+		{hpackResponseFields[0], "4882 6402 5885 aec3 771a 4b61 96d0 7abe 9410 54d4 44a8 2005 9504 0b81 66e0 82a6 2d1b ff6e 919d 29ad 1718 63c7 8f0b 97c8 e9ae 82ae 43d3", hpackResponseTables[0], 222},
+		{hpackResponseFields[1], "4883 640e ffc1 c0bf", hpackResponseTables[1], 222},
+		{hpackResponseFields[2], "88c1 6196 d07a be94 1054 d444 a820 0595 040b 8166 e084 a62d 1bff c05a 839b d9ab 77ad 94e7 821d d7f2 e6c7 b335 dfdf cd5b 3960 d5af 2708 7f36 72c1 ab27 0fb5 291f 9587 3160 65c0 03ed 4ee5 b106 3d50 07", hpackResponseTables[2], 215},
+	})
+}
+
+func TestHpackEncoderSignalsTableSizeUpdate(t *testing.T) {
+	e := NewEncoder(defaultHeaderTableSize)
+	e.Encode([]HeaderField{{Name: "custom-key", Value: "custom-value"}})
+
+	e.SetMaxTableSize(0)
+	e.SetMaxTableSize(256)
+	block := e.Encode([]HeaderField{{Name: ":method", Value: "GET"}})
+
+	assert.Equal(t, block, "\x20\x3F\xE1\x01\x82",
+		"Should have signalled the smallest size and then the final size")
+	assert.Equal(t, len(e.table.entries), 0,
+		"Shrinking the table to zero should have evicted every entry")
+}
+
+func TestHpackDecoderTableSizeUpdate(t *testing.T) {
+	d := NewDecoder(defaultHeaderTableSize)
+	d.Decode(fromHex("400a 6375 7374 6f6d 2d6b 6579 0d63 7573 746f 6d2d 6865 6164 6572"))
+
+	fields, err := d.Decode("\x20\x82")
+
+	assert.Nil(t, err)
+	assert.Equal(t, fields, []HeaderField{{Name: ":method", Value: "GET"}})
+	assert.Equal(t, len(d.table.entries), 0)
+	assert.Equal(t, d.table.maxSize, uint32(0))
+}
+
+func TestHpackDecoderRejectsTableSizeUpdateAboveMaximum(t *testing.T) {
+	d := NewDecoder(256)
+
+	_, err := d.Decode("\x3F\xE1\x1F")
+
+	assert.Equal(t, err, ConnectionError{COMPRESSION_ERROR, "Dynamic table size update of 4096 exceeds maximum of 256"})
+}
+
+func TestHpackDecoderRejectsTableSizeUpdateAfterField(t *testing.T) {
+	d := NewDecoder(defaultHeaderTableSize)
+
+	_, err := d.Decode("\x82\x20")
+
+	assert.Equal(t, err, ConnectionError{COMPRESSION_ERROR, "Dynamic table size update must occur at the start of a header block"})
+}
+
+func TestHpackDecoderRejectsInvalidIndex(t *testing.T) {
+	d := NewDecoder(defaultHeaderTableSize)
+
+	_, err := d.Decode("\xBE")
+
+	assert.Equal(t, err, ConnectionError{COMPRESSION_ERROR, "Invalid header table index: 62"})
+}
+
+func TestHpackDecoderRejectsTruncatedString(t *testing.T) {
+	d := NewDecoder(defaultHeaderTableSize)
+
+	_, err := d.Decode("\x40\x0Acustom")
+
+	assert.Equal(t, err, ConnectionError{COMPRESSION_ERROR, "String literal length exceeded header block"})
+}
+
+func TestHuffmanRoundTrip(t *testing.T) {
+	s := ""
+	for i := 0; i < 256; i++ {
+		s += string([]byte{byte(i)})
+	}
+
+	decoded, err := decodeHuffman(string(appendHuffman(nil, s)))
+
+	assert.Nil(t, err)
+	assert.Equal(t, decoded, s)
+}
+
+func TestHuffmanRejectsLongPadding(t *testing.T) {
+	// 'a' is 00011, followed by a full octet of padding
+	_, err := decodeHuffman("\x1F\xFF")
+
+	assert.Equal(t, err, ConnectionError{COMPRESSION_ERROR, "Invalid Huffman padding"})
+}
+
+func TestHuffmanRejectsPaddingThatIsNotEOS(t *testing.T) {
+	// 'a' is 00011, followed by padding of 000
+	_, err := decodeHuffman("\x18")
+
+	assert.Equal(t, err, ConnectionError{COMPRESSION_ERROR, "Invalid Huffman padding"})
+}
+
+func TestHuffmanRejectsEOS(t *testing.T) {
+	_, err := decodeHuffman("\xFF\xFF\xFF\xFF")
+
+	assert.Equal(t, err, ConnectionError{COMPRESSION_ERROR, "Huffman string contained EOS"})
+}
+
+func TestHpackDecoderLimitsHeaderListSize(t *testing.T) {
+	d := NewDecoder(defaultHeaderTableSize)
+	d.SetMaxHeaderListSize(1000)
+
+	// The literal is still added to the dynamic table
+	fields, err := d.Decode(strings.Repeat("\x82", 100) + "\x40\x03foo\x03bar")
+	assert.Nil(t, fields)
+	assert.Equal(t, err, HeaderListSizeError{100*42 + 38, 1000})
+
+	fields, err = d.Decode("\xbe")
+	assert.Nil(t, err)
+	assert.Equal(t, fields, []HeaderField{{Name: "foo", Value: "bar"}})
+}
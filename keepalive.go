@@ -0,0 +1,106 @@
+package main
+
+import (
+	"time"
+)
+
+// Keepalive PING payloads are "KA" followed by a counter, so that each
+// acknowledgement can be matched to the PING it answers.
+const keepalivePingData = 0x4B41 << 48
+
+const defaultKeepaliveTimeout = 20 * time.Second
+
+// ErrKeepaliveTimeout closes a connection whose peer stopped answering
+// keepalive PINGs.  The peer is told why in a GOAWAY, in case it is only
+// slow rather than gone.
+var ErrKeepaliveTimeout = ConnectionError{NO_ERROR, "Keepalive PING was not acknowledged in time"}
+
+// ConnectionStats describes the health of a connection.
+type ConnectionStats struct {
+	// RTT is the latest round trip time measured with a keepalive PING,
+	// or zero before one has been acknowledged
+	RTT time.Duration
+}
+
+type outstandingPing struct {
+	sentAt time.Time
+	timer  Timer
+}
+
+// Stats returns the latest measurements of the connection.
+func (c *Connection) Stats() ConnectionStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return ConnectionStats{RTT: c.rtt}
+}
+
+// startKeepalive sends a PING whenever nothing has been received from the
+// peer for interval, closing the connection if it is not acknowledged
+// within timeout.
+// http://tools.ietf.org/html/rfc9113#section-6.7
+func (c *Connection) startKeepalive(interval time.Duration, timeout time.Duration) {
+	if timeout == 0 {
+		timeout = defaultKeepaliveTimeout
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.keepaliveInterval = interval
+	c.keepaliveTimeout = timeout
+	c.keepaliveTimer = c.clock.AfterFunc(interval, c.keepalive)
+}
+
+func (c *Connection) keepalive() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+
+	now := c.clock.Now()
+	idle := now.Sub(c.lastActivity)
+	if idle < c.keepaliveInterval || len(c.pings) > 0 {
+		// Either the peer has been heard from or a PING is already
+		// waiting to be acknowledged
+		c.keepaliveTimer = c.clock.AfterFunc(c.keepaliveInterval-idle%c.keepaliveInterval, c.keepalive)
+		c.mu.Unlock()
+		return
+	}
+
+	c.pingCount++
+	data := keepalivePingData | c.pingCount
+	c.pings[data] = &outstandingPing{
+		sentAt: now,
+		timer: c.clock.AfterFunc(c.keepaliveTimeout, func() {
+			c.mu.Lock()
+			_, outstanding := c.pings[data]
+			c.mu.Unlock()
+
+			if outstanding {
+				c.closeWithError(ErrKeepaliveTimeout)
+			}
+		}),
+	}
+	c.keepaliveTimer = c.clock.AfterFunc(c.keepaliveInterval, c.keepalive)
+	c.mu.Unlock()
+
+	if err := c.writeFrame(PING{OpaqueData: data}); err != nil {
+		// No acknowledgement can arrive to wait for
+		c.closeWithError(err)
+	}
+}
+
+// handleKeepaliveAck records the round trip time of an acknowledged
+// keepalive PING.  c.mu must be held.
+func (c *Connection) handleKeepaliveAck(f PING) {
+	p, ok := c.pings[f.OpaqueData]
+	if !ok {
+		return
+	}
+
+	p.timer.Stop()
+	delete(c.pings, f.OpaqueData)
+	c.rtt = c.clock.Now().Sub(p.sentAt)
+}
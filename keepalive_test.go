@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func NewTestKeepaliveConnection(t *testing.T) (*Connection, *MockConn, *fakeClock) {
+	c, conn, clock := NewTestConnection(nil)
+	assert.Nil(t, c.handleFrame(settingsAck()))
+	c.startKeepalive(10*time.Second, 5*time.Second)
+
+	return c, conn, clock
+}
+
+func TestKeepaliveMeasuresRoundTripTime(t *testing.T) {
+	c, conn, clock := NewTestKeepaliveConnection(t)
+	assert.Equal(t, c.Stats().RTT, time.Duration(0))
+
+	clock.Advance(10 * time.Second)
+	assert.Equal(t, readAllFrames(t, conn.written), []Frame{PING{OpaqueData: keepalivePingData | 1}})
+
+	clock.Advance(300 * time.Millisecond)
+	assert.Nil(t, c.handleFrame(pingAck(keepalivePingData|1)))
+	assert.Equal(t, c.Stats().RTT, 300*time.Millisecond)
+
+	clock.Advance(5 * time.Second)
+	assert.False(t, conn.closed, "Acknowledged PING should not have timed out")
+}
+
+func TestKeepaliveOnlyPingsIdleConnections(t *testing.T) {
+	c, conn, clock := NewTestKeepaliveConnection(t)
+
+	clock.Advance(6 * time.Second)
+	assert.Nil(t, c.handleFrame(WINDOW_UPDATE{0, 1}))
+	clock.Advance(6 * time.Second)
+	assert.Equal(t, len(conn.written), 0)
+
+	clock.Advance(4 * time.Second)
+	assert.Equal(t, readAllFrames(t, conn.written), []Frame{PING{OpaqueData: keepalivePingData | 1}})
+}
+
+func TestKeepalivePingsAreUnique(t *testing.T) {
+	c, conn, clock := NewTestKeepaliveConnection(t)
+
+	clock.Advance(10 * time.Second)
+	assert.Nil(t, c.handleFrame(pingAck(keepalivePingData|1)))
+	clock.Advance(10 * time.Second)
+
+	assert.Equal(t, readAllFrames(t, conn.written), []Frame{
+		PING{OpaqueData: keepalivePingData | 1},
+		PING{OpaqueData: keepalivePingData | 2},
+	})
+}
+
+func TestKeepaliveClosesConnectionWithoutAck(t *testing.T) {
+	c, conn, clock := NewTestKeepaliveConnection(t)
+
+	clock.Advance(10 * time.Second)
+	assert.Nil(t, c.handleFrame(pingAck(42)), "Other acknowledgements should not count")
+	clock.Advance(4 * time.Second)
+	assert.False(t, conn.closed)
+
+	clock.Advance(time.Second)
+	assert.True(t, conn.closed)
+	assert.Equal(t, readAllFrames(t, conn.written), []Frame{
+		PING{OpaqueData: keepalivePingData | 1},
+		GOAWAY{0, NO_ERROR, "Keepalive PING was not acknowledged in time"},
+	})
+}
+
+func TestKeepaliveClosesConnectionWhenPingFails(t *testing.T) {
+	c, conn, clock := NewTestKeepaliveConnection(t)
+	conn.writeErr = errors.New("broken pipe")
+
+	clock.Advance(10 * time.Second)
+
+	assert.True(t, conn.closed, "The connection should not have waited for the keepalive timeout")
+	assert.False(t, c.CanOpenStream())
+}
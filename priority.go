@@ -0,0 +1,331 @@
+package main
+
+import (
+	"fmt"
+)
+
+// PriorityParam is the priority signalled for a stream in HEADERS and
+// PRIORITY frames.  Weight is the wire value, so the stream's actual weight
+// is one more than it.
+// http://tools.ietf.org/html/rfc7540#section-5.3
+type PriorityParam struct {
+	StreamDependency uint32
+	Exclusive        bool
+	Weight           uint8
+}
+
+// http://tools.ietf.org/html/rfc7540#section-5.3.5
+var defaultPriority = PriorityParam{StreamDependency: 0, Weight: 15}
+
+// maxIdlePriorityNodes is how many streams that have been prioritized but
+// never opened are kept in the tree.  Beyond it the oldest is removed, so
+// that PRIORITY frames for idle streams cannot grow the tree without bound.
+// http://tools.ietf.org/html/rfc7540#section-5.3.4
+const maxIdlePriorityNodes = 10
+
+// priorityParam returns the priority carried by a HEADERS or PRIORITY
+// frame.  HEADERS without the PRIORITY flag has the default priority.
+func priorityParam(f Frame) (PriorityParam, bool) {
+	switch f := unwrapHeaderBlock(f).(type) {
+	case HEADERS:
+		if !f.Flags.PRIORITY {
+			return defaultPriority, true
+		}
+		return PriorityParam{f.StreamDependency, f.Flags.EXCLUSIVE, f.Weight}, true
+	case PRIORITY:
+		return PriorityParam{f.StreamDependency, f.Flags.EXCLUSIVE, f.Weight}, true
+	}
+
+	return PriorityParam{}, false
+}
+
+// withoutRFC7540Priority removes the priority signals of RFC 7540 from f,
+// returning false for PRIORITY frames as nothing is then left of them.
+// http://tools.ietf.org/html/rfc9218#section-2.1
+func withoutRFC7540Priority(f Frame) (Frame, bool) {
+	switch f := f.(type) {
+	case PRIORITY:
+		return nil, false
+	case HEADERS:
+		f.Flags.PRIORITY = false
+		f.Flags.EXCLUSIVE = false
+		f.StreamDependency = 0
+		f.Weight = 0
+		return f, true
+	case HeaderBlock:
+		f.Frame, _ = withoutRFC7540Priority(f.Frame)
+		return f, true
+	}
+
+	return f, true
+}
+
+type priorityNode struct {
+	id       uint32
+	weight   int
+	parent   *priorityNode
+	children []*priorityNode
+	// idle is set until the stream is opened or has frames queued
+	idle bool
+
+	queue []Frame
+	// queued counts the frames queued in this node's whole subtree
+	queued int
+
+	// pass is how far this node has advanced through its parent's
+	// bandwidth, in bytes divided by weight; the ready sibling with the
+	// lowest pass is served next.  virtualTime is the pass of the child
+	// most recently served, which children that become ready start from.
+	pass        float64
+	virtualTime float64
+}
+
+func (n *priorityNode) removeChild(child *priorityNode) {
+	for i, c := range n.children {
+		if c == child {
+			n.children = append(n.children[0:i], n.children[i+1:]...)
+			return
+		}
+	}
+}
+
+func (n *priorityNode) isAncestorOf(other *priorityNode) bool {
+	for p := other.parent; p != nil; p = p.parent {
+		if p == n {
+			return true
+		}
+	}
+	return false
+}
+
+// PriorityWriteScheduler orders outgoing stream frames using the stream
+// dependency tree, sharing bandwidth between siblings in proportion to
+// their weights.  A stream with frames queued is served before any of its
+// descendants.
+// http://tools.ietf.org/html/rfc7540#section-5.3
+type PriorityWriteScheduler struct {
+	root  *priorityNode
+	nodes map[uint32]*priorityNode
+	// idle are the nodes of idle streams, oldest first
+	idle []*priorityNode
+}
+
+func NewPriorityWriteScheduler() *PriorityWriteScheduler {
+	root := &priorityNode{id: 0, weight: 16}
+	return &PriorityWriteScheduler{
+		root:  root,
+		nodes: map[uint32]*priorityNode{0: root},
+	}
+}
+
+// OpenStream adds a stream to the tree, or reprioritizes it if it was
+// already added by a PRIORITY frame while idle.
+func (s *PriorityWriteScheduler) OpenStream(streamId uint32, priority PriorityParam) error {
+	return s.adjust(streamId, priority, false)
+}
+
+// AdjustStream moves a stream within the tree.  A dependency on a stream
+// that is not in the tree gives the stream the default priority instead.
+// http://tools.ietf.org/html/rfc7540#section-5.3.3
+func (s *PriorityWriteScheduler) AdjustStream(streamId uint32, priority PriorityParam) error {
+	return s.adjust(streamId, priority, true)
+}
+
+// adjust moves a stream within the tree, adding it as idle or open if it
+// is not there yet.
+func (s *PriorityWriteScheduler) adjust(streamId uint32, priority PriorityParam, idle bool) error {
+	if priority.StreamDependency == streamId {
+		return StreamError{
+			streamId,
+			PROTOCOL_ERROR,
+			fmt.Sprintf("Stream %d cannot depend on itself", streamId),
+		}
+	}
+
+	parent, ok := s.nodes[priority.StreamDependency]
+	if !ok {
+		priority = defaultPriority
+		parent = s.root
+	}
+
+	n, ok := s.nodes[streamId]
+	if !ok {
+		n = &priorityNode{id: streamId, idle: idle}
+		s.nodes[streamId] = n
+		if idle {
+			s.idle = append(s.idle, n)
+		}
+	} else {
+		if n.isAncestorOf(parent) {
+			// The new parent is moved up to take the place of the stream
+			// first, keeping its weight
+			s.detach(parent)
+			s.attach(parent, n.parent, false)
+		}
+		s.detach(n)
+	}
+
+	n.weight = int(priority.Weight) + 1
+	s.attach(n, parent, priority.Exclusive)
+	if !idle {
+		s.opened(n)
+	}
+
+	if len(s.idle) > maxIdlePriorityNodes {
+		s.CloseStream(s.idle[0].id)
+	}
+
+	return nil
+}
+
+// Prioritize applies the priority in a HEADERS or PRIORITY frame.  HEADERS
+// without the PRIORITY flag, such as trailers, leave a stream already in
+// the tree where it is.
+func (s *PriorityWriteScheduler) Prioritize(f Frame) error {
+	priority, ok := priorityParam(f)
+	if !ok {
+		return nil
+	}
+
+	streamId := frameStreamId(f)
+	h, isHeaders := unwrapHeaderBlock(f).(HEADERS)
+	if !isHeaders {
+		return s.AdjustStream(streamId, priority)
+	}
+	if n := s.nodes[streamId]; n != nil && !h.Flags.PRIORITY {
+		s.opened(n)
+		return nil
+	}
+
+	return s.OpenStream(streamId, priority)
+}
+
+// CloseStream removes a stream from the tree, returning any frames still
+// queued for it.  Its children take its place, sharing its weight.
+// http://tools.ietf.org/html/rfc7540#section-5.3.4
+func (s *PriorityWriteScheduler) CloseStream(streamId uint32) []Frame {
+	n, ok := s.nodes[streamId]
+	if !ok || n == s.root {
+		return nil
+	}
+
+	parent := n.parent
+	children := n.children
+	n.children = nil
+	s.detach(n)
+	s.opened(n)
+	delete(s.nodes, streamId)
+
+	total := 0
+	for _, child := range children {
+		total += child.weight
+	}
+	for _, child := range children {
+		child.weight = n.weight * child.weight / total
+		if child.weight < 1 {
+			child.weight = 1
+		}
+		s.attach(child, parent, false)
+	}
+
+	return n.queue
+}
+
+// Push queues a frame to be written on its stream.  Frames for streams
+// that have not been opened are queued with the default priority.
+func (s *PriorityWriteScheduler) Push(f Frame) {
+	streamId := frameStreamId(f)
+	n, ok := s.nodes[streamId]
+	if !ok {
+		s.OpenStream(streamId, defaultPriority)
+		n = s.nodes[streamId]
+	}
+	s.opened(n)
+
+	n.queue = append(n.queue, f)
+	s.addQueued(n, 1)
+}
+
+// Pop returns the next frame to write, if any are queued.
+func (s *PriorityWriteScheduler) Pop() (Frame, bool) {
+	n := s.root
+	for n == s.root || len(n.queue) == 0 {
+		var next *priorityNode
+		for _, child := range n.children {
+			if child.queued > 0 && (next == nil || child.pass < next.pass) {
+				next = child
+			}
+		}
+		if next == nil {
+			return nil, false
+		}
+		n = next
+	}
+
+	f := n.queue[0]
+	n.queue = n.queue[1:]
+	s.addQueued(n, -1)
+
+	size := float64(len(f.Marshal()))
+	for node := n; node != s.root; node = node.parent {
+		node.parent.virtualTime = node.pass
+		node.pass += size / float64(node.weight)
+	}
+
+	return f, true
+}
+
+// opened stops treating n as the node of an idle stream.
+func (s *PriorityWriteScheduler) opened(n *priorityNode) {
+	if !n.idle {
+		return
+	}
+
+	n.idle = false
+	for i, idle := range s.idle {
+		if idle == n {
+			s.idle = append(s.idle[0:i], s.idle[i+1:]...)
+			return
+		}
+	}
+}
+
+// attach makes n a child of parent, or its only child if exclusive.
+func (s *PriorityWriteScheduler) attach(n *priorityNode, parent *priorityNode, exclusive bool) {
+	// Frames queued under the children that n adopts are already counted
+	// in parent and its ancestors
+	adopted := 0
+	if exclusive {
+		for _, child := range parent.children {
+			child.parent = n
+			n.children = append(n.children, child)
+			adopted += child.queued
+		}
+		parent.children = nil
+		n.queued += adopted
+	}
+
+	n.parent = parent
+	parent.children = append(parent.children, n)
+	if n.queued > 0 && n.pass < parent.virtualTime {
+		n.pass = parent.virtualTime
+	}
+	s.addQueued(parent, n.queued-adopted)
+}
+
+func (s *PriorityWriteScheduler) detach(n *priorityNode) {
+	s.addQueued(n.parent, -n.queued)
+	n.parent.removeChild(n)
+	n.parent = nil
+}
+
+func (s *PriorityWriteScheduler) addQueued(n *priorityNode, delta int) {
+	for ; n != nil; n = n.parent {
+		wasIdle := n.queued == 0
+		n.queued += delta
+		if wasIdle && n.queued > 0 && n.parent != nil && n.pass < n.parent.virtualTime {
+			// Streams that had nothing to send do not get to catch up
+			n.pass = n.parent.virtualTime
+		}
+	}
+}
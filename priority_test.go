@@ -0,0 +1,210 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func childIds(s *PriorityWriteScheduler, streamId uint32) []uint32 {
+	ids := []uint32{}
+	for _, child := range s.nodes[streamId].children {
+		ids = append(ids, child.id)
+	}
+	return ids
+}
+
+// popCounts pops n frames and counts how many came from each stream.
+func popCounts(t *testing.T, s *PriorityWriteScheduler, n int) map[uint32]int {
+	counts := map[uint32]int{}
+	for i := 0; i < n; i++ {
+		f, ok := s.Pop()
+		assert.True(t, ok)
+		counts[frameStreamId(f)]++
+	}
+	return counts
+}
+
+func TestPriorityParamFromFrames(t *testing.T) {
+	h := headersFrame(3, false)
+	p, ok := priorityParam(h)
+	assert.True(t, ok)
+	assert.Equal(t, p, defaultPriority, "HEADERS without PRIORITY should have the default priority")
+
+	h.Flags.PRIORITY = true
+	h.Flags.EXCLUSIVE = true
+	h.StreamDependency = 1
+	h.Weight = 200
+	p, _ = priorityParam(HeaderBlock{StreamId: 3, Frame: h})
+	assert.Equal(t, p, PriorityParam{1, true, 200})
+
+	_, ok = priorityParam(dataFrame(3, false))
+	assert.False(t, ok)
+}
+
+func TestPriorityPopWithNothingQueued(t *testing.T) {
+	s := NewPriorityWriteScheduler()
+	s.OpenStream(1, defaultPriority)
+
+	_, ok := s.Pop()
+	assert.False(t, ok)
+}
+
+func TestPrioritySharesBandwidthByWeight(t *testing.T) {
+	s := NewPriorityWriteScheduler()
+	s.OpenStream(1, PriorityParam{0, false, 15})
+	s.OpenStream(3, PriorityParam{0, false, 47})
+	for i := 0; i < 100; i++ {
+		s.Push(dataFrame(1, false))
+		s.Push(dataFrame(3, false))
+	}
+
+	counts := popCounts(t, s, 80)
+	assert.Equal(t, counts[1], 20)
+	assert.Equal(t, counts[3], 60)
+}
+
+func TestPriorityServesParentsBeforeChildren(t *testing.T) {
+	s := NewPriorityWriteScheduler()
+	s.OpenStream(1, defaultPriority)
+	s.OpenStream(3, PriorityParam{1, false, 255})
+	s.Push(dataFrame(3, false))
+	s.Push(dataFrame(1, false))
+	s.Push(dataFrame(1, true))
+
+	counts := popCounts(t, s, 2)
+	assert.Equal(t, counts[1], 2)
+
+	f, _ := s.Pop()
+	assert.Equal(t, frameStreamId(f), uint32(3))
+}
+
+func TestPriorityIdleStreamDoesNotCatchUp(t *testing.T) {
+	s := NewPriorityWriteScheduler()
+	s.OpenStream(1, defaultPriority)
+	s.OpenStream(3, defaultPriority)
+	for i := 0; i < 50; i++ {
+		s.Push(dataFrame(1, false))
+	}
+	popCounts(t, s, 40)
+
+	for i := 0; i < 50; i++ {
+		s.Push(dataFrame(3, false))
+	}
+	counts := popCounts(t, s, 10)
+	assert.Equal(t, counts[1], 5, "Stream 3 should not have been owed the bandwidth it did not use")
+	assert.Equal(t, counts[3], 5)
+}
+
+func TestPriorityExclusiveInsertion(t *testing.T) {
+	s := NewPriorityWriteScheduler()
+	s.OpenStream(1, defaultPriority)
+	s.OpenStream(3, defaultPriority)
+	s.Push(dataFrame(3, false))
+
+	s.OpenStream(5, PriorityParam{0, true, 15})
+
+	assert.Equal(t, childIds(s, 0), []uint32{5})
+	assert.Equal(t, childIds(s, 5), []uint32{1, 3})
+	assert.Equal(t, s.root.queued, 1)
+	assert.Equal(t, s.nodes[5].queued, 1)
+}
+
+func TestPriorityDependencyOnUnknownStream(t *testing.T) {
+	s := NewPriorityWriteScheduler()
+
+	assert.Nil(t, s.OpenStream(3, PriorityParam{7, true, 200}))
+	assert.Equal(t, childIds(s, 0), []uint32{3})
+	assert.Equal(t, s.nodes[3].weight, 16, "Stream should have been given the default priority")
+}
+
+func TestPriorityDependencyOnItself(t *testing.T) {
+	s := NewPriorityWriteScheduler()
+
+	assert.Equal(t, s.OpenStream(3, PriorityParam{3, false, 15}), StreamError{
+		3,
+		PROTOCOL_ERROR,
+		"Stream 3 cannot depend on itself",
+	})
+}
+
+func TestPriorityDependencyOnDescendant(t *testing.T) {
+	// http://tools.ietf.org/html/rfc7540#section-5.3.3
+	s := NewPriorityWriteScheduler()
+	s.OpenStream(1, defaultPriority)
+	s.OpenStream(3, PriorityParam{1, false, 15})
+	s.OpenStream(5, PriorityParam{3, false, 15})
+	s.Push(dataFrame(5, false))
+
+	assert.Nil(t, s.AdjustStream(1, PriorityParam{5, false, 15}))
+
+	assert.Equal(t, childIds(s, 0), []uint32{5})
+	assert.Equal(t, childIds(s, 5), []uint32{1})
+	assert.Equal(t, childIds(s, 1), []uint32{3})
+	assert.Equal(t, s.root.queued, 1)
+	assert.Equal(t, s.nodes[1].queued, 0)
+}
+
+func TestPriorityCloseStreamRedistributesWeight(t *testing.T) {
+	s := NewPriorityWriteScheduler()
+	s.OpenStream(1, PriorityParam{0, false, 15})
+	s.OpenStream(3, PriorityParam{1, false, 0})
+	s.OpenStream(5, PriorityParam{1, false, 2})
+	s.Push(dataFrame(1, false))
+	s.Push(dataFrame(5, false))
+
+	assert.Equal(t, s.CloseStream(1), []Frame{dataFrame(1, false)})
+
+	assert.Equal(t, childIds(s, 0), []uint32{3, 5})
+	assert.Equal(t, s.nodes[3].weight, 4)
+	assert.Equal(t, s.nodes[5].weight, 12)
+	assert.Equal(t, s.root.queued, 1, "Frames queued for the closed stream should have been dropped")
+
+	f, ok := s.Pop()
+	assert.True(t, ok)
+	assert.Equal(t, frameStreamId(f), uint32(5))
+}
+
+func TestPriorityLimitsIdleStreams(t *testing.T) {
+	s := NewPriorityWriteScheduler()
+	assert.Nil(t, s.Prioritize(headersFrame(1, false)))
+	for id := uint32(3); id < 2003; id += 2 {
+		assert.Nil(t, s.Prioritize(PRIORITY{StreamId: id, StreamDependency: id - 2, Weight: 15}))
+	}
+
+	assert.Equal(t, len(s.nodes), 1+1+maxIdlePriorityNodes)
+	assert.NotNil(t, s.nodes[1], "Open streams should not have been removed")
+	assert.NotNil(t, s.nodes[2001])
+	assert.Nil(t, s.nodes[3])
+
+	assert.Nil(t, s.Prioritize(headersFrame(2001, false)))
+	assert.Equal(t, len(s.idle), maxIdlePriorityNodes-1, "Opening the stream should have kept its node")
+}
+
+func TestPriorityPushForUnopenedStream(t *testing.T) {
+	s := NewPriorityWriteScheduler()
+	s.Push(dataFrame(7, false))
+
+	f, ok := s.Pop()
+	assert.True(t, ok)
+	assert.Equal(t, f, dataFrame(7, false))
+}
+
+func TestPriorityPrioritizeFromFrames(t *testing.T) {
+	s := NewPriorityWriteScheduler()
+	assert.Nil(t, s.Prioritize(headersFrame(1, false)))
+	assert.Nil(t, s.Prioritize(headersFrame(3, false)))
+
+	p := PRIORITY{StreamId: 3, StreamDependency: 1, Weight: 31}
+	assert.Nil(t, s.Prioritize(p))
+	assert.Equal(t, childIds(s, 1), []uint32{3})
+
+	assert.Nil(t, s.Prioritize(headersFrame(3, true)))
+	assert.Equal(t, childIds(s, 1), []uint32{3}, "Trailers should not have reprioritized the stream")
+	assert.Equal(t, s.nodes[3].weight, 32)
+
+	assert.Equal(t, s.Prioritize(PRIORITY{StreamId: 5, StreamDependency: 5}), StreamError{
+		5,
+		PROTOCOL_ERROR,
+		"Stream 5 cannot depend on itself",
+	})
+}
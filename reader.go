@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Limits on reassembling a header block, beyond which the peer is taken to
+// be flooding us with CONTINUATION frames.
+// http://tools.ietf.org/html/rfc9113#section-10.5
+const (
+	defaultMaxHeaderBlockSize = 1 << 20
+	maxContinuationFrames     = 1024
+)
+
+// HeaderBlock is a complete header block: a HEADERS or PUSH_PROMISE frame
+// together with any CONTINUATION frames that followed it on the same
+// stream, and the header fields it decoded to.
+type HeaderBlock struct {
+	StreamId uint32
+	// Frame is the HEADERS or PUSH_PROMISE frame that began the block, with
+	// the complete header block as its fragment and END_HEADERS set
+	Frame  Frame
+	Fields []HeaderField
+}
+
+func (f HeaderBlock) Marshal() []byte {
+	return f.Frame.Marshal()
+}
+
+// FrameReader reads frames from a connection, reassembling header blocks
+// that span CONTINUATION frames into a single HeaderBlock.
+// http://tools.ietf.org/html/rfc9113#section-4.3
+type FrameReader struct {
+	// MaxHeaderBlockSize is the largest header block that will be
+	// reassembled, before it is decoded
+	MaxHeaderBlockSize uint32
+
+	codec   FrameCodec
+	scanner *bufio.Scanner
+	decoder *Decoder
+	// frame is the frame the scanner last decoded
+	frame Frame
+}
+
+func NewFrameReader(r io.Reader, codec FrameCodec, decoder *Decoder) *FrameReader {
+	fr := &FrameReader{
+		MaxHeaderBlockSize: defaultMaxHeaderBlockSize,
+		codec:              codec,
+		decoder:            decoder,
+	}
+	fr.scanner = newFrameScanner(r, &fr.codec, &fr.frame)
+
+	return fr
+}
+
+// SetMaxFrameSize changes the largest frame payload accepted, once the
+// peer has acknowledged our SETTINGS_MAX_FRAME_SIZE.
+func (r *FrameReader) SetMaxFrameSize(size uint32) {
+	r.codec.MaxFrameSize = size
+}
+
+func (r *FrameReader) next() (Frame, error) {
+	if !r.scanner.Scan() {
+		if err := r.scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+
+	return r.frame, nil
+}
+
+// ReadFrame returns the next frame from the connection.  HEADERS and
+// PUSH_PROMISE frames are only returned once their header block is
+// complete, as a HeaderBlock.  A header list larger than the decoder
+// allows is returned, without its fields, together with a StreamError.
+func (r *FrameReader) ReadFrame() (Frame, error) {
+	f, err := r.next()
+	if err != nil {
+		return nil, err
+	}
+
+	var block HeaderBlock
+	var fragment strings.Builder
+	var endHeaders bool
+
+	switch f := f.(type) {
+	case HEADERS:
+		block.StreamId = f.StreamId
+		fragment.WriteString(f.HeaderBlockFragment)
+		endHeaders = f.Flags.END_HEADERS
+		block.Frame = f
+	case PUSH_PROMISE:
+		block.StreamId = f.StreamId
+		fragment.WriteString(f.HeaderBlockFragment)
+		endHeaders = f.Flags.END_HEADERS
+		block.Frame = f
+	case CONTINUATION:
+		return nil, ConnectionError{
+			PROTOCOL_ERROR,
+			fmt.Sprintf("CONTINUATION frame on stream %d did not follow a header block", f.StreamId),
+		}
+	default:
+		return f, nil
+	}
+
+	for frames := 0; !endHeaders; frames++ {
+		if frames == maxContinuationFrames {
+			return nil, ConnectionError{
+				ENHANCE_YOUR_CALM,
+				fmt.Sprintf("Header block on stream %d exceeded %d CONTINUATION frames", block.StreamId, maxContinuationFrames),
+			}
+		}
+
+		f, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+
+		c, ok := f.(CONTINUATION)
+		if !ok || c.StreamId != block.StreamId {
+			return nil, ConnectionError{
+				PROTOCOL_ERROR,
+				fmt.Sprintf("Header block on stream %d was interrupted by another frame", block.StreamId),
+			}
+		}
+		if fragment.Len()+len(c.HeaderBlockFragment) > int(r.MaxHeaderBlockSize) {
+			return nil, ConnectionError{
+				ENHANCE_YOUR_CALM,
+				fmt.Sprintf("Header block on stream %d exceeded %d bytes", block.StreamId, r.MaxHeaderBlockSize),
+			}
+		}
+		fragment.WriteString(c.HeaderBlockFragment)
+		endHeaders = c.Flags.END_HEADERS
+	}
+
+	switch f := block.Frame.(type) {
+	case HEADERS:
+		f.HeaderBlockFragment = fragment.String()
+		f.Flags.END_HEADERS = true
+		block.Frame = f
+	case PUSH_PROMISE:
+		f.HeaderBlockFragment = fragment.String()
+		f.Flags.END_HEADERS = true
+		block.Frame = f
+	}
+
+	block.Fields, err = r.decoder.Decode(fragment.String())
+	var sizeErr HeaderListSizeError
+	if errors.As(err, &sizeErr) {
+		// The block is returned as well, as it still opens its stream
+		streamId := block.StreamId
+		if p, ok := block.Frame.(PUSH_PROMISE); ok {
+			streamId = p.PromisedStreamId
+		}
+		return block, StreamError{streamId, REFUSED_STREAM, sizeErr.Error()}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return block, nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"strings"
+	"testing"
+)
+
+var readerFields = []HeaderField{
+	{Name: ":method", Value: "GET"},
+	{Name: ":scheme", Value: "https"},
+	{Name: ":path", Value: "/index.html"},
+	{Name: "custom-key", Value: "custom-value"},
+}
+
+func NewTestFrameReader(frames ...Frame) *FrameReader {
+	conn := NewMockConn()
+	for _, f := range frames {
+		conn.readData = append(conn.readData, f.Marshal())
+	}
+
+	return NewFrameReader(conn, FrameCodec{}, NewDecoder(defaultHeaderTableSize))
+}
+
+func TestFrameReaderReturnsOtherFrames(t *testing.T) {
+	r := NewTestFrameReader(PING{OpaqueData: 3957102})
+
+	f, err := r.ReadFrame()
+
+	assert.Nil(t, err)
+	assert.Equal(t, f, PING{OpaqueData: 3957102})
+}
+
+func TestFrameReaderDecodesSingleHEADERS(t *testing.T) {
+	block := NewEncoder(defaultHeaderTableSize).Encode(readerFields)
+	h := HEADERS{StreamId: 1, HeaderBlockFragment: block}
+	h.Flags.END_HEADERS = true
+	h.Flags.END_STREAM = true
+
+	r := NewTestFrameReader(h)
+	f, err := r.ReadFrame()
+
+	assert.Nil(t, err)
+	assert.Equal(t, f, HeaderBlock{StreamId: 1, Frame: h, Fields: readerFields})
+}
+
+func TestFrameReaderReassemblesCONTINUATION(t *testing.T) {
+	block := NewEncoder(defaultHeaderTableSize).Encode(readerFields)
+	h := HEADERS{StreamId: 3, HeaderBlockFragment: block[0:5]}
+	h.Flags.END_STREAM = true
+	c1 := CONTINUATION{StreamId: 3, HeaderBlockFragment: block[5:10]}
+	c2 := CONTINUATION{StreamId: 3, HeaderBlockFragment: block[10:]}
+	c2.Flags.END_HEADERS = true
+
+	r := NewTestFrameReader(h, c1, c2, PING{})
+	f, err := r.ReadFrame()
+
+	expected := h
+	expected.HeaderBlockFragment = block
+	expected.Flags.END_HEADERS = true
+
+	assert.Nil(t, err)
+	assert.Equal(t, f, HeaderBlock{StreamId: 3, Frame: expected, Fields: readerFields})
+
+	f, err = r.ReadFrame()
+	assert.Nil(t, err)
+	assert.Equal(t, f, PING{})
+}
+
+func TestFrameReaderReassemblesPUSH_PROMISE(t *testing.T) {
+	block := NewEncoder(defaultHeaderTableSize).Encode(readerFields)
+	p := PUSH_PROMISE{StreamId: 1, PromisedStreamId: 2, HeaderBlockFragment: block[0:3]}
+	c := CONTINUATION{StreamId: 1, HeaderBlockFragment: block[3:]}
+	c.Flags.END_HEADERS = true
+
+	r := NewTestFrameReader(p, c)
+	f, err := r.ReadFrame()
+
+	expected := p
+	expected.HeaderBlockFragment = block
+	expected.Flags.END_HEADERS = true
+
+	assert.Nil(t, err)
+	assert.Equal(t, f, HeaderBlock{StreamId: 1, Frame: expected, Fields: readerFields})
+}
+
+func TestFrameReaderRejectsInterleavedFrame(t *testing.T) {
+	block := NewEncoder(defaultHeaderTableSize).Encode(readerFields)
+	h := HEADERS{StreamId: 3, HeaderBlockFragment: block[0:5]}
+
+	r := NewTestFrameReader(h, PING{})
+	f, err := r.ReadFrame()
+
+	assert.Nil(t, f)
+	assert.Equal(t, err, ConnectionError{PROTOCOL_ERROR, "Header block on stream 3 was interrupted by another frame"})
+}
+
+func TestFrameReaderRejectsCONTINUATIONOnAnotherStream(t *testing.T) {
+	block := NewEncoder(defaultHeaderTableSize).Encode(readerFields)
+	h := HEADERS{StreamId: 3, HeaderBlockFragment: block[0:5]}
+	c := CONTINUATION{StreamId: 5, HeaderBlockFragment: block[5:]}
+	c.Flags.END_HEADERS = true
+
+	r := NewTestFrameReader(h, c)
+	f, err := r.ReadFrame()
+
+	assert.Nil(t, f)
+	assert.Equal(t, err, ConnectionError{PROTOCOL_ERROR, "Header block on stream 3 was interrupted by another frame"})
+}
+
+func TestFrameReaderRejectsUnexpectedCONTINUATION(t *testing.T) {
+	c := CONTINUATION{StreamId: 5, HeaderBlockFragment: "\x82"}
+	c.Flags.END_HEADERS = true
+
+	r := NewTestFrameReader(c)
+	f, err := r.ReadFrame()
+
+	assert.Nil(t, f)
+	assert.Equal(t, err, ConnectionError{PROTOCOL_ERROR, "CONTINUATION frame on stream 5 did not follow a header block"})
+}
+
+func TestFrameReaderReturnsCompressionError(t *testing.T) {
+	h := HEADERS{StreamId: 1, HeaderBlockFragment: "\xBE"}
+	h.Flags.END_HEADERS = true
+
+	r := NewTestFrameReader(h)
+	f, err := r.ReadFrame()
+
+	assert.Nil(t, f)
+	assert.Equal(t, err, ConnectionError{COMPRESSION_ERROR, "Invalid header table index: 62"})
+}
+
+func TestFrameReaderReturnsFrameErrors(t *testing.T) {
+	r := NewTestFrameReader(DATA{})
+	f, err := r.ReadFrame()
+
+	assert.Nil(t, f)
+	assert.Equal(t, err, ConnectionError{PROTOCOL_ERROR, "DATA frame must have stream identifier"})
+}
+
+func TestFrameReaderRejectsCONTINUATIONFlood(t *testing.T) {
+	frames := []Frame{HEADERS{StreamId: 1, HeaderBlockFragment: "a"}}
+	for i := 0; i < maxContinuationFrames+1; i++ {
+		frames = append(frames, CONTINUATION{StreamId: 1})
+	}
+	r := NewTestFrameReader(frames...)
+
+	f, err := r.ReadFrame()
+
+	assert.Nil(t, f)
+	assert.Equal(t, err, ConnectionError{ENHANCE_YOUR_CALM, "Header block on stream 1 exceeded 1024 CONTINUATION frames"})
+}
+
+func TestFrameReaderRejectsOversizeHeaderBlock(t *testing.T) {
+	r := NewTestFrameReader(
+		HEADERS{StreamId: 1, HeaderBlockFragment: strings.Repeat("a", 60)},
+		CONTINUATION{StreamId: 1, HeaderBlockFragment: strings.Repeat("a", 60)},
+	)
+	r.MaxHeaderBlockSize = 100
+
+	f, err := r.ReadFrame()
+
+	assert.Nil(t, f)
+	assert.Equal(t, err, ConnectionError{ENHANCE_YOUR_CALM, "Header block on stream 1 exceeded 100 bytes"})
+}
+
+func TestFrameReaderRejectsOversizeFrame(t *testing.T) {
+	r := NewTestFrameReader(DATA{StreamId: 1, Data: strings.Repeat("a", defaultMaxFrameSize+1)})
+	f, err := r.ReadFrame()
+
+	assert.Nil(t, f)
+	assert.Equal(t, err, ConnectionError{FRAME_SIZE_ERROR, "Frame length of 16385 exceeded the maximum frame size of 16384"})
+}
+
+func TestFrameReaderSetMaxFrameSize(t *testing.T) {
+	large := DATA{StreamId: 1, Data: strings.Repeat("a", defaultMaxFrameSize+1)}
+	r := NewTestFrameReader(PING{}, large)
+
+	_, err := r.ReadFrame()
+	assert.Nil(t, err)
+
+	r.SetMaxFrameSize(defaultMaxFrameSize + 1)
+	f, err := r.ReadFrame()
+	assert.Nil(t, err)
+	assert.Equal(t, f, large)
+}
+
+func TestFrameReaderEOF(t *testing.T) {
+	r := NewFrameReader(&eofReader{}, FrameCodec{}, NewDecoder(defaultHeaderTableSize))
+	f, err := r.ReadFrame()
+
+	assert.Nil(t, f)
+	assert.Equal(t, err, io.EOF)
+}
+
+type eofReader struct{}
+
+func (r *eofReader) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func TestFrameReaderDecodesEachFrameOnce(t *testing.T) {
+	decoded := 0
+	decode := func(c FrameCodec, frameFlags uint8, streamId uint32, payload string) (Frame, error) {
+		decoded++
+		return ALTSVC{streamId, payload}, nil
+	}
+	assert.Nil(t, RegisterFrameType(0xA, decode))
+	defer delete(extensionFrameTypes, 0xA)
+
+	r := NewFrameReader(strings.NewReader(string(ALTSVC{1, "origin"}.Marshal())), FrameCodec{}, NewDecoder(defaultHeaderTableSize))
+	f, err := r.ReadFrame()
+
+	assert.Nil(t, err)
+	assert.Equal(t, f, ALTSVC{1, "origin"})
+	assert.Equal(t, decoded, 1)
+}
@@ -4,7 +4,7 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"strings"
+	"sync"
 )
 
 var _ = fmt.Printf // package fmt is now used
@@ -16,44 +16,82 @@ type Conn interface {
 }
 
 type Server struct {
+	Config
+
+	mu           sync.Mutex
+	conns        map[*Connection]struct{}
+	shuttingDown bool
 }
 
 const preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
 
-func (s *Server) InitiateConn(conn Conn) error {
-	scanner := bufio.NewScanner(conn)
-	str := ""
+// InitiateConn reads the client connection preface and exchanges SETTINGS
+// frames.  If the client does not follow the protocol the connection is
+// closed with a GOAWAY frame.
+// http://tools.ietf.org/html/rfc9113#section-3.4
+func (s *Server) InitiateConn(conn Conn) (*Connection, error) {
+	r := bufio.NewReader(conn)
 
 	// TODO: connection upgrade from HTTP 1.0
-	for stopped := scanner.Scan(); stopped != false; stopped = scanner.Scan() {
-		str += scanner.Text() + "\r\n"
-		if !strings.HasPrefix(preface, str) {
-			f := GOAWAY{0, 1, "Did not include connection preface"}
-			conn.Write(f.Marshal())
-			conn.Close()
-			return nil
-		}
+	if err := readPreface(r); err != nil {
+		err := ConnectionError{PROTOCOL_ERROR, "Did not include connection preface"}
+		conn.Write(GOAWAY{0, err.Code, err.Message}.Marshal())
+		conn.Close()
+		return nil, err
+	}
 
-		if preface == str {
-			break
-		}
+	c := newConnection(conn, r, s.Clock, true)
+	if err := s.start(c); err != nil {
+		c.closeWithError(err)
+		return nil, err
 	}
 
-	conn.Write([]byte(preface))
-	// TODO: SETTINGS frame
+	if !s.track(c) {
+		c.Close()
+		return nil, ErrServerClosed
+	}
 
-	return nil
+	return c, nil
 }
 
-func NewFrameScanner(r io.Reader) *bufio.Scanner {
-	s := bufio.NewScanner(r)
-	s.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
-		advance, f, err := Unmarshal(data)
-		if f != nil || err != nil {
-			return advance, data[0:advance], err
+// track registers a connection until it closes, unless the server is
+// shutting down.
+func (s *Server) track(c *Connection) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.shuttingDown {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[*Connection]struct{})
+	}
+	s.conns[c] = struct{}{}
+	c.onClose = func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+	}
+
+	return true
+}
+
+// readPreface consumes exactly the connection preface, leaving anything the
+// client sent after it buffered in r for the frame reader.
+func readPreface(r *bufio.Reader) error {
+	for i := 0; i < len(preface); i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b != preface[i] {
+			return ConnectionError{PROTOCOL_ERROR, "Did not include connection preface"}
 		}
+	}
 
-		return 0, nil, nil
-	})
-	return s
+	return nil
+}
+
+func NewFrameScanner(r io.Reader) *bufio.Scanner {
+	return FrameCodec{}.NewFrameScanner(r)
 }
@@ -2,31 +2,65 @@ package main
 
 import (
 	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync"
 	"testing"
 )
 
 type MockConn struct {
+	// mu guards written and closed when a test writes from another goroutine
+	mu       sync.Mutex
 	readData [][]byte
 	written  []byte
 	closed   bool
+	// writeErr fails every Write when set
+	writeErr error
 }
 
 func (c *MockConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	c.closed = true
 	return nil
 }
 
+func (c *MockConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.closed
+}
+
+// writtenFrames reads back everything written so far.
+func (c *MockConn) writtenFrames(t *testing.T) []Frame {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return readAllFrames(t, c.written)
+}
+
 func (c *MockConn) Read(b []byte) (int, error) {
 	if len(c.readData) == 0 {
 		return 0, nil
 	}
 	n := copy(b, c.readData[0])
-	c.readData = c.readData[1:]
+	if n < len(c.readData[0]) {
+		c.readData[0] = c.readData[0][n:]
+	} else {
+		c.readData = c.readData[1:]
+	}
 
 	return n, nil
 }
 
 func (c *MockConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.writeErr != nil {
+		return 0, c.writeErr
+	}
 	c.written = append(c.written, b...)
 	return len(b), nil
 }
@@ -38,9 +72,9 @@ func NewMockConn() *MockConn {
 	return conn
 }
 
-func NewTestServer() (Server, *MockConn) {
+func NewTestServer() (*Server, *MockConn) {
 	conn := NewMockConn()
-	s := Server{}
+	s := &Server{}
 
 	return s, conn
 }
@@ -52,23 +86,166 @@ func TestInitiateConnWithoutPreface(t *testing.T) {
 	bytes := f.Marshal()
 
 	conn.readData = [][]byte{[]byte("not the preface")}
-	server.InitiateConn(conn)
+	_, err := server.InitiateConn(conn)
 
+	assert.Equal(t, err, ConnectionError{PROTOCOL_ERROR, "Did not include connection preface"})
 	assert.Equal(t, conn.written, bytes)
 	assert.True(t, conn.closed, "Should have closed the connection")
 }
 
-func TestRespondWithThePreface(t *testing.T) {
-	server, conn := NewTestServer()
+func settingsAck() SETTINGS {
+	f := SETTINGS{}
+	f.Flags.ACK = true
+	return f
+}
+
+func pingAck(data uint64) PING {
+	ack := PING{OpaqueData: data}
+	ack.Flags.ACK = true
+	return ack
+}
 
-	// also needs to write settings frame too.
-	preface := "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+func TestInitiateConnExchangesSettings(t *testing.T) {
+	server, conn := NewTestServer()
+	server.Settings = []Parameter{{SETTINGS_MAX_CONCURRENT_STREAMS, 100}}
 
-	conn.readData = [][]byte{[]byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")}
-	server.InitiateConn(conn)
+	clientSettings := SETTINGS{Parameters: []Parameter{{SETTINGS_INITIAL_WINDOW_SIZE, 1048576}}}
+	conn.readData = [][]byte{[]byte(preface), clientSettings.Marshal()}
+	c, err := server.InitiateConn(conn)
 
-	assert.Equal(t, conn.written, []byte(preface))
+	assert.Nil(t, err)
+	assert.Equal(t, readAllFrames(t, conn.written), []Frame{
+		SETTINGS{Parameters: server.Settings},
+		settingsAck(),
+	}, "Should have sent our SETTINGS and acknowledged the client's, without echoing the preface")
 	assert.False(t, conn.closed)
+
+	value, ok := c.PeerSetting(SETTINGS_INITIAL_WINDOW_SIZE)
+	assert.True(t, ok)
+	assert.Equal(t, value, uint32(1048576))
+
+	value, ok = c.PeerSetting(SETTINGS_ENABLE_PUSH)
+	assert.True(t, ok)
+	assert.Equal(t, value, uint32(1), "Unsent settings should have their default values")
+
+	_, ok = c.PeerSetting(SETTINGS_MAX_CONCURRENT_STREAMS)
+	assert.False(t, ok, "SETTINGS_MAX_CONCURRENT_STREAMS should have been unlimited")
+}
+
+func TestInitiateConnWithEmptySettings(t *testing.T) {
+	server, conn := NewTestServer()
+
+	conn.readData = [][]byte{[]byte(preface), SETTINGS{}.Marshal()}
+	c, err := server.InitiateConn(conn)
+
+	assert.Nil(t, err)
+	assert.NotNil(t, c)
+	assert.Equal(t, readAllFrames(t, conn.written), []Frame{SETTINGS{}, settingsAck()})
+}
+
+func TestInitiateConnAppliesHeaderTableSize(t *testing.T) {
+	server, conn := NewTestServer()
+
+	clientSettings := SETTINGS{Parameters: []Parameter{{SETTINGS_HEADER_TABLE_SIZE, 0}}}
+	conn.readData = [][]byte{[]byte(preface), clientSettings.Marshal()}
+	c, err := server.InitiateConn(conn)
+
+	assert.Nil(t, err)
+	assert.Equal(t, c.encoder.Encode([]HeaderField{{Name: ":status", Value: "200"}}), "\x20\x88",
+		"Encoder should have signalled the client's smaller table size")
+}
+
+func TestInitiateConnWithoutSettings(t *testing.T) {
+	server, conn := NewTestServer()
+
+	conn.readData = [][]byte{[]byte(preface), PING{}.Marshal()}
+	c, err := server.InitiateConn(conn)
+
+	expectedError := ConnectionError{PROTOCOL_ERROR, "First frame from the peer must be SETTINGS"}
+	assert.Nil(t, c)
+	assert.Equal(t, err, expectedError)
+	assert.Equal(t, readAllFrames(t, conn.written), []Frame{
+		SETTINGS{},
+		GOAWAY{0, PROTOCOL_ERROR, expectedError.Message},
+	})
+	assert.True(t, conn.closed, "Should have closed the connection")
+}
+
+func TestInitiateConnWithSettingsAck(t *testing.T) {
+	server, conn := NewTestServer()
+
+	conn.readData = [][]byte{[]byte(preface), settingsAck().Marshal()}
+	_, err := server.InitiateConn(conn)
+
+	assert.Equal(t, err, ConnectionError{PROTOCOL_ERROR, "First frame from the peer must be SETTINGS"})
+	assert.True(t, conn.closed, "Should have closed the connection")
+}
+
+func TestInitiateConnWithIncompletePreface(t *testing.T) {
+	server, conn := NewTestServer()
+
+	conn.readData = [][]byte{[]byte("PRI * HTTP/2.0\r\n")}
+	_, err := server.InitiateConn(conn)
+
+	assert.Equal(t, err, ConnectionError{PROTOCOL_ERROR, "Did not include connection preface"})
+	assert.True(t, conn.closed, "Should have closed the connection")
+}
+
+func TestInitiateConnWithPrefaceAndSettingsInOneRead(t *testing.T) {
+	server, conn := NewTestServer()
+
+	clientSettings := SETTINGS{Parameters: []Parameter{{SETTINGS_INITIAL_WINDOW_SIZE, 0x0A0D0A0D}}}
+	ping := PING{OpaqueData: 0x0D0A0D0A0D0A0D0A}
+	wire := append([]byte(preface), clientSettings.Marshal()...)
+	conn.readData = [][]byte{append(wire, ping.Marshal()...)}
+	c, err := server.InitiateConn(conn)
+
+	assert.Nil(t, err)
+	value, _ := c.PeerSetting(SETTINGS_INITIAL_WINDOW_SIZE)
+	assert.Equal(t, value, uint32(0x0A0D0A0D),
+		"SETTINGS containing line endings should have survived preface detection")
+
+	f, err := c.reader.ReadFrame()
+	assert.Nil(t, err)
+	assert.Equal(t, f, ping, "Frames buffered after SETTINGS should have been preserved")
+}
+
+func TestInitiateConnWithPrefaceSplitAcrossReads(t *testing.T) {
+	server, conn := NewTestServer()
+
+	wire := append([]byte(preface), SETTINGS{}.Marshal()...)
+	conn.readData = [][]byte{wire[0:5], wire[5:17], wire[17:26], wire[26:]}
+	c, err := server.InitiateConn(conn)
+
+	assert.Nil(t, err)
+	assert.NotNil(t, c)
+	assert.Equal(t, readAllFrames(t, conn.written), []Frame{SETTINGS{}, settingsAck()})
+}
+
+func TestInitiateConnWithPrefaceFollowedByFrameSplitAcrossReads(t *testing.T) {
+	server, conn := NewTestServer()
+
+	wire := append([]byte(preface), SETTINGS{}.Marshal()...)
+	conn.readData = [][]byte{wire[0:30], wire[30:]}
+	c, err := server.InitiateConn(conn)
+
+	assert.Nil(t, err)
+	assert.NotNil(t, c)
+}
+
+func TestInitiateConnWithCorruptPreface(t *testing.T) {
+	server, conn := NewTestServer()
+
+	wire := []byte(preface)
+	wire[strings.Index(preface, "M")] = '\n'
+	conn.readData = [][]byte{append(wire, SETTINGS{}.Marshal()...)}
+	_, err := server.InitiateConn(conn)
+
+	assert.Equal(t, err, ConnectionError{PROTOCOL_ERROR, "Did not include connection preface"})
+	assert.Equal(t, readAllFrames(t, conn.written), []Frame{
+		GOAWAY{0, PROTOCOL_ERROR, "Did not include connection preface"},
+	})
+	assert.True(t, conn.closed, "Should have closed the connection")
 }
 
 func TestFrameScannerReturnsAFrame(t *testing.T) {
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// Unlimited is the value of SETTINGS_MAX_CONCURRENT_STREAMS and
+// SETTINGS_MAX_HEADER_LIST_SIZE before either is advertised.
+const Unlimited = math.MaxUint32
+
+// Settings are the values of all the parameters an endpoint has advertised
+// in SETTINGS frames.
+// http://tools.ietf.org/html/rfc9113#section-6.5.2
+type Settings struct {
+	HeaderTableSize       uint32
+	EnablePush            bool
+	MaxConcurrentStreams  uint32
+	InitialWindowSize     uint32
+	MaxFrameSize          uint32
+	MaxHeaderListSize     uint32
+	EnableConnectProtocol bool
+	NoRFC7540Priorities   bool
+	// Extensions are the values of settings without a field above
+	Extensions map[uint16]uint32
+}
+
+// DefaultSettings returns the values that apply before any SETTINGS frame
+// has been sent.
+func DefaultSettings() Settings {
+	return Settings{
+		HeaderTableSize:      defaultHeaderTableSize,
+		EnablePush:           true,
+		MaxConcurrentStreams: Unlimited,
+		InitialWindowSize:    defaultInitialWindowSize,
+		MaxFrameSize:         minMaxFrameSize,
+		MaxHeaderListSize:    Unlimited,
+	}
+}
+
+// Merge returns s with parameters applied in order, as if they had been
+// received in a SETTINGS frame.  The settings advertised by a single frame
+// are DefaultSettings().Merge(f.Parameters).
+func (s Settings) Merge(parameters []Parameter) Settings {
+	merged := s.clone()
+	for _, parameter := range parameters {
+		merged.set(parameter)
+	}
+
+	return merged
+}
+
+// Diff returns the parameters that change s into to, ordered by identifier.
+// Extension settings missing from to are left as they are, as a SETTINGS
+// frame cannot remove them.
+func (s Settings) Diff(to Settings) []Parameter {
+	parameters := []Parameter{}
+	for _, parameter := range to.parameters() {
+		if value, ok := s.value(parameter.Id); !ok || value != parameter.Value {
+			parameters = append(parameters, parameter)
+		}
+	}
+
+	return parameters
+}
+
+// Frame returns the smallest SETTINGS frame that advertises s to a peer
+// that has received no other SETTINGS.
+func (s Settings) Frame() SETTINGS {
+	return SETTINGS{Parameters: DefaultSettings().Diff(s)}
+}
+
+// Get returns the value of a setting, and whether it has one; the limits
+// that are Unlimited have none.
+func (s Settings) Get(id uint16) (uint32, bool) {
+	value, ok := s.value(id)
+	if ok && value == Unlimited &&
+		(id == SETTINGS_MAX_CONCURRENT_STREAMS || id == SETTINGS_MAX_HEADER_LIST_SIZE) {
+		return 0, false
+	}
+
+	return value, ok
+}
+
+func (s Settings) value(id uint16) (uint32, bool) {
+	switch id {
+	case SETTINGS_HEADER_TABLE_SIZE:
+		return s.HeaderTableSize, true
+	case SETTINGS_ENABLE_PUSH:
+		return boolSetting(s.EnablePush), true
+	case SETTINGS_MAX_CONCURRENT_STREAMS:
+		return s.MaxConcurrentStreams, true
+	case SETTINGS_INITIAL_WINDOW_SIZE:
+		return s.InitialWindowSize, true
+	case SETTINGS_MAX_FRAME_SIZE:
+		return s.MaxFrameSize, true
+	case SETTINGS_MAX_HEADER_LIST_SIZE:
+		return s.MaxHeaderListSize, true
+	case SETTINGS_ENABLE_CONNECT_PROTOCOL:
+		return boolSetting(s.EnableConnectProtocol), true
+	case SETTINGS_NO_RFC7540_PRIORITIES:
+		return boolSetting(s.NoRFC7540Priorities), true
+	}
+
+	value, ok := s.Extensions[id]
+	return value, ok
+}
+
+// set changes a single setting.  s.Extensions must not be shared.
+func (s *Settings) set(parameter Parameter) {
+	switch parameter.Id {
+	case SETTINGS_HEADER_TABLE_SIZE:
+		s.HeaderTableSize = parameter.Value
+	case SETTINGS_ENABLE_PUSH:
+		s.EnablePush = parameter.Value != 0
+	case SETTINGS_MAX_CONCURRENT_STREAMS:
+		s.MaxConcurrentStreams = parameter.Value
+	case SETTINGS_INITIAL_WINDOW_SIZE:
+		s.InitialWindowSize = parameter.Value
+	case SETTINGS_MAX_FRAME_SIZE:
+		s.MaxFrameSize = parameter.Value
+	case SETTINGS_MAX_HEADER_LIST_SIZE:
+		s.MaxHeaderListSize = parameter.Value
+	case SETTINGS_ENABLE_CONNECT_PROTOCOL:
+		s.EnableConnectProtocol = parameter.Value != 0
+	case SETTINGS_NO_RFC7540_PRIORITIES:
+		s.NoRFC7540Priorities = parameter.Value != 0
+	default:
+		if s.Extensions == nil {
+			s.Extensions = make(map[uint16]uint32)
+		}
+		s.Extensions[parameter.Id] = parameter.Value
+	}
+}
+
+// parameters lists every setting in s, ordered by identifier.
+func (s Settings) parameters() []Parameter {
+	parameters := []Parameter{
+		{SETTINGS_HEADER_TABLE_SIZE, s.HeaderTableSize},
+		{SETTINGS_ENABLE_PUSH, boolSetting(s.EnablePush)},
+		{SETTINGS_MAX_CONCURRENT_STREAMS, s.MaxConcurrentStreams},
+		{SETTINGS_INITIAL_WINDOW_SIZE, s.InitialWindowSize},
+		{SETTINGS_MAX_FRAME_SIZE, s.MaxFrameSize},
+		{SETTINGS_MAX_HEADER_LIST_SIZE, s.MaxHeaderListSize},
+		{SETTINGS_ENABLE_CONNECT_PROTOCOL, boolSetting(s.EnableConnectProtocol)},
+		{SETTINGS_NO_RFC7540_PRIORITIES, boolSetting(s.NoRFC7540Priorities)},
+	}
+	for id, value := range s.Extensions {
+		parameters = append(parameters, Parameter{id, value})
+	}
+	sort.Slice(parameters, func(i, j int) bool {
+		return parameters[i].Id < parameters[j].Id
+	})
+
+	return parameters
+}
+
+func (s Settings) clone() Settings {
+	if s.Extensions != nil {
+		extensions := make(map[uint16]uint32, len(s.Extensions))
+		for id, value := range s.Extensions {
+			extensions[id] = value
+		}
+		s.Extensions = extensions
+	}
+
+	return s
+}
+
+func boolSetting(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
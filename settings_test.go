@@ -0,0 +1,76 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDefaultSettingsFrameIsEmpty(t *testing.T) {
+	assert.Equal(t, DefaultSettings().Frame(), SETTINGS{Parameters: []Parameter{}})
+}
+
+func TestSettingsFrameRoundTrip(t *testing.T) {
+	s := DefaultSettings()
+	s.EnablePush = false
+	s.MaxConcurrentStreams = 100
+	s.MaxFrameSize = 1 << 20
+	s.Extensions = map[uint16]uint32{0x0a0a: 3}
+
+	f := s.Frame()
+	assert.Equal(t, f.Parameters, []Parameter{
+		{SETTINGS_ENABLE_PUSH, 0},
+		{SETTINGS_MAX_CONCURRENT_STREAMS, 100},
+		{SETTINGS_MAX_FRAME_SIZE, 1 << 20},
+		{0x0a0a, 3},
+	})
+
+	_, uf, err := Unmarshal(f.Marshal())
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultSettings().Merge(uf.(SETTINGS).Parameters), s)
+}
+
+func TestSettingsMergeAppliesParametersInOrder(t *testing.T) {
+	s := DefaultSettings().Merge([]Parameter{
+		{SETTINGS_INITIAL_WINDOW_SIZE, 1000},
+		{SETTINGS_ENABLE_CONNECT_PROTOCOL, 1},
+		{SETTINGS_INITIAL_WINDOW_SIZE, 2000},
+	})
+
+	assert.Equal(t, s.InitialWindowSize, uint32(2000))
+	assert.True(t, s.EnableConnectProtocol)
+}
+
+func TestSettingsMergeDoesNotShareExtensions(t *testing.T) {
+	s := DefaultSettings().Merge([]Parameter{{0x0a0a, 1}})
+	merged := s.Merge([]Parameter{{0x0a0a, 2}})
+
+	assert.Equal(t, s.Extensions[0x0a0a], uint32(1))
+	assert.Equal(t, merged.Extensions[0x0a0a], uint32(2))
+}
+
+func TestSettingsDiff(t *testing.T) {
+	from := DefaultSettings().Merge([]Parameter{{SETTINGS_HEADER_TABLE_SIZE, 256}, {0x0a0a, 1}})
+	to := from
+	to.HeaderTableSize = 512
+	to.NoRFC7540Priorities = true
+	to.Extensions = nil
+
+	assert.Equal(t, from.Diff(to), []Parameter{
+		{SETTINGS_HEADER_TABLE_SIZE, 512},
+		{SETTINGS_NO_RFC7540_PRIORITIES, 1},
+	}, "Removed extension settings cannot be sent")
+	assert.Equal(t, to.Diff(to), []Parameter{})
+}
+
+func TestSettingsGetUnlimited(t *testing.T) {
+	s := DefaultSettings()
+
+	_, ok := s.Get(SETTINGS_MAX_CONCURRENT_STREAMS)
+	assert.False(t, ok)
+	_, ok = s.Get(0x0a0a)
+	assert.False(t, ok)
+
+	value, ok := s.Get(SETTINGS_MAX_FRAME_SIZE)
+	assert.True(t, ok)
+	assert.Equal(t, value, uint32(minMaxFrameSize))
+}
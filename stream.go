@@ -0,0 +1,515 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// http://tools.ietf.org/html/rfc9113#section-5.1
+type StreamState uint8
+
+const (
+	StreamIdle StreamState = iota
+	StreamReservedLocal
+	StreamReservedRemote
+	StreamOpen
+	StreamHalfClosedLocal
+	StreamHalfClosedRemote
+	StreamClosed
+)
+
+var streamStateNames = map[StreamState]string{
+	StreamIdle:             "idle",
+	StreamReservedLocal:    "reserved (local)",
+	StreamReservedRemote:   "reserved (remote)",
+	StreamOpen:             "open",
+	StreamHalfClosedLocal:  "half-closed (local)",
+	StreamHalfClosedRemote: "half-closed (remote)",
+	StreamClosed:           "closed",
+}
+
+func (s StreamState) String() string {
+	if name, ok := streamStateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown (%d)", uint8(s))
+}
+
+// How a stream became closed decides what the peer may still send on it.
+// http://tools.ietf.org/html/rfc9113#section-5.1
+type closeReason uint8
+
+const (
+	closedByEndStream closeReason = iota
+	closedByLocalReset
+	closedByRemoteReset
+)
+
+// Stream tracks the state of a single stream as frames are sent and
+// received on it.  Callers must serialize calls to Send and Receive.
+type Stream struct {
+	Id uint32
+
+	state       StreamState
+	closeReason closeReason
+
+	// Flow-control windows, which can become negative when
+	// SETTINGS_INITIAL_WINDOW_SIZE is reduced
+	sendWindow int64
+	recvWindow int64
+	// recvConsumed is data the application has consumed that has not yet
+	// been returned to the peer with WINDOW_UPDATE
+	recvConsumed int64
+}
+
+func NewStream(id uint32) *Stream {
+	return &Stream{
+		Id:         id,
+		sendWindow: defaultInitialWindowSize,
+		recvWindow: defaultInitialWindowSize,
+	}
+}
+
+func (s *Stream) State() StreamState {
+	return s.state
+}
+
+// Send moves the stream to its next state when we send f, returning an
+// error without changing state if f cannot be sent in the current one.
+// A PUSH_PROMISE reserves the stream when its PromisedStreamId is ours.
+func (s *Stream) Send(f Frame) error {
+	f = unwrapHeaderBlock(f)
+
+	if pp, ok := f.(PUSH_PROMISE); ok && pp.PromisedStreamId == s.Id {
+		if s.state != StreamIdle {
+			return s.sendError(f)
+		}
+		s.state = StreamReservedLocal
+		return nil
+	}
+
+	if _, ok := f.(RST_STREAM); ok {
+		if s.state == StreamIdle || s.state == StreamClosed {
+			return s.sendError(f)
+		}
+		s.close(closedByLocalReset)
+		return nil
+	}
+
+	if _, ok := f.(PRIORITY); ok {
+		return nil
+	}
+
+	switch s.state {
+	case StreamIdle:
+		if _, ok := f.(HEADERS); !ok {
+			return s.sendError(f)
+		}
+		s.state = StreamOpen
+	case StreamReservedLocal:
+		if _, ok := f.(HEADERS); !ok {
+			return s.sendError(f)
+		}
+		s.state = StreamHalfClosedRemote
+	case StreamReservedRemote:
+		if _, ok := f.(WINDOW_UPDATE); !ok {
+			return s.sendError(f)
+		}
+	case StreamOpen, StreamHalfClosedRemote:
+		if _, ok := f.(PUSH_PROMISE); ok {
+			// Promises are sent on the stream that they are associated with
+			// http://tools.ietf.org/html/rfc9113#section-8.4
+			return nil
+		}
+	case StreamHalfClosedLocal:
+		if _, ok := f.(WINDOW_UPDATE); !ok {
+			return s.sendError(f)
+		}
+	case StreamClosed:
+		return s.sendError(f)
+	}
+
+	if hasEndStream(f) {
+		s.endStream(StreamHalfClosedLocal, StreamHalfClosedRemote)
+	}
+
+	return nil
+}
+
+// Receive moves the stream to its next state when the peer sends f.  A
+// frame that is not allowed in the current state results in a StreamError
+// or ConnectionError, as the RFC requires.
+func (s *Stream) Receive(f Frame) error {
+	f = unwrapHeaderBlock(f)
+
+	if pp, ok := f.(PUSH_PROMISE); ok {
+		if pp.PromisedStreamId == s.Id {
+			if s.state != StreamIdle {
+				return s.protocolError(f)
+			}
+			s.state = StreamReservedRemote
+			return nil
+		}
+
+		// http://tools.ietf.org/html/rfc9113#section-6.6
+		if s.state != StreamOpen && s.state != StreamHalfClosedLocal {
+			return s.protocolError(f)
+		}
+		return nil
+	}
+
+	if _, ok := f.(PRIORITY); ok {
+		return nil
+	}
+
+	_, isReset := f.(RST_STREAM)
+	_, isWindowUpdate := f.(WINDOW_UPDATE)
+
+	switch s.state {
+	case StreamIdle:
+		if _, ok := f.(HEADERS); !ok {
+			return s.protocolError(f)
+		}
+		s.state = StreamOpen
+	case StreamReservedLocal:
+		if !isReset && !isWindowUpdate {
+			return s.protocolError(f)
+		}
+	case StreamReservedRemote:
+		if _, ok := f.(HEADERS); ok {
+			s.state = StreamHalfClosedLocal
+		} else if !isReset {
+			return s.protocolError(f)
+		}
+	case StreamHalfClosedRemote:
+		if !isReset && !isWindowUpdate {
+			return StreamError{
+				s.Id,
+				STREAM_CLOSED,
+				fmt.Sprintf("Received %s frame on half-closed stream %d", frameName(f), s.Id),
+			}
+		}
+	case StreamClosed:
+		return s.receiveOnClosed(f)
+	}
+
+	if isReset {
+		s.close(closedByRemoteReset)
+		return nil
+	}
+
+	if hasEndStream(f) {
+		s.endStream(StreamHalfClosedRemote, StreamHalfClosedLocal)
+	}
+
+	return nil
+}
+
+func (s *Stream) receiveOnClosed(f Frame) error {
+	switch s.closeReason {
+	case closedByLocalReset:
+		// The peer may not have seen our RST_STREAM yet
+		return nil
+	case closedByRemoteReset:
+		return StreamError{
+			s.Id,
+			STREAM_CLOSED,
+			fmt.Sprintf("Received %s frame on stream %d after RST_STREAM", frameName(f), s.Id),
+		}
+	}
+
+	switch f.(type) {
+	case WINDOW_UPDATE, RST_STREAM:
+		// These can cross an END_STREAM we have just sent
+		return nil
+	}
+
+	return ConnectionError{
+		STREAM_CLOSED,
+		fmt.Sprintf("Received %s frame on closed stream %d", frameName(f), s.Id),
+	}
+}
+
+// endStream half-closes an open stream, or closes a stream that was
+// already half-closed from the other side.
+func (s *Stream) endStream(halfClosed StreamState, otherHalfClosed StreamState) {
+	switch s.state {
+	case StreamOpen:
+		s.state = halfClosed
+	case otherHalfClosed:
+		s.close(closedByEndStream)
+	}
+}
+
+func (s *Stream) close(reason closeReason) {
+	s.state = StreamClosed
+	s.closeReason = reason
+}
+
+func (s *Stream) sendError(f Frame) error {
+	return fmt.Errorf("Cannot send %s frame on %s stream %d", frameName(f), s.state, s.Id)
+}
+
+func (s *Stream) protocolError(f Frame) error {
+	return ConnectionError{
+		PROTOCOL_ERROR,
+		fmt.Sprintf("Received %s frame on %s stream %d", frameName(f), s.state, s.Id),
+	}
+}
+
+func unwrapHeaderBlock(f Frame) Frame {
+	if hb, ok := f.(HeaderBlock); ok {
+		return hb.Frame
+	}
+	return f
+}
+
+func hasEndStream(f Frame) bool {
+	switch f := f.(type) {
+	case DATA:
+		return f.Flags.END_STREAM
+	case HEADERS:
+		return f.Flags.END_STREAM
+	}
+	return false
+}
+
+func frameName(f Frame) string {
+	return reflect.TypeOf(f).Name()
+}
+
+// http://tools.ietf.org/html/rfc9113#section-5.1.1
+const maxStreamId = 1<<31 - 1
+
+// maxClosedStreams is how many closed streams the registry remembers the
+// closing of.  Frames on streams closed before those are ignored.
+const maxClosedStreams = 128
+
+// ErrStreamIdsExhausted means no more streams can be opened on this
+// connection; it should be shut down and replaced with a new one.
+var ErrStreamIdsExhausted = errors.New("Stream identifiers exhausted")
+
+// streamRegistry tracks the live streams on a connection and checks that
+// stream identifiers are used in order.  Clients initiate odd-numbered
+// streams and servers even-numbered ones.
+// http://tools.ietf.org/html/rfc9113#section-5.1.1
+type streamRegistry struct {
+	server  bool
+	streams map[uint32]*Stream
+
+	nextLocalId uint32
+	// lastLocalId and lastPeerId are the highest identifiers that have
+	// left the idle state on each side
+	lastLocalId uint32
+	lastPeerId  uint32
+
+	// The SETTINGS_INITIAL_WINDOW_SIZE values that new streams start with
+	initialSendWindow int64
+	initialRecvWindow int64
+
+	// closed records how the most recently closed streams were closed,
+	// oldest first in closedOrder
+	closed      map[uint32]closeReason
+	closedOrder []uint32
+}
+
+func newStreamRegistry(server bool) *streamRegistry {
+	r := &streamRegistry{
+		server:      server,
+		streams:     make(map[uint32]*Stream),
+		closed:      make(map[uint32]closeReason),
+		nextLocalId: 1,
+
+		initialSendWindow: defaultInitialWindowSize,
+		initialRecvWindow: defaultInitialWindowSize,
+	}
+	if server {
+		r.nextLocalId = 2
+	}
+
+	return r
+}
+
+func (r *streamRegistry) isLocal(id uint32) bool {
+	return (id%2 == 0) == r.server
+}
+
+// newLocalStream allocates the next identifier for a stream of our own.
+func (r *streamRegistry) newLocalStream() (*Stream, error) {
+	if r.nextLocalId > maxStreamId {
+		return nil, ErrStreamIdsExhausted
+	}
+
+	s := r.newStream(r.nextLocalId)
+	r.nextLocalId += 2
+	r.streams[s.Id] = s
+
+	return s, nil
+}
+
+// newPeerStream registers a stream that the peer has opened or promised.
+func (r *streamRegistry) newPeerStream(id uint32) (*Stream, error) {
+	if r.isLocal(id) {
+		return nil, ConnectionError{
+			PROTOCOL_ERROR,
+			fmt.Sprintf("Stream %d cannot be initiated by the peer", id),
+		}
+	}
+	if id <= r.lastPeerId {
+		return nil, ConnectionError{
+			PROTOCOL_ERROR,
+			fmt.Sprintf("Stream identifier %d was not greater than %d", id, r.lastPeerId),
+		}
+	}
+
+	r.closeIdleStreams(id)
+	r.lastPeerId = id
+
+	s := r.newStream(id)
+	r.streams[id] = s
+
+	return s, nil
+}
+
+func (r *streamRegistry) newStream(id uint32) *Stream {
+	s := NewStream(id)
+	s.sendWindow = r.initialSendWindow
+	s.recvWindow = r.initialRecvWindow
+
+	return s
+}
+
+// closeIdleStreams implicitly closes any idle streams from the same side
+// with identifiers lower than id, which has just been used.
+func (r *streamRegistry) closeIdleStreams(id uint32) {
+	for otherId, s := range r.streams {
+		if otherId < id && otherId%2 == id%2 && s.state == StreamIdle {
+			s.close(closedByEndStream)
+			delete(r.streams, otherId)
+		}
+	}
+}
+
+// get returns the stream with the given identifier.  Streams that are no
+// longer tracked are either still idle or already closed; frames in flight
+// on a stream that we have forgotten are ignored.
+func (r *streamRegistry) get(id uint32) (*Stream, bool) {
+	if s, ok := r.streams[id]; ok {
+		return s, true
+	}
+
+	s := NewStream(id)
+	if r.isLocal(id) && id < r.nextLocalId || !r.isLocal(id) && id <= r.lastPeerId {
+		reason, ok := r.closed[id]
+		if !ok {
+			reason = closedByLocalReset
+		}
+		s.close(reason)
+	}
+
+	return s, false
+}
+
+// send updates the state of a local or peer stream for a frame we are
+// about to send on it.
+func (r *streamRegistry) send(f Frame) error {
+	streamId := frameStreamId(f)
+	s, tracked := r.get(streamId)
+	if _, ok := f.(PRIORITY); !ok && !tracked && s.state == StreamIdle {
+		return fmt.Errorf("Stream %d has not been allocated", streamId)
+	}
+
+	if pp, ok := unwrapHeaderBlock(f).(PUSH_PROMISE); ok {
+		promised, tracked := r.get(pp.PromisedStreamId)
+		if !tracked || !r.isLocal(promised.Id) {
+			return fmt.Errorf("Stream %d was not allocated for a promise", pp.PromisedStreamId)
+		}
+		if err := s.Send(f); err != nil {
+			return err
+		}
+		return r.sent(promised, promised.Send(f))
+	}
+
+	return r.sent(s, s.Send(f))
+}
+
+func (r *streamRegistry) sent(s *Stream, err error) error {
+	if err == nil && r.isLocal(s.Id) && s.Id > r.lastLocalId {
+		r.closeIdleStreams(s.Id)
+		r.lastLocalId = s.Id
+	}
+
+	return r.update(s, err)
+}
+
+// receive updates the state of the stream that f was sent on, opening or
+// reserving streams initiated by the peer.
+func (r *streamRegistry) receive(f Frame) error {
+	streamId := frameStreamId(f)
+	s, tracked := r.get(streamId)
+
+	switch f := unwrapHeaderBlock(f).(type) {
+	case HEADERS:
+		if !tracked && (s.state == StreamIdle || !r.isLocal(streamId)) {
+			var err error
+			if s, err = r.newPeerStream(streamId); err != nil {
+				return err
+			}
+		}
+	case PUSH_PROMISE:
+		// http://tools.ietf.org/html/rfc9113#section-8.4
+		if r.server {
+			return ConnectionError{PROTOCOL_ERROR, "Clients cannot send PUSH_PROMISE"}
+		}
+		if err := s.Receive(f); err != nil {
+			return r.update(s, err)
+		}
+		promised, err := r.newPeerStream(f.PromisedStreamId)
+		if err != nil {
+			return err
+		}
+		return r.update(promised, promised.Receive(f))
+	}
+
+	return r.update(s, s.Receive(f))
+}
+
+// update stops tracking streams once they have closed, remembering how.
+func (r *streamRegistry) update(s *Stream, err error) error {
+	if _, tracked := r.streams[s.Id]; tracked && s.state == StreamClosed {
+		delete(r.streams, s.Id)
+
+		r.closed[s.Id] = s.closeReason
+		r.closedOrder = append(r.closedOrder, s.Id)
+		if len(r.closedOrder) > maxClosedStreams {
+			delete(r.closed, r.closedOrder[0])
+			r.closedOrder = r.closedOrder[1:]
+		}
+	}
+
+	return err
+}
+
+func frameStreamId(f Frame) uint32 {
+	switch f := f.(type) {
+	case DATA:
+		return f.StreamId
+	case HEADERS:
+		return f.StreamId
+	case PRIORITY:
+		return f.StreamId
+	case RST_STREAM:
+		return f.StreamId
+	case PUSH_PROMISE:
+		return f.StreamId
+	case WINDOW_UPDATE:
+		return f.StreamId
+	case CONTINUATION:
+		return f.StreamId
+	case HeaderBlock:
+		return f.StreamId
+	}
+
+	return 0
+}
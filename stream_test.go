@@ -0,0 +1,343 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func headersFrame(streamId uint32, endStream bool) HEADERS {
+	f := HEADERS{StreamId: streamId}
+	f.Flags.END_HEADERS = true
+	f.Flags.END_STREAM = endStream
+	return f
+}
+
+func dataFrame(streamId uint32, endStream bool) DATA {
+	f := DATA{StreamId: streamId, Data: "hello"}
+	f.Flags.END_STREAM = endStream
+	return f
+}
+
+func TestStreamStartsIdle(t *testing.T) {
+	s := NewStream(1)
+
+	assert.Equal(t, s.State(), StreamIdle)
+	assert.Equal(t, s.State().String(), "idle")
+}
+
+func TestStreamRequestAndResponse(t *testing.T) {
+	s := NewStream(1)
+
+	assert.Nil(t, s.Receive(headersFrame(1, false)))
+	assert.Equal(t, s.State(), StreamOpen)
+
+	assert.Nil(t, s.Receive(dataFrame(1, true)))
+	assert.Equal(t, s.State(), StreamHalfClosedRemote)
+
+	assert.Nil(t, s.Send(headersFrame(1, false)))
+	assert.Nil(t, s.Send(dataFrame(1, true)))
+	assert.Equal(t, s.State(), StreamClosed)
+}
+
+func TestStreamHeadersWithEndStream(t *testing.T) {
+	s := NewStream(1)
+
+	assert.Nil(t, s.Send(headersFrame(1, true)))
+	assert.Equal(t, s.State(), StreamHalfClosedLocal)
+
+	assert.Nil(t, s.Receive(headersFrame(1, true)))
+	assert.Equal(t, s.State(), StreamClosed)
+}
+
+func TestStreamHeaderBlockDrivesState(t *testing.T) {
+	s := NewStream(1)
+
+	assert.Nil(t, s.Receive(HeaderBlock{StreamId: 1, Frame: headersFrame(1, true)}))
+	assert.Equal(t, s.State(), StreamHalfClosedRemote)
+}
+
+func TestStreamReservedLocal(t *testing.T) {
+	associated := NewStream(1)
+	promised := NewStream(2)
+	assert.Nil(t, associated.Receive(headersFrame(1, true)))
+
+	pp := PUSH_PROMISE{StreamId: 1, PromisedStreamId: 2}
+	assert.Nil(t, associated.Send(pp))
+	assert.Nil(t, promised.Send(pp))
+	assert.Equal(t, promised.State(), StreamReservedLocal)
+
+	assert.Equal(t, promised.Receive(dataFrame(2, false)), ConnectionError{
+		PROTOCOL_ERROR,
+		"Received DATA frame on reserved (local) stream 2",
+	})
+	assert.Nil(t, promised.Receive(WINDOW_UPDATE{2, 100}))
+
+	assert.Nil(t, promised.Send(headersFrame(2, false)))
+	assert.Equal(t, promised.State(), StreamHalfClosedRemote)
+}
+
+func TestStreamReservedRemote(t *testing.T) {
+	associated := NewStream(1)
+	promised := NewStream(2)
+	assert.Nil(t, associated.Send(headersFrame(1, true)))
+
+	pp := PUSH_PROMISE{StreamId: 1, PromisedStreamId: 2}
+	assert.Nil(t, associated.Receive(pp))
+	assert.Nil(t, promised.Receive(pp))
+	assert.Equal(t, promised.State(), StreamReservedRemote)
+
+	assert.NotNil(t, promised.Send(headersFrame(2, false)))
+	assert.Nil(t, promised.Send(WINDOW_UPDATE{2, 100}))
+
+	assert.Nil(t, promised.Receive(headersFrame(2, true)))
+	assert.Equal(t, promised.State(), StreamClosed)
+}
+
+func TestStreamPushPromiseOnClosedStream(t *testing.T) {
+	s := NewStream(1)
+	assert.Nil(t, s.Send(headersFrame(1, true)))
+	assert.Nil(t, s.Receive(headersFrame(1, true)))
+
+	assert.Equal(t, s.Receive(PUSH_PROMISE{StreamId: 1, PromisedStreamId: 2}), ConnectionError{
+		PROTOCOL_ERROR,
+		"Received PUSH_PROMISE frame on closed stream 1",
+	})
+}
+
+func TestStreamPushPromiseReusingStream(t *testing.T) {
+	s := NewStream(2)
+	assert.Nil(t, s.Receive(PUSH_PROMISE{StreamId: 1, PromisedStreamId: 2}))
+
+	assert.Equal(t, s.Receive(PUSH_PROMISE{StreamId: 1, PromisedStreamId: 2}), ConnectionError{
+		PROTOCOL_ERROR,
+		"Received PUSH_PROMISE frame on reserved (remote) stream 2",
+	})
+}
+
+func TestStreamFramesOnIdleStream(t *testing.T) {
+	for _, f := range []Frame{dataFrame(1, false), RST_STREAM{1, CANCEL}, WINDOW_UPDATE{1, 10}} {
+		s := NewStream(1)
+		assert.IsType(t, s.Receive(f), ConnectionError{})
+		assert.Equal(t, s.Receive(f).(ConnectionError).Code, PROTOCOL_ERROR)
+		assert.Equal(t, s.State(), StreamIdle)
+	}
+
+	s := NewStream(1)
+	assert.Nil(t, s.Receive(PRIORITY{StreamId: 1, Weight: 16}))
+	assert.Equal(t, s.State(), StreamIdle, "PRIORITY should not open a stream")
+}
+
+func TestStreamDataOnHalfClosedRemote(t *testing.T) {
+	s := NewStream(1)
+	assert.Nil(t, s.Receive(headersFrame(1, true)))
+
+	assert.Equal(t, s.Receive(dataFrame(1, false)), StreamError{
+		1,
+		STREAM_CLOSED,
+		"Received DATA frame on half-closed stream 1",
+	})
+	assert.Nil(t, s.Receive(WINDOW_UPDATE{1, 10}))
+}
+
+func TestStreamCannotSendAfterEndStream(t *testing.T) {
+	s := NewStream(1)
+	assert.Nil(t, s.Send(headersFrame(1, true)))
+
+	assert.EqualError(t, s.Send(dataFrame(1, false)),
+		"Cannot send DATA frame on half-closed (local) stream 1")
+	assert.Nil(t, s.Send(WINDOW_UPDATE{1, 10}))
+	assert.Equal(t, s.State(), StreamHalfClosedLocal)
+}
+
+func TestStreamReceivedReset(t *testing.T) {
+	s := NewStream(1)
+	assert.Nil(t, s.Receive(headersFrame(1, false)))
+	assert.Nil(t, s.Receive(RST_STREAM{1, CANCEL}))
+	assert.Equal(t, s.State(), StreamClosed)
+
+	assert.Nil(t, s.Receive(PRIORITY{StreamId: 1, Weight: 16}))
+	assert.Equal(t, s.Receive(WINDOW_UPDATE{1, 10}), StreamError{
+		1,
+		STREAM_CLOSED,
+		"Received WINDOW_UPDATE frame on stream 1 after RST_STREAM",
+	})
+	assert.EqualError(t, s.Send(RST_STREAM{1, CANCEL}),
+		"Cannot send RST_STREAM frame on closed stream 1")
+}
+
+func TestStreamSentResetIgnoresFramesInFlight(t *testing.T) {
+	s := NewStream(1)
+	assert.Nil(t, s.Receive(headersFrame(1, false)))
+	assert.Nil(t, s.Send(RST_STREAM{1, CANCEL}))
+	assert.Equal(t, s.State(), StreamClosed)
+
+	assert.Nil(t, s.Receive(dataFrame(1, false)))
+	assert.Nil(t, s.Receive(headersFrame(1, true)))
+}
+
+func TestStreamFramesAfterEndStream(t *testing.T) {
+	s := NewStream(1)
+	assert.Nil(t, s.Receive(headersFrame(1, true)))
+	assert.Nil(t, s.Send(headersFrame(1, true)))
+
+	assert.Nil(t, s.Receive(WINDOW_UPDATE{1, 10}))
+	assert.Nil(t, s.Receive(RST_STREAM{1, NO_ERROR}))
+	assert.Equal(t, s.Receive(dataFrame(1, false)), ConnectionError{
+		STREAM_CLOSED,
+		"Received DATA frame on closed stream 1",
+	})
+}
+
+func TestRegistryAllocatesLocalStreamIds(t *testing.T) {
+	server := newStreamRegistry(true)
+	client := newStreamRegistry(false)
+
+	for _, expected := range []uint32{2, 4, 6} {
+		s, err := server.newLocalStream()
+		assert.Nil(t, err)
+		assert.Equal(t, s.Id, expected)
+	}
+	for _, expected := range []uint32{1, 3, 5} {
+		s, err := client.newLocalStream()
+		assert.Nil(t, err)
+		assert.Equal(t, s.Id, expected)
+	}
+}
+
+func TestRegistryReportsExhaustedStreamIds(t *testing.T) {
+	r := newStreamRegistry(false)
+	r.nextLocalId = maxStreamId
+
+	s, err := r.newLocalStream()
+	assert.Nil(t, err)
+	assert.Equal(t, s.Id, uint32(maxStreamId))
+
+	_, err = r.newLocalStream()
+	assert.Equal(t, err, ErrStreamIdsExhausted)
+}
+
+func TestRegistryOpensPeerStreams(t *testing.T) {
+	r := newStreamRegistry(true)
+
+	assert.Nil(t, r.receive(headersFrame(1, false)))
+	assert.Nil(t, r.receive(headersFrame(5, false)))
+
+	s, tracked := r.get(5)
+	assert.True(t, tracked)
+	assert.Equal(t, s.State(), StreamOpen)
+	assert.Equal(t, r.lastPeerId, uint32(5))
+}
+
+func TestRegistryRejectsDecreasingPeerStreamIds(t *testing.T) {
+	r := newStreamRegistry(true)
+	assert.Nil(t, r.receive(headersFrame(5, false)))
+
+	assert.Equal(t, r.receive(headersFrame(3, false)), ConnectionError{
+		PROTOCOL_ERROR,
+		"Stream identifier 3 was not greater than 5",
+	}, "Skipped stream 3 should have been implicitly closed")
+}
+
+func TestRegistryRejectsReusedPeerStreamIds(t *testing.T) {
+	r := newStreamRegistry(true)
+	assert.Nil(t, r.receive(headersFrame(1, true)))
+	assert.Nil(t, r.send(headersFrame(1, true)))
+
+	_, tracked := r.get(1)
+	assert.False(t, tracked, "Closed streams should no longer be tracked")
+	assert.Equal(t, r.receive(headersFrame(1, false)), ConnectionError{
+		PROTOCOL_ERROR,
+		"Stream identifier 1 was not greater than 1",
+	})
+}
+
+func TestRegistryRejectsPeerStreamsWithOurParity(t *testing.T) {
+	r := newStreamRegistry(true)
+
+	assert.Equal(t, r.receive(headersFrame(2, false)), ConnectionError{
+		PROTOCOL_ERROR,
+		"Stream 2 cannot be initiated by the peer",
+	})
+}
+
+func TestRegistryFramesOnIdleStreams(t *testing.T) {
+	r := newStreamRegistry(true)
+
+	assert.Equal(t, r.receive(dataFrame(3, false)), ConnectionError{
+		PROTOCOL_ERROR,
+		"Received DATA frame on idle stream 3",
+	})
+	assert.Nil(t, r.receive(PRIORITY{StreamId: 3, Weight: 16}))
+}
+
+func TestRegistryIgnoresFramesOnForgottenStreams(t *testing.T) {
+	r := newStreamRegistry(true)
+	assert.Nil(t, r.receive(headersFrame(1, false)))
+	assert.Nil(t, r.send(RST_STREAM{1, CANCEL}))
+
+	assert.Nil(t, r.receive(dataFrame(1, false)))
+}
+
+func TestRegistryRejectsFramesOnStreamsClosedByEndStream(t *testing.T) {
+	r := newStreamRegistry(true)
+	assert.Nil(t, r.receive(headersFrame(1, true)))
+	assert.Nil(t, r.send(headersFrame(1, true)))
+
+	assert.Nil(t, r.receive(WINDOW_UPDATE{1, 1}))
+	assert.Equal(t, r.receive(dataFrame(1, false)), ConnectionError{
+		STREAM_CLOSED,
+		"Received DATA frame on closed stream 1",
+	})
+}
+
+func TestRegistryForgetsOldestClosedStreams(t *testing.T) {
+	r := newStreamRegistry(true)
+	for id := uint32(1); id <= 2*maxClosedStreams+1; id += 2 {
+		assert.Nil(t, r.receive(headersFrame(id, true)))
+		assert.Nil(t, r.send(headersFrame(id, true)))
+	}
+
+	assert.Equal(t, len(r.closed), maxClosedStreams)
+	assert.Nil(t, r.receive(dataFrame(1, false)),
+		"Frames on forgotten streams should be ignored")
+	assert.NotNil(t, r.receive(dataFrame(2*maxClosedStreams+1, false)))
+}
+
+func TestRegistryImplicitlyClosesSkippedLocalStreams(t *testing.T) {
+	r := newStreamRegistry(false)
+	first, _ := r.newLocalStream()
+	second, _ := r.newLocalStream()
+
+	assert.Nil(t, r.send(headersFrame(second.Id, false)))
+	assert.Equal(t, first.State(), StreamClosed)
+	assert.EqualError(t, r.send(headersFrame(first.Id, false)),
+		"Cannot send HEADERS frame on closed stream 1")
+}
+
+func TestRegistryRejectsUnallocatedLocalStreams(t *testing.T) {
+	r := newStreamRegistry(false)
+
+	assert.EqualError(t, r.send(headersFrame(1, false)), "Stream 1 has not been allocated")
+}
+
+func TestRegistryPushPromise(t *testing.T) {
+	server := newStreamRegistry(true)
+	client := newStreamRegistry(false)
+
+	request, _ := client.newLocalStream()
+	assert.Nil(t, client.send(headersFrame(request.Id, true)))
+	assert.Nil(t, server.receive(headersFrame(request.Id, true)))
+
+	promised, err := server.newLocalStream()
+	assert.Nil(t, err)
+	pp := PUSH_PROMISE{StreamId: request.Id, PromisedStreamId: promised.Id}
+	assert.Nil(t, server.send(pp))
+	assert.Equal(t, promised.State(), StreamReservedLocal)
+
+	assert.Nil(t, client.receive(pp))
+	s, tracked := client.get(promised.Id)
+	assert.True(t, tracked)
+	assert.Equal(t, s.State(), StreamReservedRemote)
+
+	assert.Equal(t, server.receive(pp), ConnectionError{PROTOCOL_ERROR, "Clients cannot send PUSH_PROMISE"})
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// http://tools.ietf.org/html/rfc9113#section-6.5.2
+const defaultMaxFrameSize = 16384
+
+// FrameWriter writes frames to a connection, splitting header blocks that do
+// not fit in a single frame into HEADERS or PUSH_PROMISE frames followed by
+// CONTINUATION frames.
+type FrameWriter struct {
+	// MaxFrameSize is the largest frame payload the peer accepts, as
+	// advertised in its SETTINGS_MAX_FRAME_SIZE
+	MaxFrameSize uint32
+
+	codec   FrameCodec
+	w       io.Writer
+	encoder *Encoder
+}
+
+func NewFrameWriter(w io.Writer, codec FrameCodec, encoder *Encoder) *FrameWriter {
+	maxFrameSize := uint32(defaultMaxFrameSize)
+	if codec.Version == Draft12 {
+		// Draft12 frames have a 14-bit length field
+		maxFrameSize = 0x3FFF
+	}
+
+	return &FrameWriter{
+		MaxFrameSize: maxFrameSize,
+		codec:        codec,
+		w:            w,
+		encoder:      encoder,
+	}
+}
+
+// WriteFrame writes f, splitting DATA frames and complete header blocks
+// that are larger than MaxFrameSize.  Other frames that are too large are
+// not written, nor are frames with more padding than the codec can encode.
+// http://tools.ietf.org/html/rfc9113#section-4.2
+func (w *FrameWriter) WriteFrame(f Frame) error {
+	if err := w.codec.checkPadding(framePadding(f)); err != nil {
+		return err
+	}
+
+	wire := w.codec.Marshal(f)
+	if length := len(wire) - w.codec.headerLength(); length > int(w.MaxFrameSize) {
+		switch h := f.(type) {
+		case DATA:
+			return w.writeData(h)
+		case HEADERS:
+			if h.Flags.END_HEADERS {
+				return w.WriteHeaderBlock(h)
+			}
+		case PUSH_PROMISE:
+			if h.Flags.END_HEADERS {
+				return w.WriteHeaderBlock(h)
+			}
+		case HeaderBlock:
+			return w.WriteHeaderBlock(h)
+		}
+
+		return fmt.Errorf("%T frame length of %d exceeds maximum frame size of %d", f, length, w.MaxFrameSize)
+	}
+
+	_, err := w.w.Write(wire)
+	return err
+}
+
+// writeData writes f as DATA frames no larger than MaxFrameSize, with its
+// padding and END_STREAM on the last of them.
+func (w *FrameWriter) writeData(f DATA) error {
+	overhead := w.paddingOverhead(f.Padding)
+	if f.Flags.PADDED && overhead == 0 {
+		// An empty Pad Length field
+		overhead = 1
+	}
+	if overhead > int(w.MaxFrameSize) {
+		return fmt.Errorf("DATA frame padding of %d exceeds maximum frame size of %d", overhead, w.MaxFrameSize)
+	}
+
+	var wire []byte
+	data := f.Data
+	for len(data)+overhead > int(w.MaxFrameSize) {
+		n := len(data)
+		if n > int(w.MaxFrameSize) {
+			n = int(w.MaxFrameSize)
+		}
+		wire = append(wire, w.codec.Marshal(DATA{StreamId: f.StreamId, Data: data[0:n]})...)
+		data = data[n:]
+	}
+	f.Data = data
+	wire = append(wire, w.codec.Marshal(f)...)
+
+	_, err := w.w.Write(wire)
+	return err
+}
+
+// WriteHeaders encodes fields and writes them as the header block of a
+// HEADERS frame on streamId.
+func (w *FrameWriter) WriteHeaders(streamId uint32, fields []HeaderField, endStream bool) error {
+	f := HEADERS{StreamId: streamId}
+	f.Flags.END_STREAM = endStream
+	f.HeaderBlockFragment = w.encoder.Encode(fields)
+
+	return w.WriteHeaderBlock(f)
+}
+
+// WritePushPromise encodes fields and writes them as the header block of a
+// PUSH_PROMISE frame reserving promisedStreamId.
+func (w *FrameWriter) WritePushPromise(streamId uint32, promisedStreamId uint32, fields []HeaderField) error {
+	f := PUSH_PROMISE{StreamId: streamId, PromisedStreamId: promisedStreamId}
+	f.HeaderBlockFragment = w.encoder.Encode(fields)
+
+	return w.WriteHeaderBlock(f)
+}
+
+// WriteHeaderBlock writes a HEADERS, PUSH_PROMISE or HeaderBlock whose
+// HeaderBlockFragment is a complete header block.  END_HEADERS is set on the
+// last frame written; every frame is written with a single call to Write so
+// that nothing can be interleaved with the header block.
+// http://tools.ietf.org/html/rfc9113#section-4.3
+func (w *FrameWriter) WriteHeaderBlock(f Frame) error {
+	if b, ok := f.(HeaderBlock); ok {
+		f = b.Frame
+	}
+	if err := w.codec.checkPadding(framePadding(f)); err != nil {
+		return err
+	}
+
+	var streamId uint32
+	var block string
+	var overhead int
+
+	switch h := f.(type) {
+	case HEADERS:
+		streamId, block = h.StreamId, h.HeaderBlockFragment
+		overhead = w.paddingOverhead(h.Padding)
+		if h.Flags.PRIORITY {
+			overhead += 5
+		}
+	case PUSH_PROMISE:
+		streamId, block = h.StreamId, h.HeaderBlockFragment
+		overhead = 4 + w.paddingOverhead(h.Padding)
+	default:
+		return fmt.Errorf("Cannot write %T as a header block", f)
+	}
+
+	capacity := int(w.MaxFrameSize) - overhead
+	if capacity <= 0 {
+		return fmt.Errorf("Header block frame overhead of %d exceeds maximum frame size of %d", overhead, w.MaxFrameSize)
+	}
+
+	first := block
+	if len(first) > capacity {
+		first = block[0:capacity]
+	}
+	block = block[len(first):]
+
+	var wire []byte
+	switch h := f.(type) {
+	case HEADERS:
+		h.HeaderBlockFragment = first
+		h.Flags.END_HEADERS = len(block) == 0
+		wire = w.codec.Marshal(h)
+	case PUSH_PROMISE:
+		h.HeaderBlockFragment = first
+		h.Flags.END_HEADERS = len(block) == 0
+		wire = w.codec.Marshal(h)
+	}
+
+	for len(block) > 0 {
+		c := CONTINUATION{StreamId: streamId}
+		c.HeaderBlockFragment = block
+		if len(block) > int(w.MaxFrameSize) {
+			c.HeaderBlockFragment = block[0:w.MaxFrameSize]
+		}
+		block = block[len(c.HeaderBlockFragment):]
+		c.Flags.END_HEADERS = len(block) == 0
+
+		wire = append(wire, w.codec.Marshal(c)...)
+	}
+
+	_, err := w.w.Write(wire)
+	return err
+}
+
+func (w *FrameWriter) paddingOverhead(padding string) int {
+	b := base{}
+	return len(paddingHeaders(w.codec, &b, &padding)) + len(padding)
+}
+
+// framePadding returns the padding of a DATA, HEADERS or PUSH_PROMISE frame.
+func framePadding(f Frame) string {
+	switch f := unwrapHeaderBlock(f).(type) {
+	case DATA:
+		return f.Padding
+	case HEADERS:
+		return f.Padding
+	case PUSH_PROMISE:
+		return f.Padding
+	}
+
+	return ""
+}
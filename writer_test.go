@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func NewTestFrameWriter(maxFrameSize uint32) (*FrameWriter, *MockConn) {
+	conn := NewMockConn()
+	w := NewFrameWriter(conn, FrameCodec{}, NewEncoder(defaultHeaderTableSize))
+	w.MaxFrameSize = maxFrameSize
+
+	return w, conn
+}
+
+func readAllFrames(t *testing.T, wire []byte) []Frame {
+	frames := make([]Frame, 0)
+	for len(wire) > 0 {
+		advance, f, err := Unmarshal(wire)
+		assert.Nil(t, err)
+		assert.NotNil(t, f)
+		if f == nil {
+			break
+		}
+		frames = append(frames, f)
+		wire = wire[advance:]
+	}
+	return frames
+}
+
+func TestFrameWriterWritesSmallHeaderBlockInOneFrame(t *testing.T) {
+	w, conn := NewTestFrameWriter(defaultMaxFrameSize)
+
+	err := w.WriteHeaders(1, readerFields, true)
+
+	expected := HEADERS{StreamId: 1}
+	expected.HeaderBlockFragment = NewEncoder(defaultHeaderTableSize).Encode(readerFields)
+	expected.Flags.END_STREAM = true
+	expected.Flags.END_HEADERS = true
+
+	assert.Nil(t, err)
+	assert.Equal(t, readAllFrames(t, conn.written), []Frame{expected})
+}
+
+func TestFrameWriterSplitsHEADERSIntoCONTINUATION(t *testing.T) {
+	w, conn := NewTestFrameWriter(16)
+	h := HEADERS{StreamId: 3, HeaderBlockFragment: strings.Repeat("a", 40)}
+	h.Flags.END_STREAM = true
+
+	err := w.WriteHeaderBlock(h)
+
+	first := HEADERS{StreamId: 3, HeaderBlockFragment: strings.Repeat("a", 16)}
+	first.Flags.END_STREAM = true
+	second := CONTINUATION{StreamId: 3, HeaderBlockFragment: strings.Repeat("a", 16)}
+	third := CONTINUATION{StreamId: 3, HeaderBlockFragment: strings.Repeat("a", 8)}
+	third.Flags.END_HEADERS = true
+
+	assert.Nil(t, err)
+	assert.Equal(t, readAllFrames(t, conn.written), []Frame{first, second, third})
+}
+
+func TestFrameWriterAccountsForPriorityAndPadding(t *testing.T) {
+	w, conn := NewTestFrameWriter(16)
+	h := HEADERS{StreamId: 3, HeaderBlockFragment: strings.Repeat("a", 20), Padding: "\x00\x00"}
+	h.StreamDependency = 1
+	h.Weight = 10
+	h.Flags.PRIORITY = true
+
+	err := w.WriteHeaderBlock(h)
+	frames := readAllFrames(t, conn.written)
+
+	assert.Nil(t, err)
+	assert.Equal(t, len(frames), 2)
+	first := frames[0].(HEADERS)
+	assert.Equal(t, first.HeaderBlockFragment, strings.Repeat("a", 8),
+		"Fragment should have filled the frame after the pad length, priority and padding")
+	assert.Equal(t, first.Padding, "\x00\x00")
+	assert.True(t, first.Flags.PRIORITY)
+	assert.False(t, first.Flags.END_HEADERS)
+	assert.Equal(t, frames[1].(CONTINUATION).HeaderBlockFragment, strings.Repeat("a", 12))
+	assert.True(t, frames[1].(CONTINUATION).Flags.END_HEADERS)
+}
+
+func TestFrameWriterSplitsPUSH_PROMISE(t *testing.T) {
+	w, conn := NewTestFrameWriter(16)
+	block := NewEncoder(defaultHeaderTableSize).Encode(readerFields)
+
+	err := w.WritePushPromise(1, 2, readerFields)
+	frames := readAllFrames(t, conn.written)
+
+	assert.Nil(t, err)
+	assert.Equal(t, frames[0].(PUSH_PROMISE).PromisedStreamId, uint32(2))
+	assert.Equal(t, frames[0].(PUSH_PROMISE).HeaderBlockFragment, block[0:12])
+
+	reassembled := ""
+	for _, f := range frames {
+		switch f := f.(type) {
+		case PUSH_PROMISE:
+			reassembled += f.HeaderBlockFragment
+		case CONTINUATION:
+			assert.Equal(t, f.StreamId, uint32(1))
+			reassembled += f.HeaderBlockFragment
+		}
+	}
+	assert.Equal(t, reassembled, block)
+	assert.True(t, frames[len(frames)-1].(CONTINUATION).Flags.END_HEADERS)
+}
+
+func TestFrameWriterRoundTripsThroughFrameReader(t *testing.T) {
+	w, conn := NewTestFrameWriter(10)
+	fields := append(readerFields, HeaderField{Name: "user-agent", Value: strings.Repeat("x", 100)})
+
+	assert.Nil(t, w.WriteHeaders(5, fields, false))
+	assert.Nil(t, w.WriteFrame(PING{OpaqueData: 1}))
+
+	conn.readData = [][]byte{conn.written}
+	r := NewFrameReader(conn, FrameCodec{}, NewDecoder(defaultHeaderTableSize))
+
+	f, err := r.ReadFrame()
+	assert.Nil(t, err)
+	assert.Equal(t, f.(HeaderBlock).Fields, fields)
+
+	f, err = r.ReadFrame()
+	assert.Nil(t, err)
+	assert.Equal(t, f, PING{OpaqueData: 1})
+}
+
+func TestFrameWriterSplitsDATA(t *testing.T) {
+	w, conn := NewTestFrameWriter(defaultMaxFrameSize)
+
+	f := DATA{StreamId: 1, Data: strings.Repeat("a", 2*defaultMaxFrameSize-5), Padding: "\x00\x00\x00\x00\x00"}
+	f.Flags.END_STREAM = true
+	f.Flags.PADDED = true
+	assert.Nil(t, w.WriteFrame(f))
+
+	last := DATA{StreamId: 1, Padding: f.Padding}
+	last.Flags.END_STREAM = true
+	last.Flags.PADDED = true
+
+	assert.Equal(t, readAllFrames(t, conn.written), []Frame{
+		DATA{StreamId: 1, Data: strings.Repeat("a", defaultMaxFrameSize)},
+		// The padding does not fit alongside the rest of the data
+		DATA{StreamId: 1, Data: strings.Repeat("a", defaultMaxFrameSize-5)},
+		last,
+	})
+}
+
+func TestFrameWriterSplitsHeaderBlockWrittenAsFrame(t *testing.T) {
+	w, conn := NewTestFrameWriter(defaultMaxFrameSize)
+
+	f := HEADERS{StreamId: 1, HeaderBlockFragment: strings.Repeat("a", defaultMaxFrameSize+1)}
+	f.Flags.END_HEADERS = true
+	assert.Nil(t, w.WriteFrame(f))
+
+	frames := readAllFrames(t, conn.written)
+	assert.Equal(t, len(frames), 2)
+	assert.IsType(t, frames[1], CONTINUATION{})
+}
+
+func TestFrameWriterRejectsOversizeFrame(t *testing.T) {
+	w, conn := NewTestFrameWriter(defaultMaxFrameSize)
+
+	err := w.WriteFrame(GOAWAY{0, NO_ERROR, strings.Repeat("a", defaultMaxFrameSize)})
+
+	assert.NotNil(t, err)
+	assert.Equal(t, len(conn.written), 0)
+}
+
+func TestFrameWriterRejectsOverheadLargerThanFrame(t *testing.T) {
+	w, conn := NewTestFrameWriter(4)
+
+	err := w.WriteHeaderBlock(PUSH_PROMISE{StreamId: 1, PromisedStreamId: 2, HeaderBlockFragment: "a"})
+
+	assert.NotNil(t, err)
+	assert.Equal(t, len(conn.written), 0)
+}
+
+func TestFrameWriterRejectsOtherFrames(t *testing.T) {
+	w, _ := NewTestFrameWriter(defaultMaxFrameSize)
+
+	assert.NotNil(t, w.WriteHeaderBlock(PING{}))
+}
+
+func TestFrameWriterRejectsPaddingTooLongToEncode(t *testing.T) {
+	w, conn := NewTestFrameWriter(defaultMaxFrameSize)
+	padding := strings.Repeat("\x00", 256)
+
+	assert.Equal(t, w.WriteFrame(DATA{StreamId: 1, Data: "a", Padding: padding}),
+		fmt.Errorf("Padding of 256 octets exceeds the maximum of 255"))
+	assert.Equal(t, w.WriteHeaderBlock(HEADERS{StreamId: 1, HeaderBlockFragment: "a", Padding: padding}),
+		fmt.Errorf("Padding of 256 octets exceeds the maximum of 255"))
+	assert.Equal(t, w.WriteFrame(PUSH_PROMISE{StreamId: 1, PromisedStreamId: 2, Padding: padding}),
+		fmt.Errorf("Padding of 256 octets exceeds the maximum of 255"))
+	assert.Equal(t, len(conn.written), 0)
+
+	d := NewFrameWriter(conn, draft12, NewEncoder(defaultHeaderTableSize))
+	assert.Nil(t, d.WriteFrame(DATA{StreamId: 1, Data: "a", Padding: padding}),
+		"Draft12 can encode up to 65535 octets of padding")
+	assert.Equal(t, d.WriteFrame(DATA{StreamId: 1, Data: "a", Padding: strings.Repeat("\x00", 0x10000)}),
+		fmt.Errorf("Padding of 65536 octets exceeds the maximum of 65535"))
+}
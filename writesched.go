@@ -0,0 +1,125 @@
+package main
+
+// WriteScheduler chooses the order in which frames queued on streams are
+// written.  Control frames such as SETTINGS and PING acknowledgements,
+// RST_STREAM and GOAWAY never pass through the scheduler, so they are
+// written ahead of anything queued in it.
+type WriteScheduler interface {
+	// Prioritize applies the priority the peer signalled in a HEADERS,
+	// PRIORITY or PRIORITY_UPDATE frame; other frames are ignored.
+	Prioritize(f Frame) error
+	// CloseStream discards a stream, returning any frames that were still
+	// queued for it.
+	CloseStream(streamId uint32) []Frame
+	// Push queues a frame to be written on its stream.
+	Push(f Frame)
+	// Pop returns the next frame to write, if any are queued.
+	Pop() (Frame, bool)
+}
+
+// FIFOWriteScheduler writes frames in the order they were queued,
+// whichever stream they are on.
+type FIFOWriteScheduler struct {
+	queue []Frame
+}
+
+func NewFIFOWriteScheduler() *FIFOWriteScheduler {
+	return &FIFOWriteScheduler{}
+}
+
+func (s *FIFOWriteScheduler) Prioritize(f Frame) error {
+	return nil
+}
+
+func (s *FIFOWriteScheduler) CloseStream(streamId uint32) []Frame {
+	dropped := []Frame{}
+	queue := s.queue[0:0]
+	for _, f := range s.queue {
+		if frameStreamId(f) != streamId {
+			queue = append(queue, f)
+		} else {
+			dropped = append(dropped, f)
+		}
+	}
+	s.queue = queue
+
+	return dropped
+}
+
+func (s *FIFOWriteScheduler) Push(f Frame) {
+	s.queue = append(s.queue, f)
+}
+
+func (s *FIFOWriteScheduler) Pop() (Frame, bool) {
+	if len(s.queue) == 0 {
+		return nil, false
+	}
+
+	f := s.queue[0]
+	s.queue = s.queue[1:]
+	return f, true
+}
+
+type roundRobinStream struct {
+	id    uint32
+	queue []Frame
+}
+
+// RoundRobinWriteScheduler takes one frame from each stream with frames
+// queued in turn, ignoring any priority signalled by the peer.
+type RoundRobinWriteScheduler struct {
+	streams []*roundRobinStream
+	// next is the index in streams of the stream to try first
+	next int
+}
+
+func NewRoundRobinWriteScheduler() *RoundRobinWriteScheduler {
+	return &RoundRobinWriteScheduler{}
+}
+
+func (s *RoundRobinWriteScheduler) Prioritize(f Frame) error {
+	return nil
+}
+
+func (s *RoundRobinWriteScheduler) CloseStream(streamId uint32) []Frame {
+	for i, st := range s.streams {
+		if st.id == streamId {
+			s.streams = append(s.streams[0:i], s.streams[i+1:]...)
+			if i < s.next {
+				s.next--
+			}
+			if s.next >= len(s.streams) {
+				s.next = 0
+			}
+			return st.queue
+		}
+	}
+
+	return nil
+}
+
+func (s *RoundRobinWriteScheduler) Push(f Frame) {
+	streamId := frameStreamId(f)
+	for _, st := range s.streams {
+		if st.id == streamId {
+			st.queue = append(st.queue, f)
+			return
+		}
+	}
+
+	s.streams = append(s.streams, &roundRobinStream{streamId, []Frame{f}})
+}
+
+func (s *RoundRobinWriteScheduler) Pop() (Frame, bool) {
+	for i := 0; i < len(s.streams); i++ {
+		st := s.streams[(s.next+i)%len(s.streams)]
+		if len(st.queue) > 0 {
+			f := st.queue[0]
+			st.queue = st.queue[1:]
+			s.next = (s.next + i + 1) % len(s.streams)
+			return f, true
+		}
+	}
+
+	return nil, false
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func popAll(s WriteScheduler) []uint32 {
+	ids := []uint32{}
+	for f, ok := s.Pop(); ok; f, ok = s.Pop() {
+		ids = append(ids, frameStreamId(f))
+	}
+	return ids
+}
+
+func TestFIFOWriteSchedulerKeepsQueueOrder(t *testing.T) {
+	s := NewFIFOWriteScheduler()
+	s.Push(dataFrame(3, false))
+	s.Push(dataFrame(1, false))
+	s.Push(dataFrame(3, false))
+	s.Push(dataFrame(5, false))
+
+	assert.Equal(t, s.CloseStream(5), []Frame{dataFrame(5, false)})
+
+	assert.Equal(t, popAll(s), []uint32{3, 1, 3})
+}
+
+func TestRoundRobinWriteSchedulerAlternatesStreams(t *testing.T) {
+	s := NewRoundRobinWriteScheduler()
+	for i := 0; i < 3; i++ {
+		s.Push(dataFrame(1, false))
+	}
+	s.Push(dataFrame(3, false))
+	s.Push(dataFrame(5, false))
+
+	assert.Equal(t, popAll(s), []uint32{1, 3, 5, 1, 1})
+}
+
+func TestRoundRobinWriteSchedulerCloseStream(t *testing.T) {
+	s := NewRoundRobinWriteScheduler()
+	for i := 0; i < 2; i++ {
+		s.Push(dataFrame(1, false))
+		s.Push(dataFrame(3, false))
+		s.Push(dataFrame(5, false))
+	}
+
+	f, _ := s.Pop()
+	assert.Equal(t, frameStreamId(f), uint32(1))
+	assert.Equal(t, s.CloseStream(1), []Frame{dataFrame(1, false)})
+
+	assert.Equal(t, popAll(s), []uint32{3, 5, 3, 5})
+}
+
+func TestWriteSchedulersIgnoreMissingPriority(t *testing.T) {
+	schedulers := []WriteScheduler{
+		NewFIFOWriteScheduler(),
+		NewRoundRobinWriteScheduler(),
+		NewPriorityWriteScheduler(),
+		NewExtensiblePriorityWriteScheduler(),
+	}
+
+	for _, s := range schedulers {
+		assert.Nil(t, s.Prioritize(dataFrame(1, false)))
+		s.Push(dataFrame(1, false))
+		assert.Equal(t, popAll(s), []uint32{1})
+	}
+}